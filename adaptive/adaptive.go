@@ -0,0 +1,213 @@
+package adaptive
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ewmaAlpha is the weight of the latest latency sample
+const ewmaAlpha = 0.2
+
+// minSamples is the number of samples needed before a latency spike is detected
+const minSamples = 5
+
+type Config struct {
+	Enabled bool `mapstructure:"enabled"`
+	// concurrency of a host when first seen
+	Initial int `mapstructure:"initial"`
+	Min     int `mapstructure:"min"`
+	// upper bound of the concurrency of a host. Bounded by the pool size as well.
+	Max int `mapstructure:"max"`
+	// a response slower than SpikeFactor times the average latency is a latency spike
+	SpikeFactor float64 `mapstructure:"spike_factor"`
+}
+
+var DefaultConfig = Config{
+	Enabled:     false,
+	Initial:     2,
+	Min:         1,
+	SpikeFactor: 3,
+}
+
+// HostState is the concurrency of a host
+//
+// @Description adaptive concurrency of a host
+type HostState struct {
+	Host     string `json:"host" example:"example.com"`
+	Limit    int    `json:"limit" example:"4"`
+	InFlight int    `json:"in_flight" example:"2"`
+	// moving average of the latency in milliseconds
+	LatencyMs int64 `json:"latency_ms" example:"250"`
+}
+
+type host struct {
+	limit    float64
+	inflight int
+	ewma     time.Duration
+	samples  int
+	// multiplicative decrease happens at most once per average latency,
+	// since the requests in flight would carry the same signal
+	lastDecrease time.Time
+}
+
+// Limiter limits the concurrency of each host with AIMD
+// (additive increase, multiplicative decrease).
+type Limiter struct {
+	mu      sync.Mutex
+	config  Config
+	hosts   map[string]*host
+	changed chan struct{}
+}
+
+// New creates a limiter bounded by maxConcurrency, which is usually the pool size.
+// It returns nil if it's not enabled, and a nil limiter allows everything.
+func New(config Config, maxConcurrency int) *Limiter {
+	if !config.Enabled {
+		return nil
+	}
+	if config.Max <= 0 || config.Max > maxConcurrency {
+		config.Max = maxConcurrency
+	}
+	if config.Min <= 0 {
+		config.Min = 1
+	}
+	if config.Min > config.Max {
+		config.Min = config.Max
+	}
+	if config.Initial < config.Min {
+		config.Initial = config.Min
+	}
+	if config.Initial > config.Max {
+		config.Initial = config.Max
+	}
+	if config.SpikeFactor <= 1 {
+		config.SpikeFactor = DefaultConfig.SpikeFactor
+	}
+	return &Limiter{
+		config:  config,
+		hosts:   make(map[string]*host),
+		changed: make(chan struct{}),
+	}
+}
+
+// get should be called with lock held
+func (l *Limiter) get(name string) *host {
+	name = strings.ToLower(name)
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &host{limit: float64(l.config.Initial)}
+		l.hosts[name] = h
+	}
+	return h
+}
+
+// notify wakes up the waiters. should be called with lock held
+func (l *Limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// TryAcquire takes a slot of the host if there's one.
+// Release must be called if it returns true.
+func (l *Limiter) TryAcquire(name string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.get(name)
+	if h.inflight >= int(h.limit) {
+		return false
+	}
+	h.inflight++
+	return true
+}
+
+// Acquire blocks until a slot of the host is taken
+func (l *Limiter) Acquire(ctx context.Context, name string) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		h := l.get(name)
+		if h.inflight < int(h.limit) {
+			h.inflight++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Release gives the slot back with the feedback of the request.
+// throttled is true if the host asked us to slow down (like 429).
+func (l *Limiter) Release(name string, latency time.Duration, throttled bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.get(name)
+	h.inflight--
+	spike := h.samples >= minSamples && float64(latency) > l.config.SpikeFactor*float64(h.ewma)
+	if h.samples == 0 {
+		h.ewma = latency
+	} else {
+		h.ewma = time.Duration(ewmaAlpha*float64(latency) + (1-ewmaAlpha)*float64(h.ewma))
+	}
+	h.samples++
+	if throttled || spike {
+		if time.Since(h.lastDecrease) > h.ewma {
+			h.limit = math.Max(float64(l.config.Min), h.limit/2)
+			h.lastDecrease = time.Now()
+		}
+	} else {
+		// +1 after a full limit of successes
+		h.limit = math.Min(float64(l.config.Max), h.limit+1/h.limit)
+	}
+	l.notify()
+}
+
+// Cancel gives the slot back without any feedback
+func (l *Limiter) Cancel(name string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.get(name).inflight--
+	l.notify()
+}
+
+// States returns the concurrency of each host, sorted by host
+func (l *Limiter) States() []HostState {
+	if l == nil {
+		return []HostState{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	states := make([]HostState, 0, len(l.hosts))
+	for name, h := range l.hosts {
+		states = append(states, HostState{
+			Host:      name,
+			Limit:     int(h.limit),
+			InFlight:  h.inflight,
+			LatencyMs: h.ewma.Milliseconds(),
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Host < states[j].Host
+	})
+	return states
+}
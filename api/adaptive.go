@@ -0,0 +1,21 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/crosstyan/dumb_downloader/adaptive"
+)
+
+// MakeGetConcurrencyHandler creates a handler that returns the adaptive concurrency of each host.
+// @Summary Get Adaptive Concurrency
+// @Description Get the current concurrency limit of each host. Empty if adaptive concurrency is disabled
+// @Tag admin
+// @Produce json
+// @Success 200 {array} adaptive.HostState
+// @Security BearerAuth
+// @Router /admin/concurrency [get]
+func MakeGetConcurrencyHandler(l *adaptive.Limiter) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		writeJson(resp, l.States(), http.StatusOK)
+	}
+}
@@ -5,17 +5,29 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/crosstyan/dumb_downloader/breaker"
+	"github.com/crosstyan/dumb_downloader/dedup"
+	"github.com/crosstyan/dumb_downloader/digest"
 	"github.com/crosstyan/dumb_downloader/entity"
 	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/imageinfo"
+	"github.com/crosstyan/dumb_downloader/job"
+	"github.com/crosstyan/dumb_downloader/pause"
+	"github.com/crosstyan/dumb_downloader/policy"
+	"github.com/crosstyan/dumb_downloader/queue"
+	"github.com/crosstyan/dumb_downloader/utils"
 	"github.com/samber/mo"
 	"io"
 	"net/http"
 	"strconv"
-	"time"
 )
 
 const JSON_MIME = "application/json"
 
+// ErrShuttingDown is the response of the requests left in the queue on shutdown
+var ErrShuttingDown = errors.New("server is shutting down")
+
 func getDownloadRequest(req *http.Request) (*entity.DownloadRequest, error) {
 	dlReq := entity.DownloadRequest{}
 	buf, err := io.ReadAll(req.Body)
@@ -29,6 +41,10 @@ func getDownloadRequest(req *http.Request) (*entity.DownloadRequest, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = dlReq.Validate()
+	if err != nil {
+		return nil, err
+	}
 	return &dlReq, nil
 }
 
@@ -36,70 +52,184 @@ func writeErrorAsJson(resp http.ResponseWriter, err error, code int) {
 	resp.Header().Add("Content-Type", JSON_MIME)
 	eR := entity.ErrorResponse{Error: err.Error()}
 	b, _ := json.Marshal(eR)
-	_, err = resp.Write(b)
+	// the status code must be written before the body
 	resp.WriteHeader(code)
+	_, err = resp.Write(b)
 	if err != nil {
 		log.Sugar().Errorw("failed to write response", "error", err)
 		return
 	}
 }
 
-// MakeAsyncPushHandler creates a handler that pushes the request to the channel.
+func writeJson(resp http.ResponseWriter, v any, code int) {
+	buf := bytes.NewBuffer([]byte{})
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	if err != nil {
+		writeErrorAsJson(resp, err, http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Add("Content-Type", JSON_MIME)
+	resp.WriteHeader(code)
+	_, err = resp.Write(buf.Bytes())
+	if err != nil {
+		log.Sugar().Errorw("failed to write response", "error", err)
+	}
+}
+
+// checkAsync checks if the request could be queued as an async job
+func checkAsync(req *http.Request, urlPolicy *policy.Policy, dlReq *entity.DownloadRequest) (int, error) {
+	// if save output is not set, it's meaningless to use async API
+	if dlReq.OutPrefix == nil {
+		return http.StatusBadRequest, errors.New("async API only accepts query with save output")
+	}
+	if err := checkOutPrefix(req, dlReq); err != nil {
+		return http.StatusForbidden, err
+	}
+	if dlReq.CallbackUrl != "" {
+		if code, err := checkUrl(urlPolicy, dlReq.CallbackUrl); err != nil {
+			return code, fmt.Errorf("callback_url: %w", err)
+		}
+	}
+	return checkUrl(urlPolicy, dlReq.Url)
+}
+
+// asyncItem is the queue item of the job
+func asyncItem(j entity.Job) entity.ReqResp {
+	// the job outlives the request
+	return entity.ReqResp{Request: j.Request, ResponseChannel: mo.None[entity.ResponseChannelV](),
+		Context: context.Background(), IsSync: false, JobID: j.ID, Owner: j.Owner}
+}
+
+// MakeAsyncPushHandler creates a handler that pushes the request to the queue.
 // @Summary Async Download
 // @Description Push a download request to the queue
 // @Tag download
 // @Accept json
 // @Produce json
+// @Description
+// @Description With `Idempotency-Key`, or with `dedup.by_url` for the same url and out_prefix, a repeated
+// @Description submission within `dedup.window` returns the original job with 200 instead of queuing again.
+// @Param wait query string false "how long to wait for the space if the queue is full, like `10s`. not waiting by default"
+// @Param Idempotency-Key header string false "the retries with the same key return the original job"
 // @Param request body entity.DownloadRequest true "download request"
-// @Success 202
+// @Security BearerAuth
+// @Success 200 {object} entity.Job "the original job of a repeated submission"
+// @Success 202 {object} entity.Job
+// @Header 200 {boolean} Idempotent-Replayed "true if the job is the original one"
+// @Header 202,503 {integer} X-Queue-Depth "requests in the queue"
+// @Header 202,503 {integer} X-Queue-Estimated-Wait-Ms "estimated wait of the queue in milliseconds"
 // @Failure 400 {object} entity.ErrorResponse
+// @Failure 401 {object} entity.ErrorResponse
+// @Failure 403 {object} entity.ErrorResponse "out_prefix or url not allowed"
+// @Failure 422 {object} entity.ErrorResponse "Idempotency-Key reused with a different request"
 // @Failure 500 {object} entity.ErrorResponse
+// @Failure 503 {object} entity.ErrorResponse "queue is full. see `Retry-After`"
 // @Router /download [post]
 func MakeAsyncPushHandler(
-	reqChan chan<- entity.ReqResp,
-	timeout time.Duration,
+	q *queue.Scheduler,
+	jobs *job.Store,
+	urlPolicy *policy.Policy,
+	index *dedup.Index,
 ) http.HandlerFunc {
 	pushQueue := func(resp http.ResponseWriter, req *http.Request) {
-		var ctx, cancel = context.WithTimeout(req.Context(), timeout)
-		defer cancel()
 		dlReq, err := getDownloadRequest(req)
-		log.Sugar().Infow("request", "url", dlReq.Url)
 		if err != nil {
 			writeErrorAsJson(resp, err, http.StatusBadRequest)
 			return
 		}
-		// if save output is not set, it's meaningless to use async API
-		if dlReq.OutPrefix == nil {
-			writeErrorAsJson(resp, errors.New("async API only accepts query with save output"), http.StatusBadRequest)
+		log.Sugar().Infow("request", "url", dlReq.Url, "method", dlReq.GetMethod())
+		if code, err := checkAsync(req, urlPolicy, dlReq); err != nil {
+			writeErrorAsJson(resp, err, code)
 			return
 		}
-		select {
-		case reqChan <- entity.ReqResp{Request: dlReq,
-			ResponseChannel: mo.None[entity.ResponseChannelV](), Context: ctx, IsSync: false}:
-			resp.WriteHeader(http.StatusAccepted)
-			return
-		case <-ctx.Done():
-			writeErrorAsJson(resp, errors.New("timeout"), http.StatusGatewayTimeout)
+		owner := tokenName(req)
+		create := func() (entity.Job, error) {
+			j := jobs.Create(dlReq, owner)
+			if !pushToQueue(resp, req, q, asyncItem(j)) {
+				jobs.Delete(j.ID)
+				return entity.Job{}, errNotQueued
+			}
+			return j, nil
+		}
+		key, fingerprint, ok := index.KeyOf(owner, req.Header.Get(IDEMPOTENCY_KEY_HEADER), dlReq)
+		if !ok {
+			if j, err := create(); err == nil {
+				writeJson(resp, j.Redacted(), http.StatusAccepted)
+			}
 			return
 		}
+		j, existed, err := submitOnce(index, jobs, key, fingerprint, create)
+		var mismatch *dedup.MismatchError
+		switch {
+		case errors.As(err, &mismatch):
+			writeErrorAsJson(resp, err, http.StatusUnprocessableEntity)
+		case err != nil:
+			// the error response has been written
+		case existed:
+			log.Sugar().Infow("duplicate submission", "url", dlReq.Url, "job", j.ID)
+			resp.Header().Set("Idempotent-Replayed", "true")
+			writeJson(resp, j.Redacted(), http.StatusOK)
+		default:
+			writeJson(resp, j.Redacted(), http.StatusAccepted)
+		}
 	}
 	return pushQueue
 }
 
-// MakeSyncPushHandler creates a sync handler that pushes the request to the channel.
+// syncErrorStatus maps the error of a sync request to the status code
+func syncErrorStatus(err error) int {
+	var openErr *breaker.OpenError
+	var pausedErr *pause.PausedError
+	var fullErr *queue.FullError
+	var mismatch *digest.MismatchError
+	var invalid *imageinfo.InvalidError
+	switch {
+	case isBlocked(err):
+		return http.StatusForbidden
+	case errors.As(err, &mismatch), errors.As(err, &invalid):
+		return http.StatusBadGateway
+	case errors.As(err, &openErr), errors.As(err, &pausedErr), errors.As(err, &fullErr), errors.Is(err, ErrShuttingDown):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// isShareable reports whether the identical concurrent requests could share one fetch.
+// Only the requests without side effects are.
+func isShareable(dlReq *entity.DownloadRequest) bool {
+	m := dlReq.GetMethod()
+	return (m == http.MethodGet || m == http.MethodHead) &&
+		dlReq.Body == nil && len(dlReq.JSON) == 0 && dlReq.Form == nil
+}
+
+// MakeSyncPushHandler creates a sync handler that pushes the request to the queue.
 // @Summary Sync Download
-// @Description Push a download request to the queue and wait for the response
+// @Description Push a download request to the queue and wait for the response.
+// @Description Identical concurrent GET or HEAD requests of the same token share one fetch unless `dedup.share_sync` is false.
 // @Tag download
 // @Accept json
 // @Produce json
 // @Param transparent query bool false "If the response is transparent. See also `strconv.ParseBool`"
+// @Param wait query string false "how long to wait for the space if the queue is full, like `10s`. not waiting by default"
 // @Param request body entity.DownloadRequest true "download request"
+// @Security BearerAuth
 // @Success 200 {object} entity.DownloadResponse
+// @Header 200,503 {integer} X-Queue-Depth "requests in the queue"
+// @Header 200,503 {integer} X-Queue-Estimated-Wait-Ms "estimated wait of the queue in milliseconds"
 // @Failure 400 {object} entity.ErrorResponse
+// @Failure 401 {object} entity.ErrorResponse
+// @Failure 403 {object} entity.ErrorResponse "out_prefix or url not allowed"
 // @Failure 500 {object} entity.ErrorResponse
+// @Failure 502 {object} entity.ErrorResponse "body doesn't match expected_digest, or the image is broken"
+// @Failure 503 {object} entity.ErrorResponse "queue is full, circuit breaker of the host is open, host or out_prefix paused, or server is shutting down"
 // @Router /download/sync [post]
 func MakeSyncPushHandler(
-	reqChan chan<- entity.ReqResp,
+	q *queue.Scheduler,
+	urlPolicy *policy.Policy,
+	flights *dedup.Group[entity.RespV],
 ) http.HandlerFunc {
 	pushQueue := func(resp http.ResponseWriter, req *http.Request) {
 		var ctx = req.Context()
@@ -118,60 +248,97 @@ func MakeSyncPushHandler(
 			writeErrorAsJson(resp, err, http.StatusBadRequest)
 			return
 		}
-		log.Sugar().Infow("request", "url", dlReq.Url, "isTransparent", isTransparent)
-		respChan := make(chan entity.RespT)
-		reqChan <- entity.ReqResp{Request: dlReq,
-			ResponseChannel: mo.Some[entity.ResponseChannelV](respChan), Context: ctx, IsSync: true}
-		select {
-		case response := <-respChan:
-			{
-				r, err := response.Get()
-				if err != nil {
-					writeErrorAsJson(resp, err, http.StatusInternalServerError)
-					return
-				}
-				if r == nil {
-					writeErrorAsJson(resp, errors.New("nil response"), http.StatusInternalServerError)
-					return
-				}
-				// https://pkg.go.dev/encoding/json#Marshal
-				// https://www.alexedwards.net/blog/json-surprises-and-gotchas
-				if !isTransparent {
-					resp.Header().Add("Content-Type", JSON_MIME)
-					buf := bytes.NewBuffer([]byte{})
-					enc := json.NewEncoder(buf)
-					enc.SetEscapeHTML(false)
-					err = enc.Encode(r)
-					if err != nil {
-						writeErrorAsJson(resp, err, http.StatusInternalServerError)
-						return
-					}
-					_, err = resp.Write(buf.Bytes())
-					resp.WriteHeader(http.StatusOK)
-					if err != nil {
-						log.Sugar().Errorw("failed to write response", "error", err)
-						resp.WriteHeader(http.StatusInternalServerError)
-						return
-					}
-				} else {
-					for k, v := range r.Headers {
-						resp.Header().Add(k, v)
-					}
-					resp.WriteHeader(r.StatusCode)
-					_, err = resp.Write(r.Body)
-					if err != nil {
-						log.Sugar().Errorw("failed to write response", "error", err)
-						resp.WriteHeader(http.StatusInternalServerError)
-						return
-					}
-					return
-				}
-				return
+		if err = checkOutPrefix(req, dlReq); err != nil {
+			writeErrorAsJson(resp, err, http.StatusForbidden)
+			return
+		}
+		if code, err := checkUrl(urlPolicy, dlReq.Url); err != nil {
+			writeErrorAsJson(resp, err, code)
+			return
+		}
+		log.Sugar().Infow("request", "url", dlReq.Url, "method", dlReq.GetMethod(), "isTransparent", isTransparent)
+		wait, err := parseWait(query.Get("wait"))
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		owner := tokenName(req)
+		fetch := func(ctx context.Context) (entity.RespV, error) {
+			// buffered so that the worker won't be blocked if we are gone
+			respChan := make(chan entity.RespT, 1)
+			item := entity.ReqResp{Request: dlReq, ResponseChannel: mo.Some[entity.ResponseChannelV](respChan),
+				Context: ctx, IsSync: true, Owner: owner}
+			if err := enqueue(ctx, q, item, wait); err != nil {
+				return nil, err
+			}
+			select {
+			case response := <-respChan:
+				return response.Get()
+			case <-ctx.Done():
+				return nil, ctx.Err()
 			}
-		case <-ctx.Done():
+		}
+		var r entity.RespV
+		if flights != nil && isShareable(dlReq) {
+			var shared bool
+			r, shared, err = flights.Do(ctx, owner+"\x00"+dedup.Fingerprint(dlReq), fetch)
+			if shared {
+				log.Sugar().Infow("shared fetch", "url", dlReq.Url)
+			}
+		} else {
+			r, err = fetch(ctx)
+		}
+		writeQueueHeaders(resp, q.Stats())
+		if ctx.Err() != nil {
 			writeErrorAsJson(resp, errors.New("timeout"), http.StatusGatewayTimeout)
 			return
 		}
+		if err != nil {
+			var openErr *breaker.OpenError
+			var fullErr *queue.FullError
+			if errors.As(err, &openErr) {
+				resp.Header().Set("Retry-After", utils.FormatRetryAfter(openErr.RetryAfter))
+			} else if errors.As(err, &fullErr) {
+				resp.Header().Set("Retry-After", utils.FormatRetryAfter(fullErr.RetryAfter))
+			}
+			writeErrorAsJson(resp, err, syncErrorStatus(err))
+			return
+		}
+		if r == nil {
+			writeErrorAsJson(resp, errors.New("nil response"), http.StatusInternalServerError)
+			return
+		}
+		// https://pkg.go.dev/encoding/json#Marshal
+		// https://www.alexedwards.net/blog/json-surprises-and-gotchas
+		if !isTransparent {
+			resp.Header().Add("Content-Type", JSON_MIME)
+			buf := bytes.NewBuffer([]byte{})
+			enc := json.NewEncoder(buf)
+			enc.SetEscapeHTML(false)
+			err = enc.Encode(r)
+			if err != nil {
+				writeErrorAsJson(resp, err, http.StatusInternalServerError)
+				return
+			}
+			_, err = resp.Write(buf.Bytes())
+			resp.WriteHeader(http.StatusOK)
+			if err != nil {
+				log.Sugar().Errorw("failed to write response", "error", err)
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		} else {
+			for k, v := range r.Headers {
+				resp.Header().Add(k, v)
+			}
+			resp.WriteHeader(r.StatusCode)
+			_, err = resp.Write(r.Body)
+			if err != nil {
+				log.Sugar().Errorw("failed to write response", "error", err)
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
 	}
 	return pushQueue
 }
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/crosstyan/dumb_downloader/auth"
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+)
+
+// RequireScope creates a middleware that only lets the requests with a token
+// of the scope pass. Everything passes if a is nil (authentication disabled).
+func RequireScope(a *auth.Authenticator, scope auth.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if a == nil {
+			return next
+		}
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			t, err := a.Authenticate(req)
+			if err != nil {
+				resp.Header().Set("WWW-Authenticate", `Bearer realm="dumbdl"`)
+				writeErrorAsJson(resp, err, http.StatusUnauthorized)
+				return
+			}
+			if !t.HasScope(scope) {
+				log.Sugar().Warnw("scope required", "token", t.Name, "scope", scope, "path", req.URL.Path)
+				writeErrorAsJson(resp, auth.Forbidden.New("scope %s required", scope), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(resp, req.WithContext(auth.WithToken(req.Context(), t)))
+		})
+	}
+}
+
+// tokenName returns the name of the token of the request. Empty if authentication is disabled.
+func tokenName(req *http.Request) string {
+	t := auth.FromContext(req.Context())
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// checkOutPrefix checks if the token of the request could save to the out_prefix of dlReq
+func checkOutPrefix(req *http.Request, dlReq *entity.DownloadRequest) error {
+	t := auth.FromContext(req.Context())
+	if t == nil || dlReq.OutPrefix == nil {
+		return nil
+	}
+	if !t.AllowsOutPrefix(*dlReq.OutPrefix) {
+		return auth.Forbidden.New("token %s could not save to %s", t.Name, *dlReq.OutPrefix)
+	}
+	return nil
+}
+
+// MakeFilesHandler creates a handler that serves the saved files in baseOutDir.
+// The token could only read the files under its out prefixes.
+// @Summary Read Files
+// @Description Read the saved files, or list a directory
+// @Tag files
+// @Produce octet-stream
+// @Security BearerAuth
+// @Param path path string true "path relative to the output directory"
+// @Success 200
+// @Failure 403 {object} entity.ErrorResponse
+// @Router /files/{path} [get]
+func MakeFilesHandler(baseOutDir string) http.HandlerFunc {
+	fs := http.StripPrefix("/files/", http.FileServer(http.Dir(baseOutDir)))
+	return func(resp http.ResponseWriter, req *http.Request) {
+		p := strings.Trim(path.Clean("/"+strings.TrimPrefix(req.URL.Path, "/files/")), "/")
+		if t := auth.FromContext(req.Context()); t != nil && !t.AllowsOutPrefix(p) {
+			writeErrorAsJson(resp, auth.Forbidden.New("token %s could not read %s", t.Name, p), http.StatusForbidden)
+			return
+		}
+		fs.ServeHTTP(resp, req)
+	}
+}
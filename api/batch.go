@@ -0,0 +1,400 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"unicode"
+
+	"github.com/crosstyan/dumb_downloader/auth"
+	"github.com/crosstyan/dumb_downloader/dedup"
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/job"
+	"github.com/crosstyan/dumb_downloader/policy"
+	"github.com/crosstyan/dumb_downloader/queue"
+	"github.com/go-chi/chi/v5"
+	"github.com/samber/mo"
+)
+
+const NDJSON_MIME = "application/x-ndjson"
+
+// ndjsonWriter writes a JSON value per line, and flushes each of them
+type ndjsonWriter struct {
+	rc  *http.ResponseController
+	enc *json.Encoder
+}
+
+func newNdjsonWriter(resp http.ResponseWriter) *ndjsonWriter {
+	resp.Header().Set("Content-Type", NDJSON_MIME)
+	enc := json.NewEncoder(resp)
+	enc.SetEscapeHTML(false)
+	return &ndjsonWriter{rc: http.NewResponseController(resp), enc: enc}
+}
+
+func (w *ndjsonWriter) write(v any) {
+	if err := w.enc.Encode(v); err != nil {
+		log.Sugar().Errorw("failed to write response", "error", err)
+		return
+	}
+	_ = w.rc.Flush()
+}
+
+// batchDecoder reads the items of either a JSON array or NDJSON
+type batchDecoder struct {
+	dec     *json.Decoder
+	isArray bool
+}
+
+func newBatchDecoder(r io.Reader) (*batchDecoder, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if unicode.IsSpace(c) {
+			continue
+		}
+		_ = br.UnreadRune()
+		d := &batchDecoder{dec: json.NewDecoder(br), isArray: c == '['}
+		if d.isArray {
+			// the opening bracket
+			if _, err = d.dec.Token(); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	}
+	// empty body
+	return &batchDecoder{dec: json.NewDecoder(br)}, nil
+}
+
+// next returns the raw item, or io.EOF if there's no more
+func (d *batchDecoder) next() (json.RawMessage, error) {
+	if d.isArray && !d.dec.More() {
+		return nil, io.EOF
+	}
+	var raw json.RawMessage
+	err := d.dec.Decode(&raw)
+	return raw, err
+}
+
+// MakeBatchPushHandler creates a handler that queues many async requests at once.
+// @Summary Batch Async Download
+// @Description Push many download requests to the queue. The body is either a JSON array or
+// @Description NDJSON (one request per line), which could be streamed. The result of each item
+// @Description is streamed back as a line of NDJSON as soon as it's queued, followed by a summary line.
+// @Description With `wait`, each item waits for the space of the queue.
+// @Tag download
+// @Accept json
+// @Produce application/x-ndjson
+// @Param wait query string false "how long each item waits for the space if the queue is full, like `10s`"
+// @Param request body []entity.DownloadRequest true "download requests"
+// @Security BearerAuth
+// @Success 200 {object} entity.BatchItemResult "one line per item, and then entity.BatchSummary"
+// @Header 200 {string} X-Batch-Id "ID of the batch"
+// @Failure 400 {object} entity.ErrorResponse
+// @Router /download/batch [post]
+func MakeBatchPushHandler(
+	q *queue.Scheduler,
+	jobs *job.Store,
+	urlPolicy *policy.Policy,
+	index *dedup.Index,
+) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		wait, err := parseWait(req.URL.Query().Get("wait"))
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(req.Body)
+		dec, err := newBatchDecoder(req.Body)
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		// keep reading the body after the response starts
+		_ = http.NewResponseController(resp).EnableFullDuplex()
+		owner := tokenName(req)
+		batchID := jobs.CreateBatch(owner)
+		resp.Header().Set("X-Batch-Id", batchID)
+		out := newNdjsonWriter(resp)
+		resp.WriteHeader(http.StatusOK)
+		summary := entity.BatchSummary{BatchID: batchID}
+		for i := 0; ; i++ {
+			raw, err := dec.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				summary.Error = err.Error()
+				break
+			}
+			summary.Total++
+			result := entity.BatchItemResult{Index: i}
+			j, err := func() (entity.Job, error) {
+				dlReq := &entity.DownloadRequest{}
+				if err := json.Unmarshal(raw, dlReq); err != nil {
+					return entity.Job{}, err
+				}
+				result.Url = dlReq.Url
+				if err := dlReq.Validate(); err != nil {
+					return entity.Job{}, err
+				}
+				if _, err := checkAsync(req, urlPolicy, dlReq); err != nil {
+					return entity.Job{}, err
+				}
+				create := func() (entity.Job, error) {
+					j := jobs.CreateInBatch(dlReq, owner, batchID)
+					if err := enqueue(req.Context(), q, asyncItem(j), wait); err != nil {
+						jobs.Delete(j.ID)
+						return entity.Job{}, err
+					}
+					return j, nil
+				}
+				// Idempotency-Key is of the whole request, not the items
+				key, _, ok := index.KeyOf(owner, "", dlReq)
+				if !ok {
+					return create()
+				}
+				j, existed, err := submitOnce(index, jobs, key, "", create)
+				result.Duplicate = existed
+				return j, err
+			}()
+			if err != nil {
+				result.Error = err.Error()
+				summary.Rejected++
+			} else {
+				result.JobID = j.ID
+				summary.Accepted++
+			}
+			out.write(result)
+		}
+		log.Sugar().Infow("batch", "batch", batchID, "total", summary.Total, "accepted", summary.Accepted, "rejected", summary.Rejected, "error", summary.Error)
+		out.write(summary)
+	}
+}
+
+// getBatch returns the progress of the batch of the id in the path. The batches
+// of others are invisible unless admin.
+func getBatch(req *http.Request, jobs *job.Store) (entity.BatchProgress, bool) {
+	p, ok := jobs.Progress(chi.URLParam(req, "id"))
+	if t := auth.FromContext(req.Context()); ok && t != nil && !t.HasScope(auth.ScopeAdmin) && p.Owner != t.Name {
+		return entity.BatchProgress{}, false
+	}
+	return p, ok
+}
+
+// MakeGetBatchHandler creates a handler that returns the progress of the batch.
+// @Summary Get Batch
+// @Description Get the aggregate progress of the jobs of a batch
+// @Tag job
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "batch ID"
+// @Success 200 {object} entity.BatchProgress
+// @Failure 404 {object} entity.ErrorResponse
+// @Router /batches/{id} [get]
+func MakeGetBatchHandler(jobs *job.Store) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		p, ok := getBatch(req, jobs)
+		if !ok {
+			writeErrorAsJson(resp, errors.New("batch not found"), http.StatusNotFound)
+			return
+		}
+		writeJson(resp, p, http.StatusOK)
+	}
+}
+
+// MakeWaitBatchHandler creates a handler that waits for all the jobs of the batch to finish.
+// @Summary Wait Batch
+// @Description Block until all the jobs of the batch are done, failed or cancelled, or the timeout elapses.
+// @Description Responds 200 if the batch has finished, otherwise 202 with the progress as it is.
+// @Tag job
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "batch ID"
+// @Param timeout query string false "how long to wait, like `30s`. at most 5 minutes" default(30s)
+// @Success 200 {object} entity.BatchProgress "the batch has finished"
+// @Success 202 {object} entity.BatchProgress "some jobs are still queued or running"
+// @Failure 400 {object} entity.ErrorResponse
+// @Failure 404 {object} entity.ErrorResponse
+// @Router /batches/{id}/wait [get]
+func MakeWaitBatchHandler(jobs *job.Store) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		p, ok := getBatch(req, jobs)
+		if !ok {
+			writeErrorAsJson(resp, errors.New("batch not found"), http.StatusNotFound)
+			return
+		}
+		ctx, cancel, err := waitContext(req)
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		defer cancel()
+		p, _ = jobs.WaitBatch(ctx, p.ID)
+		if !p.Finished {
+			writeJson(resp, p, http.StatusAccepted)
+			return
+		}
+		writeJson(resp, p, http.StatusOK)
+	}
+}
+
+// MakeSyncBatchHandler creates a handler that sends many sync requests at once.
+// @Summary Batch Sync Download
+// @Description Send many download requests concurrently within the worker pool. The body is either
+// @Description a JSON array or NDJSON. Each response is streamed back as a line of NDJSON as soon as it
+// @Description completes (not in order), followed by a summary line. An item failing doesn't fail the others.
+// @Description At most as many items as the worker pool are in flight at once; the rest of the body is read
+// @Description as they complete.
+// @Tag download
+// @Accept json
+// @Produce application/x-ndjson
+// @Param wait query string false "how long each item waits for the space if the queue is full, like `10s`"
+// @Param request body []entity.DownloadRequest true "download requests"
+// @Security BearerAuth
+// @Success 200 {object} entity.SyncBatchItem "one line per item, and then entity.SyncBatchSummary"
+// @Failure 400 {object} entity.ErrorResponse
+// @Router /download/sync/batch [post]
+func MakeSyncBatchHandler(
+	q *queue.Scheduler,
+	urlPolicy *policy.Policy,
+	// how many items of a batch could be queued or fetched at once
+	maxInFlight int,
+) http.HandlerFunc {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	return func(resp http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		wait, err := parseWait(req.URL.Query().Get("wait"))
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(req.Body)
+		dec, err := newBatchDecoder(req.Body)
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		_ = http.NewResponseController(resp).EnableFullDuplex()
+		out := newNdjsonWriter(resp)
+		resp.WriteHeader(http.StatusOK)
+		summary := entity.SyncBatchSummary{}
+		// the responses are written while the body is still being read
+		var mu sync.Mutex
+		write := func(item entity.SyncBatchItem) {
+			mu.Lock()
+			defer mu.Unlock()
+			if item.Response != nil {
+				summary.Succeeded++
+			} else {
+				summary.Failed++
+			}
+			out.write(item)
+		}
+		fail := func(item entity.SyncBatchItem, err error) {
+			item.Error = err.Error()
+			item.ErrorStatus = syncErrorStatus(err)
+			write(item)
+		}
+		results := make(chan entity.SyncBatchItem)
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			for item := range results {
+				write(item)
+			}
+		}()
+		inFlight := make(chan struct{}, maxInFlight)
+		var pending sync.WaitGroup
+	read:
+		for i := 0; ; i++ {
+			raw, err := dec.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				summary.Error = err.Error()
+				break
+			}
+			summary.Total++
+			item := entity.SyncBatchItem{Index: i}
+			dlReq := &entity.DownloadRequest{}
+			if err = json.Unmarshal(raw, dlReq); err != nil {
+				fail(item, err)
+				continue
+			}
+			item.Url = dlReq.Url
+			if err = dlReq.Validate(); err != nil {
+				item.Error, item.ErrorStatus = err.Error(), http.StatusBadRequest
+				write(item)
+				continue
+			}
+			if err = checkOutPrefix(req, dlReq); err != nil {
+				item.Error, item.ErrorStatus = err.Error(), http.StatusForbidden
+				write(item)
+				continue
+			}
+			if code, err := checkUrl(urlPolicy, dlReq.Url); err != nil {
+				item.Error, item.ErrorStatus = err.Error(), code
+				write(item)
+				continue
+			}
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				summary.Error = ctx.Err().Error()
+				break read
+			}
+			respChan := make(chan entity.RespT, 1)
+			err = enqueue(ctx, q, entity.ReqResp{Request: dlReq, ResponseChannel: mo.Some[entity.ResponseChannelV](respChan),
+				Context: ctx, IsSync: true, Owner: tokenName(req)}, wait)
+			if err != nil {
+				<-inFlight
+				fail(item, err)
+				continue
+			}
+			pending.Add(1)
+			go func(item entity.SyncBatchItem) {
+				defer pending.Done()
+				defer func() { <-inFlight }()
+				select {
+				case response := <-respChan:
+					r, err := response.Get()
+					if err != nil {
+						item.Error = err.Error()
+						item.ErrorStatus = syncErrorStatus(err)
+					} else {
+						item.Response = r
+					}
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case results <- item:
+				case <-ctx.Done():
+				}
+			}(item)
+		}
+		pending.Wait()
+		close(results)
+		<-drained
+		log.Sugar().Infow("sync batch", "total", summary.Total, "succeeded", summary.Succeeded, "failed", summary.Failed, "error", summary.Error)
+		out.write(summary)
+	}
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/crosstyan/dumb_downloader/breaker"
+)
+
+// MakeGetBreakersHandler creates a handler that returns the state of the per-host circuit breakers.
+// @Summary Get Circuit Breakers
+// @Description Get the state of the circuit breaker of each host
+// @Tag admin
+// @Produce json
+// @Success 200 {array} breaker.HostState
+// @Security BearerAuth
+// @Router /admin/breakers [get]
+func MakeGetBreakersHandler(b *breaker.Breaker) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		writeJson(resp, b.States(), http.StatusOK)
+	}
+}
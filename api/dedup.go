@@ -0,0 +1,46 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/crosstyan/dumb_downloader/dedup"
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/job"
+)
+
+// IDEMPOTENCY_KEY_HEADER makes the retries of an async submission return the original job
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+
+// errNotQueued means the job could not be queued and the error response has been written
+var errNotQueued = errors.New("not queued")
+
+// submitOnce creates the job with create unless the same submission has been made
+// within the dedup window, in which case the original job is returned with existed set.
+// The original job found by url is submitted again if it's gone, failed or cancelled.
+// The one found by Idempotency-Key is only submitted again if it's gone.
+func submitOnce(
+	index *dedup.Index,
+	jobs *job.Store,
+	key string, fingerprint string,
+	create func() (entity.Job, error),
+) (j entity.Job, existed bool, err error) {
+	createID := func() (string, error) {
+		j, err := create()
+		return j.ID, err
+	}
+	for {
+		id, existed, err := index.Do(key, fingerprint, createID)
+		if err != nil {
+			return entity.Job{}, existed, err
+		}
+		j, ok := jobs.Get(id)
+		if !existed {
+			return j, false, nil
+		}
+		if ok && (fingerprint != "" || (j.Status != entity.JobFailed && j.Status != entity.JobCancelled)) {
+			return j, true, nil
+		}
+		// the next Do creates the job, unless a concurrent submission does first
+		index.Forget(key, id)
+	}
+}
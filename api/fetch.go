@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/policy"
+	"github.com/crosstyan/dumb_downloader/session"
+	"github.com/crosstyan/dumb_downloader/utils"
+)
+
+// passthroughHeaders are the headers of the caller forwarded to upstream
+var passthroughHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+// MakeFetchHandler creates a handler that fetches the url with the impersonated
+// client and streams the upstream response back as is.
+// @Summary Fetch
+// @Description Fetch the url and stream the upstream status, headers and body back.
+// @Description `Range` and conditional headers are passed through.
+// @Tag download
+// @Produce octet-stream
+// @Security BearerAuth
+// @Param url query string true "the url to fetch"
+// @Param session query string false "named session of the token. Cookies are shared among the requests in the same session"
+// @Param referer query string false "Referer header"
+// @Param header query []string false "extra header in the form of `Name: Value`" collectionFormat(multi)
+// @Success 200
+// @Failure 400 {object} entity.ErrorResponse
+// @Failure 403 {object} entity.ErrorResponse "url not allowed"
+// @Failure 502 {object} entity.ErrorResponse
+// @Router /fetch [get]
+func MakeFetchHandler(sessions *session.Store, urlPolicy *policy.Policy) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		target, err := url.Parse(query.Get("url"))
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		if target.Scheme != "http" && target.Scheme != "https" {
+			writeErrorAsJson(resp, errors.New("url should be an absolute http(s) url"), http.StatusBadRequest)
+			return
+		}
+		if err = urlPolicy.CheckURL(target); err != nil {
+			writeErrorAsJson(resp, err, http.StatusForbidden)
+			return
+		}
+		client := sessions.Client(tokenName(req), query.Get("session"))
+		R := client.R().SetContext(req.Context()).DisableAutoReadResponse()
+		for _, h := range query["header"] {
+			k, v, ok := strings.Cut(h, ":")
+			if !ok {
+				writeErrorAsJson(resp, errors.New("bad header "+h), http.StatusBadRequest)
+				return
+			}
+			R.SetHeader(strings.TrimSpace(k), strings.TrimSpace(v))
+		}
+		if referer := query.Get("referer"); referer != "" {
+			R.SetHeader("Referer", referer)
+		}
+		for _, k := range passthroughHeaders {
+			if v := req.Header.Get(k); v != "" {
+				R.SetHeader(k, v)
+			}
+		}
+		r, err := R.Get(target.String())
+		if err != nil {
+			log.Sugar().Errorw("fetch", "url", target.String(), "error", err)
+			if isBlocked(err) {
+				writeErrorAsJson(resp, err, http.StatusForbidden)
+				return
+			}
+			writeErrorAsJson(resp, err, http.StatusBadGateway)
+			return
+		}
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(r.Body)
+		utils.CopyHeaders(resp.Header(), r.Header)
+		resp.WriteHeader(r.StatusCode)
+		n, err := io.Copy(resp, r.Body)
+		if err != nil {
+			log.Sugar().Warnw("fetch", "url", target.String(), "error", err, "written", n)
+			return
+		}
+		log.Sugar().Infow("fetch", "url", target.String(), "status", r.StatusCode, "written", n)
+	}
+}
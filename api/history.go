@@ -0,0 +1,46 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/crosstyan/dumb_downloader/auth"
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/history"
+)
+
+// MakeHistoryHandler creates a handler that returns the history of a url.
+// @Summary Download History
+// @Description Whether the url has been downloaded, wherever the file is now, and the outcomes
+// @Description of its downloads, the latest first. The downloads of others are invisible unless admin.
+// @Tag history
+// @Produce json
+// @Security BearerAuth
+// @Param url query string true "the url"
+// @Success 200 {object} entity.HistoryResponse
+// @Failure 400 {object} entity.ErrorResponse
+// @Failure 404 {object} entity.ErrorResponse "history is disabled"
+// @Router /history [get]
+func MakeHistoryHandler(downloads *history.Store) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if downloads == nil {
+			writeErrorAsJson(resp, errors.New("history is disabled"), http.StatusNotFound)
+			return
+		}
+		u := req.URL.Query().Get("url")
+		if u == "" {
+			writeErrorAsJson(resp, errors.New("url is required"), http.StatusBadRequest)
+			return
+		}
+		t := auth.FromContext(req.Context())
+		h := entity.HistoryResponse{Url: u, Entries: []entity.HistoryEntry{}}
+		for _, e := range downloads.Get(u) {
+			if t != nil && !t.HasScope(auth.ScopeAdmin) && e.Owner != t.Name {
+				continue
+			}
+			h.Entries = append(h.Entries, e)
+			h.Completed = h.Completed || e.Status == entity.JobDone
+		}
+		writeJson(resp, h, http.StatusOK)
+	}
+}
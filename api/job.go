@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/auth"
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/job"
+	"github.com/go-chi/chi/v5"
+	"github.com/joomcode/errorx"
+)
+
+// getJob returns the job of the id in the path. The jobs of others are
+// invisible unless admin.
+func getJob(req *http.Request, jobs *job.Store) (entity.Job, bool) {
+	j, ok := jobs.Get(chi.URLParam(req, "id"))
+	if t := auth.FromContext(req.Context()); ok && t != nil && !t.HasScope(auth.ScopeAdmin) && j.Owner != t.Name {
+		return entity.Job{}, false
+	}
+	return j, ok
+}
+
+const (
+	// DefaultWaitTimeout is how long a long-poll waits without the `timeout` query
+	DefaultWaitTimeout = 30 * time.Second
+	// MaxWaitTimeout is the upper bound of the `timeout` query
+	MaxWaitTimeout = 5 * time.Minute
+)
+
+// waitContext is the context of a long-poll, done after the `timeout` query
+func waitContext(req *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := DefaultWaitTimeout
+	if v := req.URL.Query().Get("timeout"); v != "" {
+		d, err := parseWait(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		timeout = min(d, MaxWaitTimeout)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return ctx, cancel, nil
+}
+
+// MakeGetJobHandler creates a handler that returns the job.
+// @Summary Get Job
+// @Description Get the status and the result of an async download
+// @Tag job
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "job ID"
+// @Success 200 {object} entity.Job
+// @Failure 404 {object} entity.ErrorResponse
+// @Router /jobs/{id} [get]
+func MakeGetJobHandler(jobs *job.Store) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		j, ok := getJob(req, jobs)
+		if !ok {
+			writeErrorAsJson(resp, errors.New("job not found"), http.StatusNotFound)
+			return
+		}
+		writeJson(resp, j.Redacted(), http.StatusOK)
+	}
+}
+
+// MakeCancelJobHandler creates a handler that cancels the job.
+// @Summary Cancel Job
+// @Description Cancel a queued or running async download. The download in progress is aborted
+// @Description and nothing is saved.
+// @Tag job
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "job ID"
+// @Success 200 {object} entity.Job
+// @Failure 404 {object} entity.ErrorResponse
+// @Failure 409 {object} entity.ErrorResponse "job has finished"
+// @Router /jobs/{id} [delete]
+func MakeCancelJobHandler(jobs *job.Store) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		j, ok := getJob(req, jobs)
+		if !ok {
+			writeErrorAsJson(resp, errors.New("job not found"), http.StatusNotFound)
+			return
+		}
+		j, err := jobs.Cancel(j.ID)
+		if err != nil {
+			if errorx.IsOfType(err, job.Conflict) {
+				writeErrorAsJson(resp, err, http.StatusConflict)
+				return
+			}
+			writeErrorAsJson(resp, err, http.StatusNotFound)
+			return
+		}
+		log.Sugar().Infow("job cancelled", "job", j.ID, "url", j.Request.Url, "token", tokenName(req))
+		writeJson(resp, j.Redacted(), http.StatusOK)
+	}
+}
+
+// MakeWaitJobHandler creates a handler that waits for the job to finish.
+// @Summary Wait Job
+// @Description Block until the job is done, failed or cancelled, or the timeout elapses.
+// @Description Responds 200 if the job has finished, otherwise 202 with the job as it is.
+// @Tag job
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "job ID"
+// @Param timeout query string false "how long to wait, like `30s`. at most 5 minutes" default(30s)
+// @Success 200 {object} entity.Job "the job has finished"
+// @Success 202 {object} entity.Job "the job is still queued or running"
+// @Failure 400 {object} entity.ErrorResponse
+// @Failure 404 {object} entity.ErrorResponse
+// @Router /jobs/{id}/wait [get]
+func MakeWaitJobHandler(jobs *job.Store) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		j, ok := getJob(req, jobs)
+		if !ok {
+			writeErrorAsJson(resp, errors.New("job not found"), http.StatusNotFound)
+			return
+		}
+		ctx, cancel, err := waitContext(req)
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		defer cancel()
+		j, ok = jobs.Wait(ctx, j.ID)
+		if !ok {
+			writeErrorAsJson(resp, errors.New("job not found"), http.StatusNotFound)
+			return
+		}
+		if !j.Status.IsTerminal() {
+			writeJson(resp, j.Redacted(), http.StatusAccepted)
+			return
+		}
+		writeJson(resp, j.Redacted(), http.StatusOK)
+	}
+}
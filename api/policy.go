@@ -0,0 +1,31 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/crosstyan/dumb_downloader/policy"
+)
+
+// checkUrl rejects the url forbidden by the policy before it's queued.
+// The policy is checked again on every redirect and when dialing.
+func checkUrl(urlPolicy *policy.Policy, rawUrl string) (int, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if !u.IsAbs() {
+		return http.StatusBadRequest, errors.New("url should be absolute")
+	}
+	if err = urlPolicy.CheckURL(u); err != nil {
+		return http.StatusForbidden, err
+	}
+	return http.StatusOK, nil
+}
+
+// isBlocked reports whether err is caused by the url policy
+func isBlocked(err error) bool {
+	var blocked *policy.BlockedError
+	return errors.As(err, &blocked)
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/pause"
+	"github.com/crosstyan/dumb_downloader/queue"
+	"github.com/crosstyan/dumb_downloader/utils"
+)
+
+// QueueState is what is paused and the depth of the queue
+//
+// @Description what is paused and the depth of the queue
+type QueueState struct {
+	pause.State
+	queue.Stats
+}
+
+// parseWait parses the `wait` query, either a duration like `10s` or seconds
+func parseWait(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if s, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(s * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.New("bad wait " + v)
+	}
+	return d, nil
+}
+
+// writeQueueHeaders tells the depth and the estimated wait of the queue
+func writeQueueHeaders(resp http.ResponseWriter, stats queue.Stats) {
+	resp.Header().Set("X-Queue-Depth", strconv.Itoa(stats.Depth))
+	resp.Header().Set("X-Queue-Estimated-Wait-Ms", strconv.FormatInt(stats.EstimatedWaitMs, 10))
+}
+
+// enqueue pushes the request to the queue, waiting for the space up to wait
+func enqueue(ctx context.Context, q *queue.Scheduler, item entity.ReqResp, wait time.Duration) error {
+	if wait <= 0 {
+		return q.TryPush(item)
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	return q.PushWait(ctx, item)
+}
+
+// pushToQueue pushes the request to the queue. If the queue is full, it waits for
+// the space as long as the `wait` query, or responds 503 with `Retry-After`.
+// Returns false if the error response has been written.
+func pushToQueue(resp http.ResponseWriter, req *http.Request, q *queue.Scheduler, item entity.ReqResp) bool {
+	wait, err := parseWait(req.URL.Query().Get("wait"))
+	if err != nil {
+		writeErrorAsJson(resp, err, http.StatusBadRequest)
+		return false
+	}
+	err = enqueue(req.Context(), q, item, wait)
+	writeQueueHeaders(resp, q.Stats())
+	if err != nil {
+		var full *queue.FullError
+		if errors.As(err, &full) {
+			resp.Header().Set("Retry-After", utils.FormatRetryAfter(full.RetryAfter))
+			writeErrorAsJson(resp, err, http.StatusServiceUnavailable)
+			return false
+		}
+		writeErrorAsJson(resp, err, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// getScope reads the optional scope in the body. Empty body means the whole queue.
+func getScope(req *http.Request) (pause.Scope, error) {
+	var scope pause.Scope
+	buf, err := io.ReadAll(req.Body)
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(req.Body)
+	if err != nil || len(buf) == 0 {
+		return scope, err
+	}
+	err = json.Unmarshal(buf, &scope)
+	return scope, err
+}
+
+// MakeGetQueueHandler creates a handler that returns the paused scopes and the depth of the queue.
+// @Summary Get Queue State
+// @Description Get what is paused, the depth and the estimated wait of the queue
+// @Tag queue
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} QueueState
+// @Router /queue [get]
+func MakeGetQueueHandler(gate *pause.Gate, q *queue.Scheduler) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		writeJson(resp, QueueState{State: gate.State(), Stats: q.Stats()}, http.StatusOK)
+	}
+}
+
+// MakePauseHandler creates a handler that pauses the queue, a host or an out_prefix.
+// The requests are held instead of dropped.
+// @Summary Pause Queue
+// @Description Stop the workers from picking up new requests, of a host or an out_prefix if given.
+// @Description The downloads in progress are not affected.
+// @Tag queue
+// @Accept json
+// @Produce json
+// @Param scope body pause.Scope false "what to pause. the whole queue if empty"
+// @Security BearerAuth
+// @Success 200 {object} pause.State
+// @Failure 400 {object} entity.ErrorResponse
+// @Router /queue/pause [post]
+func MakePauseHandler(gate *pause.Gate) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		scope, err := getScope(req)
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		gate.Pause(scope)
+		log.Sugar().Infow("paused", "scope", scope, "token", tokenName(req))
+		writeJson(resp, gate.State(), http.StatusOK)
+	}
+}
+
+// MakeResumeHandler creates a handler that resumes what is paused by MakePauseHandler.
+// @Summary Resume Queue
+// @Description Resume the queue, a host or an out_prefix
+// @Tag queue
+// @Accept json
+// @Produce json
+// @Param scope body pause.Scope false "what to resume. the whole queue if empty"
+// @Security BearerAuth
+// @Success 200 {object} pause.State
+// @Failure 400 {object} entity.ErrorResponse
+// @Router /queue/resume [post]
+func MakeResumeHandler(gate *pause.Gate) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		scope, err := getScope(req)
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		gate.Resume(scope)
+		log.Sugar().Infow("resumed", "scope", scope, "token", tokenName(req))
+		writeJson(resp, gate.State(), http.StatusOK)
+	}
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/throttle"
+)
+
+// MakeGetThrottleHandler creates a handler that returns current bandwidth caps.
+// @Summary Get Bandwidth Caps
+// @Description Get the bandwidth caps in bytes per second
+// @Tag admin
+// @Produce json
+// @Success 200 {object} throttle.Config
+// @Security BearerAuth
+// @Router /admin/throttle [get]
+func MakeGetThrottleHandler(limiter *throttle.Limiter) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		writeJson(resp, limiter.Config(), http.StatusOK)
+	}
+}
+
+// MakePutThrottleHandler creates a handler that replaces the bandwidth caps at runtime.
+// @Summary Set Bandwidth Caps
+// @Description Replace the bandwidth caps. Downloads in progress are affected as well
+// @Tag admin
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param config body throttle.Config true "bandwidth caps"
+// @Success 200 {object} throttle.Config
+// @Failure 400 {object} entity.ErrorResponse
+// @Router /admin/throttle [put]
+func MakePutThrottleHandler(limiter *throttle.Limiter) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(req.Body)
+		c := throttle.Config{}
+		err := json.NewDecoder(req.Body).Decode(&c)
+		if err != nil {
+			writeErrorAsJson(resp, err, http.StatusBadRequest)
+			return
+		}
+		limiter.SetConfig(c)
+		log.Sugar().Infow("bandwidth caps changed", "global", c.Global, "per_host", c.PerHost, "hosts", c.Hosts)
+		writeJson(resp, limiter.Config(), http.StatusOK)
+	}
+}
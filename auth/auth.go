@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/joomcode/errorx"
+)
+
+type Scope string
+
+const (
+	// ScopeSubmit allows submitting async downloads and reading their jobs
+	ScopeSubmit Scope = "submit"
+	// ScopeSync allows sync downloads and fetching
+	ScopeSync Scope = "sync"
+	// ScopeAdmin allows the admin endpoints, metrics and the jobs of others
+	ScopeAdmin Scope = "admin"
+	// ScopeReadFiles allows reading the saved files
+	ScopeReadFiles Scope = "read-files"
+)
+
+var scopes = []Scope{ScopeSubmit, ScopeSync, ScopeAdmin, ScopeReadFiles}
+
+const hashPrefix = "sha256:"
+
+var (
+	Errors          = errorx.NewNamespace("auth")
+	Unauthenticated = Errors.NewType("unauthenticated")
+	Forbidden       = Errors.NewType("forbidden")
+)
+
+// TokenConfig is a token in config. Only the hash of the token is stored.
+type TokenConfig struct {
+	Name string `mapstructure:"name"`
+	// `sha256:` followed by the hex encoded SHA-256 of the token
+	Hash   string  `mapstructure:"hash"`
+	Scopes []Scope `mapstructure:"scopes"`
+	// the out_prefix of the requests (and the files readable) should be under one of them.
+	// empty means no restriction
+	OutPrefixes []string `mapstructure:"out_prefixes"`
+}
+
+type Token struct {
+	Name        string
+	hash        []byte
+	scopes      map[Scope]struct{}
+	outPrefixes []string
+}
+
+// HasScope returns true if the token has the scope. Admin has all the scopes.
+func (t *Token) HasScope(s Scope) bool {
+	if _, ok := t.scopes[ScopeAdmin]; ok {
+		return true
+	}
+	_, ok := t.scopes[s]
+	return ok
+}
+
+// AllowsOutPrefix tells if the token could save to (or read from) the prefix,
+// which should have been cleaned.
+func (t *Token) AllowsOutPrefix(prefix string) bool {
+	if len(t.outPrefixes) == 0 {
+		return true
+	}
+	prefix = strings.Trim(path.Clean("/"+prefix), "/")
+	for _, p := range t.outPrefixes {
+		if p == "" || prefix == p || strings.HasPrefix(prefix, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash returns the hash of the token in the format of TokenConfig.Hash
+func Hash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hashPrefix + hex.EncodeToString(h[:])
+}
+
+// NewToken generates a random token
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type Authenticator struct {
+	tokens []*Token
+}
+
+func isKnown(s Scope) bool {
+	for _, k := range scopes {
+		if k == s {
+			return true
+		}
+	}
+	return false
+}
+
+// New creates an authenticator from the tokens in config.
+// It returns nil if there's no token, which means authentication is disabled.
+func New(configs []TokenConfig) (*Authenticator, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	a := &Authenticator{}
+	for _, c := range configs {
+		if !strings.HasPrefix(c.Hash, hashPrefix) {
+			return nil, errorx.IllegalArgument.New("hash of token %s should start with %s", c.Name, hashPrefix)
+		}
+		h, err := hex.DecodeString(strings.TrimPrefix(c.Hash, hashPrefix))
+		if err != nil || len(h) != sha256.Size {
+			return nil, errorx.IllegalArgument.New("bad hash of token %s", c.Name)
+		}
+		t := &Token{Name: c.Name, hash: h, scopes: make(map[Scope]struct{})}
+		for _, s := range c.Scopes {
+			if !isKnown(s) {
+				return nil, errorx.IllegalArgument.New("unknown scope %s of token %s", s, c.Name)
+			}
+			t.scopes[s] = struct{}{}
+		}
+		for _, p := range c.OutPrefixes {
+			t.outPrefixes = append(t.outPrefixes, strings.Trim(path.Clean("/"+p), "/"))
+		}
+		a.tokens = append(a.tokens, t)
+	}
+	return a, nil
+}
+
+// Authenticate finds the token of the bearer in `Authorization` header
+func (a *Authenticator) Authenticate(r *http.Request) (*Token, error) {
+	v := r.Header.Get("Authorization")
+	scheme, bearer, ok := strings.Cut(v, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || bearer == "" {
+		return nil, Unauthenticated.New("bearer token required")
+	}
+	h := sha256.Sum256([]byte(strings.TrimSpace(bearer)))
+	var found *Token
+	// compare with every token to not leak which one matched by timing
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(h[:], t.hash) == 1 {
+			found = t
+		}
+	}
+	if found == nil {
+		return nil, Unauthenticated.New("invalid token")
+	}
+	return found, nil
+}
+
+type tokenKey struct{}
+
+func WithToken(ctx context.Context, t *Token) context.Context {
+	return context.WithValue(ctx, tokenKey{}, t)
+}
+
+// FromContext returns the token of the request. nil if authentication is disabled.
+func FromContext(ctx context.Context) *Token {
+	t, _ := ctx.Value(tokenKey{}).(*Token)
+	return t
+}
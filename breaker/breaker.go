@@ -0,0 +1,289 @@
+package breaker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	Closed   State = "closed"
+	Open     State = "open"
+	HalfOpen State = "half-open"
+)
+
+// Result is the outcome of a request reported to the breaker
+type Result int
+
+const (
+	// Success closes a half-open breaker
+	Success Result = iota
+	// Failure is a ban, like 403, 429 or a challenge page
+	Failure
+	// Neutral is neither a success nor a ban, like a transport error.
+	// It only releases the probe of a half-open breaker.
+	Neutral
+)
+
+// probeWait is how long to wait when the probe of a half-open breaker is in flight
+const probeWait = time.Second
+
+type Config struct {
+	// number of the latest results the error ratio is computed over
+	Window int `mapstructure:"window"`
+	// the breaker won't open with fewer results than this in the window
+	MinRequests int `mapstructure:"min_requests"`
+	// the breaker opens when the ratio of failures reaches this. 0 disables the breaker
+	ErrorRatio float64 `mapstructure:"error_ratio"`
+	// how long the breaker stays open. Doubled each time the probe fails
+	Cooldown time.Duration `mapstructure:"cooldown"`
+	// upper bound of the cooldown
+	MaxCooldown time.Duration `mapstructure:"max_cooldown"`
+}
+
+var DefaultConfig = Config{
+	Window:      20,
+	MinRequests: 10,
+	ErrorRatio:  0.5,
+	Cooldown:    30 * time.Second,
+	MaxCooldown: 10 * time.Minute,
+}
+
+// OpenError is returned when the breaker of the host is open
+type OpenError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("circuit breaker of %s is open. retry after %s", e.Host, e.RetryAfter)
+}
+
+// HostState is the state of the breaker of a host
+//
+// @Description state of the circuit breaker of a host
+type HostState struct {
+	Host  string `json:"host" example:"example.com"`
+	State State  `json:"state" example:"closed" enums:"closed,open,half-open"`
+	// number of results in the window
+	Requests   int     `json:"requests" example:"20"`
+	ErrorRatio float64 `json:"error_ratio" example:"0.1"`
+	// consecutive times the breaker opened
+	Trips     int        `json:"trips" example:"0"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+type host struct {
+	state State
+	// ring buffer of the latest results. true for failure
+	results   []bool
+	next      int
+	count     int
+	failures  int
+	trips     int
+	openUntil time.Time
+	probing   bool
+	// the largest Retry-After seen since the last time the breaker opened,
+	// or the last success
+	retryAfter time.Duration
+}
+
+func (h *host) push(failure bool, window int) {
+	if len(h.results) != window {
+		h.results = make([]bool, window)
+		h.next, h.count, h.failures = 0, 0, 0
+	}
+	if h.count == window {
+		if h.results[h.next] {
+			h.failures--
+		}
+	} else {
+		h.count++
+	}
+	h.results[h.next] = failure
+	if failure {
+		h.failures++
+	}
+	h.next = (h.next + 1) % window
+}
+
+func (h *host) reset() {
+	h.results = nil
+	h.next, h.count, h.failures = 0, 0, 0
+}
+
+func (h *host) ratio() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	return float64(h.failures) / float64(h.count)
+}
+
+// Breaker is a set of per-host circuit breakers
+type Breaker struct {
+	mu     sync.Mutex
+	config Config
+	hosts  map[string]*host
+}
+
+func New(config Config) *Breaker {
+	if config.Window <= 0 {
+		config.Window = DefaultConfig.Window
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = DefaultConfig.Cooldown
+	}
+	if config.MaxCooldown < config.Cooldown {
+		config.MaxCooldown = config.Cooldown
+	}
+	return &Breaker{config: config, hosts: make(map[string]*host)}
+}
+
+func (b *Breaker) enabled() bool {
+	return b.config.ErrorRatio > 0
+}
+
+// get should be called with lock held
+func (b *Breaker) get(name string) *host {
+	name = strings.ToLower(name)
+	h, ok := b.hosts[name]
+	if !ok {
+		h = &host{state: Closed}
+		b.hosts[name] = h
+	}
+	return h
+}
+
+// Allow reports whether a request to the host could be sent now.
+// If not, it returns how long to wait before asking again.
+// When it returns true, Report must be called with the result.
+func (b *Breaker) Allow(name string) (time.Duration, bool) {
+	if !b.enabled() {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := b.get(name)
+	switch h.state {
+	case Open:
+		if d := time.Until(h.openUntil); d > 0 {
+			return d, false
+		}
+		// cooldown elapsed. let this one be the probe
+		h.state = HalfOpen
+		h.probing = true
+		return 0, true
+	case HalfOpen:
+		if h.probing {
+			return probeWait, false
+		}
+		h.probing = true
+		return 0, true
+	default:
+		return 0, true
+	}
+}
+
+// Wait blocks until a request to the host is allowed
+func (b *Breaker) Wait(ctx context.Context, name string) error {
+	for {
+		d, ok := b.Allow(name)
+		if ok {
+			return nil
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Report records the result of a request allowed by Allow.
+// retryAfter is the `Retry-After` of the response, 0 if absent.
+func (b *Breaker) Report(name string, result Result, retryAfter time.Duration) {
+	if !b.enabled() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := b.get(name)
+	if retryAfter > h.retryAfter {
+		h.retryAfter = retryAfter
+	}
+	switch h.state {
+	case HalfOpen:
+		h.probing = false
+		switch result {
+		case Success:
+			h.state = Closed
+			h.trips = 0
+			h.retryAfter = 0
+			h.reset()
+		case Failure:
+			b.open(h)
+		}
+	case Closed:
+		if result == Neutral {
+			return
+		}
+		// the host has recovered since. the hint is stale
+		if result == Success {
+			h.retryAfter = 0
+		}
+		h.push(result == Failure, b.config.Window)
+		if h.count >= b.config.MinRequests && h.ratio() >= b.config.ErrorRatio {
+			b.open(h)
+		}
+	case Open:
+		// the requests sent before the breaker opened. nothing to do
+	}
+}
+
+// open should be called with lock held
+func (b *Breaker) open(h *host) {
+	cooldown := b.config.Cooldown << h.trips
+	if cooldown > b.config.MaxCooldown || cooldown <= 0 {
+		cooldown = b.config.MaxCooldown
+	}
+	if h.retryAfter > cooldown {
+		cooldown = h.retryAfter
+	}
+	h.state = Open
+	h.trips++
+	h.openUntil = time.Now().Add(cooldown)
+	h.retryAfter = 0
+	h.reset()
+}
+
+// States returns the state of each host, sorted by host
+func (b *Breaker) States() []HostState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	states := make([]HostState, 0, len(b.hosts))
+	for name, h := range b.hosts {
+		s := HostState{
+			Host:       name,
+			State:      h.state,
+			Requests:   h.count,
+			ErrorRatio: h.ratio(),
+			Trips:      h.trips,
+		}
+		if h.state == Open {
+			t := h.openUntil
+			s.OpenUntil = &t
+		}
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Host < states[j].Host
+	})
+	return states
+}
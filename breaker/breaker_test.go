@@ -0,0 +1,151 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+const testHost = "example.com"
+
+func testBreaker() *Breaker {
+	return New(Config{Window: 4, MinRequests: 2, ErrorRatio: 0.5, Cooldown: time.Minute, MaxCooldown: time.Hour})
+}
+
+func state(b *Breaker) HostState {
+	for _, s := range b.States() {
+		if s.Host == testHost {
+			return s
+		}
+	}
+	return HostState{}
+}
+
+// trip opens the breaker of testHost, and lets its cooldown elapse
+func trip(t *testing.T, b *Breaker) {
+	t.Helper()
+	for i := 0; i < 2; i++ {
+		if _, ok := b.Allow(testHost); !ok {
+			t.Fatalf("request %d not allowed", i)
+		}
+		b.Report(testHost, Failure, 0)
+	}
+	if s := state(b); s.State != Open {
+		t.Fatalf("state = %s, want open", s.State)
+	}
+	if d, ok := b.Allow(testHost); ok || d <= 0 {
+		t.Fatalf("Allow = %s, %v while open", d, ok)
+	}
+	b.mu.Lock()
+	b.hosts[testHost].openUntil = time.Now().Add(-time.Millisecond)
+	b.mu.Unlock()
+}
+
+func TestMinRequests(t *testing.T) {
+	b := testBreaker()
+	b.Allow(testHost)
+	b.Report(testHost, Failure, 0)
+	if s := state(b); s.State != Closed {
+		t.Fatalf("state = %s after one failure, want closed", s.State)
+	}
+	// neither a success nor a failure
+	b.Allow(testHost)
+	b.Report(testHost, Neutral, 0)
+	if s := state(b); s.State != Closed || s.Requests != 1 {
+		t.Fatalf("state = %+v after a neutral result, want closed with 1 request", s)
+	}
+}
+
+func TestHalfOpenProbe(t *testing.T) {
+	tests := []struct {
+		name      string
+		result    Result
+		want      State
+		allowNext bool
+		trips     int
+	}{
+		{"success closes", Success, Closed, true, 0},
+		{"failure opens again", Failure, Open, false, 2},
+		{"neutral releases the probe", Neutral, HalfOpen, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBreaker()
+			trip(t, b)
+			if _, ok := b.Allow(testHost); !ok {
+				t.Fatal("probe not allowed once the cooldown elapsed")
+			}
+			if s := state(b); s.State != HalfOpen {
+				t.Fatalf("state = %s, want half-open", s.State)
+			}
+			// only one probe at a time
+			if d, ok := b.Allow(testHost); ok || d != probeWait {
+				t.Fatalf("Allow = %s, %v while probing, want %s", d, ok, probeWait)
+			}
+			b.Report(testHost, tt.result, 0)
+			s := state(b)
+			if s.State != tt.want || s.Trips != tt.trips {
+				t.Fatalf("state = %+v, want %s with %d trips", s, tt.want, tt.trips)
+			}
+			if _, ok := b.Allow(testHost); ok != tt.allowNext {
+				t.Fatalf("next Allow = %v, want %v", ok, tt.allowNext)
+			}
+		})
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter time.Duration
+		// after the probe failed
+		want time.Duration
+	}{
+		{"doubled", 0, 2 * time.Minute},
+		{"longer retry after", 5 * time.Minute, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBreaker()
+			trip(t, b)
+			b.Allow(testHost)
+			b.Report(testHost, Failure, tt.retryAfter)
+			s := state(b)
+			if s.OpenUntil == nil {
+				t.Fatalf("state = %+v, want open", s)
+			}
+			got := time.Until(*s.OpenUntil)
+			if got > tt.want || got < tt.want-time.Second {
+				t.Fatalf("cooldown = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfterReset(t *testing.T) {
+	b := New(Config{Window: 4, MinRequests: 4, ErrorRatio: 0.5, Cooldown: time.Minute, MaxCooldown: time.Hour})
+	// the host recovers after the Retry-After, and fails again later
+	for _, r := range []struct {
+		result     Result
+		retryAfter time.Duration
+	}{{Failure, time.Hour}, {Success, 0}, {Success, 0}, {Failure, 0}} {
+		b.Allow(testHost)
+		b.Report(testHost, r.result, r.retryAfter)
+	}
+	s := state(b)
+	if s.OpenUntil == nil {
+		t.Fatalf("state = %+v, want open", s)
+	}
+	if got := time.Until(*s.OpenUntil); got > time.Minute {
+		t.Fatalf("cooldown = %s, want the stale retry after ignored", got)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	b := New(Config{})
+	for i := 0; i < 20; i++ {
+		if _, ok := b.Allow(testHost); !ok {
+			t.Fatal("request not allowed with the breaker disabled")
+		}
+		b.Report(testHost, Failure, 0)
+	}
+}
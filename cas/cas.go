@@ -0,0 +1,317 @@
+package cas
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/utils"
+	"github.com/joomcode/errorx"
+)
+
+const (
+	// LayoutPlain saves the files as they are
+	LayoutPlain = "plain"
+	// LayoutCAS saves the content under `objects/<sha256>`, and the files are links to it
+	LayoutCAS = "cas"
+)
+
+// ObjectsDir is the directory of the objects under the output directory
+const ObjectsDir = "objects"
+
+// RefsSuffix is appended to the object for the file listing the names referring to it
+const RefsSuffix = ".refs"
+
+type Config struct {
+	// `plain` or `cas`
+	Layout string `mapstructure:"layout"`
+}
+
+var DefaultConfig = Config{
+	Layout: LayoutPlain,
+}
+
+// Store keeps the content once no matter how many names it's saved as.
+// The names are hardlinks of the object, or symlinks if hardlinks are not
+// supported. A nil Store saves the files as they are.
+type Store struct {
+	mu      sync.Mutex
+	root    string
+	objects string
+	// object of each name, relative to root
+	names map[string]string
+}
+
+// New creates the store of the output directory. Returns nil if the layout is plain.
+func New(config Config, root string) (*Store, error) {
+	switch config.Layout {
+	case "", LayoutPlain:
+		return nil, nil
+	case LayoutCAS:
+	default:
+		return nil, errorx.IllegalArgument.New("bad storage layout %s. expect plain or cas", config.Layout)
+	}
+	s := &Store{root: root, objects: filepath.Join(root, ObjectsDir), names: make(map[string]string)}
+	if err := os.MkdirAll(s.objects, 0755); err != nil {
+		return nil, errorx.Decorate(err, "failed to create objects directory %s", s.objects)
+	}
+	refs, err := s.allRefs()
+	if err != nil {
+		return nil, err
+	}
+	for sum, names := range refs {
+		for _, n := range names {
+			s.names[n] = sum
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) objectPath(sum string) string {
+	return filepath.Join(s.objects, sum)
+}
+
+func (s *Store) refsPath(sum string) string {
+	return s.objectPath(sum) + RefsSuffix
+}
+
+// rel is the name relative to the root
+func (s *Store) rel(name string) string {
+	r, err := filepath.Rel(s.root, name)
+	if err != nil || strings.HasPrefix(r, "..") {
+		abs, _ := filepath.Abs(name)
+		return abs
+	}
+	return filepath.ToSlash(r)
+}
+
+func (s *Store) abs(rel string) string {
+	if filepath.IsAbs(rel) {
+		return rel
+	}
+	return filepath.Join(s.root, filepath.FromSlash(rel))
+}
+
+func (s *Store) readRefs(sum string) ([]string, error) {
+	b, err := os.ReadFile(s.refsPath(sum))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	err = json.Unmarshal(b, &names)
+	return names, err
+}
+
+// writeRefs saves the names referring to the object. The object is removed
+// if there's none.
+func (s *Store) writeRefs(sum string, names []string) error {
+	if len(names) == 0 {
+		log.Sugar().Infow("object unreferenced", "sha256", sum)
+		_ = os.Remove(s.objectPath(sum))
+		err := os.Remove(s.refsPath(sum))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	sort.Strings(names)
+	b, _ := json.Marshal(names)
+	return utils.WriteFileAtomic(s.refsPath(sum), b, 0644)
+}
+
+// allRefs reads the names of every object
+func (s *Store) allRefs() (map[string][]string, error) {
+	entries, err := os.ReadDir(s.objects)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string][]string)
+	for _, e := range entries {
+		sum, ok := strings.CutSuffix(e.Name(), RefsSuffix)
+		if !ok {
+			continue
+		}
+		names, err := s.readRefs(sum)
+		if err != nil {
+			return nil, errorx.Decorate(err, "bad refs of object %s", sum)
+		}
+		refs[sum] = names
+	}
+	return refs, nil
+}
+
+// addRefLocked adds the name to the refs of the object, and removes it from
+// the refs of the object it used to refer to
+func (s *Store) addRefLocked(name string, sum string) error {
+	if old, ok := s.names[name]; ok && old != sum {
+		if err := s.removeRefLocked(name); err != nil {
+			return err
+		}
+	}
+	names, err := s.readRefs(sum)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n == name {
+			s.names[name] = sum
+			return nil
+		}
+	}
+	if err = s.writeRefs(sum, append(names, name)); err != nil {
+		return err
+	}
+	s.names[name] = sum
+	return nil
+}
+
+func (s *Store) removeRefLocked(name string) error {
+	sum, ok := s.names[name]
+	if !ok {
+		return nil
+	}
+	delete(s.names, name)
+	names, err := s.readRefs(sum)
+	if err != nil {
+		return err
+	}
+	kept := names[:0]
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return s.writeRefs(sum, kept)
+}
+
+// link makes name refer to the object, replacing the file of the name if any
+func (s *Store) link(object string, name string) error {
+	tmp := name + ".link-tmp"
+	_ = os.Remove(tmp)
+	err := os.Link(object, tmp)
+	if err != nil {
+		// like across devices, or on filesystems without hardlinks
+		target, e := filepath.Rel(filepath.Dir(name), object)
+		if e != nil {
+			target = object
+		}
+		if e = os.Symlink(target, tmp); e != nil {
+			return errorx.Decorate(e, "failed to link %s (hardlink: %s)", name, err)
+		}
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Save saves data of the SHA-256 as name. The object is only written if
+// it doesn't exist yet.
+func (s *Store) Save(name string, data []byte, sum string) error {
+	if s == nil {
+		return utils.WriteFileAtomic(name, data, 0644)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object := s.objectPath(sum)
+	if _, err := os.Stat(object); errors.Is(err, os.ErrNotExist) {
+		// the objects are shared. never modify them in place
+		if err = utils.WriteFileAtomic(object, data, 0444); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	// the stale ref left by a crash is cleaned by GC, while a link without ref
+	// would be lost
+	if err := s.addRefLocked(s.rel(name), sum); err != nil {
+		return err
+	}
+	return s.link(object, name)
+}
+
+// Remove removes the name, and the object once nothing refers to it
+func (s *Store) Remove(name string) error {
+	if s == nil {
+		return os.Remove(name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(name)
+	if e := s.removeRefLocked(s.rel(name)); e != nil {
+		return e
+	}
+	return err
+}
+
+// GCResult is what GC has found
+type GCResult struct {
+	// names that no longer refer to their objects
+	StaleRefs []string
+	// objects removed since nothing refers to them
+	Removed []string
+	// bytes of the removed objects
+	Freed int64
+}
+
+// GC drops the names that have been removed or replaced without Remove, and
+// removes the objects nothing refers to. Nothing is changed if dryRun.
+func (s *Store) GC(dryRun bool) (GCResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result GCResult
+	refs, err := s.allRefs()
+	if err != nil {
+		return result, err
+	}
+	entries, err := os.ReadDir(s.objects)
+	if err != nil {
+		return result, err
+	}
+	for _, e := range entries {
+		sum := e.Name()
+		if e.IsDir() || strings.HasSuffix(sum, RefsSuffix) || strings.HasSuffix(sum, ".tmp") {
+			continue
+		}
+		objectInfo, err := os.Stat(s.objectPath(sum))
+		if err != nil {
+			continue
+		}
+		var kept []string
+		for _, n := range refs[sum] {
+			// follows the symlink
+			info, err := os.Stat(s.abs(n))
+			if err == nil && os.SameFile(info, objectInfo) {
+				kept = append(kept, n)
+				continue
+			}
+			result.StaleRefs = append(result.StaleRefs, n)
+		}
+		if len(kept) == 0 {
+			result.Removed = append(result.Removed, sum)
+			result.Freed += objectInfo.Size()
+		}
+		if dryRun || len(kept) == len(refs[sum]) && len(kept) > 0 {
+			continue
+		}
+		for _, n := range refs[sum] {
+			delete(s.names, n)
+		}
+		for _, n := range kept {
+			s.names[n] = sum
+		}
+		if err = s.writeRefs(sum, kept); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,189 @@
+package cas
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func sum(data []byte) string {
+	s := sha256.Sum256(data)
+	return hex.EncodeToString(s[:])
+}
+
+func newStore(t *testing.T) (*Store, string) {
+	t.Helper()
+	root := t.TempDir()
+	s, err := New(Config{Layout: LayoutCAS}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, root
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+func refsOf(t *testing.T, s *Store, sum string) []string {
+	t.Helper()
+	names, err := s.readRefs(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func save(t *testing.T, s *Store, name string, data []byte) {
+	t.Helper()
+	if err := s.Save(name, data, sum(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveRemoveRefs(t *testing.T) {
+	s, root := newStore(t)
+	data := []byte("image")
+	a, b := filepath.Join(root, "a.jpg"), filepath.Join(root, "sub", "b.jpg")
+	if err := os.MkdirAll(filepath.Dir(b), 0755); err != nil {
+		t.Fatal(err)
+	}
+	save(t, s, a, data)
+	save(t, s, b, data)
+	// saving again doesn't add the ref twice
+	save(t, s, a, data)
+
+	object := s.objectPath(sum(data))
+	if got := refsOf(t, s, sum(data)); len(got) != 2 || got[0] != "a.jpg" || got[1] != "sub/b.jpg" {
+		t.Fatalf("refs = %v, want [a.jpg sub/b.jpg]", got)
+	}
+	for _, name := range []string{a, b} {
+		content, err := os.ReadFile(name)
+		if err != nil || string(content) != string(data) {
+			t.Fatalf("content of %s = %q, %v", name, content, err)
+		}
+	}
+
+	tests := []struct {
+		remove     string
+		refs       int
+		objectLeft bool
+	}{
+		{a, 1, true},
+		// removing twice changes nothing
+		{a, 1, true},
+		{b, 0, false},
+	}
+	for _, tt := range tests {
+		_ = s.Remove(tt.remove)
+		if got := refsOf(t, s, sum(data)); len(got) != tt.refs {
+			t.Fatalf("refs = %v after removing %s, want %d", got, tt.remove, tt.refs)
+		}
+		if exists(object) != tt.objectLeft {
+			t.Fatalf("object exists = %v after removing %s, want %v", exists(object), tt.remove, tt.objectLeft)
+		}
+	}
+	if exists(s.refsPath(sum(data))) {
+		t.Fatal("refs file left")
+	}
+}
+
+func TestSaveReplaces(t *testing.T) {
+	s, root := newStore(t)
+	name := filepath.Join(root, "a.jpg")
+	first, second := []byte("first"), []byte("second")
+	save(t, s, name, first)
+	save(t, s, name, second)
+	if exists(s.objectPath(sum(first))) {
+		t.Fatal("the object nothing refers to is left")
+	}
+	if got := refsOf(t, s, sum(second)); len(got) != 1 {
+		t.Fatalf("refs = %v, want [a.jpg]", got)
+	}
+	if content, _ := os.ReadFile(name); string(content) != string(second) {
+		t.Fatalf("content = %q, want %q", content, second)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	s, root := newStore(t)
+	data := []byte("image")
+	a, b := filepath.Join(root, "a.jpg"), filepath.Join(root, "b.jpg")
+	save(t, s, a, data)
+	save(t, s, b, data)
+
+	s, err := New(Config{Layout: LayoutCAS}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	if got := refsOf(t, s, sum(data)); len(got) != 1 || got[0] != "b.jpg" {
+		t.Fatalf("refs = %v, want [b.jpg]", got)
+	}
+}
+
+func TestGC(t *testing.T) {
+	s, root := newStore(t)
+	kept, gone := []byte("kept"), []byte("gone")
+	a, b := filepath.Join(root, "a.jpg"), filepath.Join(root, "b.jpg")
+	save(t, s, a, kept)
+	save(t, s, b, gone)
+	// removed without the store
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dryRun     bool
+		objectLeft bool
+	}{
+		{true, true},
+		{false, false},
+	}
+	for _, tt := range tests {
+		result, err := s.GC(tt.dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.StaleRefs) != 1 || result.StaleRefs[0] != "b.jpg" {
+			t.Fatalf("stale refs = %v, want [b.jpg]", result.StaleRefs)
+		}
+		if len(result.Removed) != 1 || result.Removed[0] != sum(gone) || result.Freed != int64(len(gone)) {
+			t.Fatalf("result = %+v, want %s removed", result, sum(gone))
+		}
+		if exists(s.objectPath(sum(gone))) != tt.objectLeft {
+			t.Fatalf("object exists = %v with dry run %v", !tt.objectLeft, tt.dryRun)
+		}
+	}
+	if !exists(s.objectPath(sum(kept))) || len(refsOf(t, s, sum(kept))) != 1 {
+		t.Fatal("the object still referred to is removed")
+	}
+	result, err := s.GC(false)
+	if err != nil || len(result.StaleRefs) != 0 || len(result.Removed) != 0 {
+		t.Fatalf("second GC = %+v, %v, want nothing", result, err)
+	}
+}
+
+func TestPlain(t *testing.T) {
+	s, err := New(Config{Layout: LayoutPlain}, t.TempDir())
+	if err != nil || s != nil {
+		t.Fatalf("New = %v, %v, want nil", s, err)
+	}
+	name := filepath.Join(t.TempDir(), "a.jpg")
+	data := []byte("image")
+	if err = s.Save(name, data, sum(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Remove(name); err != nil || exists(name) {
+		t.Fatalf("Remove = %v, exists %v", err, exists(name))
+	}
+	if _, err = New(Config{Layout: "bad"}, t.TempDir()); err == nil {
+		t.Fatal("New accepted a bad layout")
+	}
+}
@@ -0,0 +1,221 @@
+package classify
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/joomcode/errorx"
+)
+
+// Class is the label of a response
+type Class string
+
+const (
+	OK            Class = "ok"
+	Challenge     Class = "challenge"
+	Captcha       Class = "captcha"
+	RateLimited   Class = "rate-limited"
+	LoginRequired Class = "login-required"
+	NotFound      Class = "not-found"
+	Soft404       Class = "soft-404"
+	// Error is any other bad response, like 5xx
+	Error Class = "error"
+)
+
+var classes = []Class{OK, Challenge, Captcha, RateLimited, LoginRequired, NotFound, Soft404, Error}
+
+// maxBodyScan is the max number of bytes of the body scanned by the body signatures.
+// The signatures of the block pages are always near the beginning.
+const maxBodyScan = 64 * 1024
+
+// Rule labels a response with Class if all the conditions set are met.
+type Rule struct {
+	Class Class `mapstructure:"class"`
+	// any of the status codes
+	Status []int `mapstructure:"status"`
+	// each header should contain the value (case-insensitive).
+	// empty value means the header should be present.
+	Headers map[string]string `mapstructure:"headers"`
+	// any of the regular expressions matches the final url
+	Url []string `mapstructure:"url"`
+	// any of the regular expressions matches the (text) body
+	Body []string `mapstructure:"body"`
+}
+
+// DefaultRules are applied after the rules from config
+var DefaultRules = []Rule{
+	{Class: Challenge, Headers: map[string]string{"cf-mitigated": "challenge"}},
+	{
+		Class:   Challenge,
+		Status:  []int{403, 503},
+		Headers: map[string]string{"server": "cloudflare"},
+		Body:    []string{`(?i)<title>just a moment\.\.\.</title>`, `_cf_chl_opt`, `/cdn-cgi/challenge-platform/`},
+	},
+	{Class: Challenge, Status: []int{403, 503}, Body: []string{`(?i)ddos-guard`, `(?i)<title>[^<]*(attention required|access denied)[^<]*</title>`}},
+	{Class: Captcha, Body: []string{`captcha-delivery\.com`, `(?i)<title>[^<]*captcha[^<]*</title>`, `(?i)verify (that )?you are (a )?human`}},
+	{Class: Captcha, Status: []int{403, 429}, Body: []string{`g-recaptcha`, `h-captcha`, `cf-turnstile`}},
+	{Class: RateLimited, Status: []int{429}},
+	{Class: LoginRequired, Status: []int{401}},
+	// a login page, not a file under such a path like /img/login.png
+	{
+		Class:   LoginRequired,
+		Headers: map[string]string{"content-type": "text/html"},
+		Url:     []string{`(?i)/(login|signin|sign-in|sign_in)([/?#]|$)`},
+	},
+	{Class: LoginRequired, Status: []int{301, 302, 303, 307, 308}, Headers: map[string]string{"location": "login"}},
+	{Class: NotFound, Status: []int{404, 410}},
+	{Class: Soft404, Status: []int{200}, Body: []string{`(?i)<title>[^<]*(404|not found)[^<]*</title>`}},
+}
+
+// Response is what the classifier looks at
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	// the url after the redirects
+	Url  string
+	Body []byte
+}
+
+type compiledRule struct {
+	class   Class
+	status  map[int]struct{}
+	headers map[string]string
+	url     []*regexp.Regexp
+	body    []*regexp.Regexp
+}
+
+type Classifier struct {
+	rules []compiledRule
+}
+
+func compileAll(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(exprs))
+	for i, e := range exprs {
+		re, err := regexp.Compile(e)
+		if err != nil {
+			return nil, errorx.Decorate(err, "bad regular expression %s", e)
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+func isKnown(c Class) bool {
+	for _, k := range classes {
+		if k == c {
+			return true
+		}
+	}
+	return false
+}
+
+func compile(r Rule) (compiledRule, error) {
+	if !isKnown(r.Class) {
+		return compiledRule{}, errorx.IllegalArgument.New("unknown class %s", r.Class)
+	}
+	c := compiledRule{class: r.Class, headers: make(map[string]string)}
+	if len(r.Status) > 0 {
+		c.status = make(map[int]struct{})
+		for _, s := range r.Status {
+			c.status[s] = struct{}{}
+		}
+	}
+	for k, v := range r.Headers {
+		c.headers[http.CanonicalHeaderKey(k)] = strings.ToLower(v)
+	}
+	var err error
+	if c.url, err = compileAll(r.Url); err != nil {
+		return c, err
+	}
+	if c.body, err = compileAll(r.Body); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// New creates a classifier with the rules, which are tried in order
+// before DefaultRules.
+func New(rules []Rule, withDefaults bool) (*Classifier, error) {
+	all := append([]Rule(nil), rules...)
+	if withDefaults {
+		all = append(all, DefaultRules...)
+	}
+	c := &Classifier{}
+	for i, r := range all {
+		cr, err := compile(r)
+		if err != nil {
+			return nil, errorx.Decorate(err, "bad classification rule #%d", i)
+		}
+		c.rules = append(c.rules, cr)
+	}
+	return c, nil
+}
+
+func anyMatch(res []*regexp.Regexp, b []byte) bool {
+	for _, re := range res {
+		if re.Match(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *compiledRule) match(resp *Response, body []byte) bool {
+	if r.status != nil {
+		if _, ok := r.status[resp.StatusCode]; !ok {
+			return false
+		}
+	}
+	for k, v := range r.headers {
+		vs := resp.Header.Values(k)
+		if len(vs) == 0 {
+			return false
+		}
+		if v != "" && !strings.Contains(strings.ToLower(strings.Join(vs, ",")), v) {
+			return false
+		}
+	}
+	if len(r.url) > 0 && !anyMatch(r.url, []byte(resp.Url)) {
+		return false
+	}
+	if len(r.body) > 0 && (body == nil || !anyMatch(r.body, body)) {
+		return false
+	}
+	return true
+}
+
+func isText(header http.Header) bool {
+	ct := strings.ToLower(header.Get("Content-Type"))
+	for _, t := range []string{"text", "html", "json", "xml", "javascript"} {
+		if strings.Contains(ct, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Classify returns the class of the first matched rule. If none matches,
+// it's OK for 2xx and 3xx, and Error otherwise.
+func (c *Classifier) Classify(resp *Response) Class {
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	// don't scan binary like images
+	var body []byte
+	if isText(resp.Header) {
+		body = resp.Body
+		if len(body) > maxBodyScan {
+			body = body[:maxBodyScan]
+		}
+	}
+	for i := range c.rules {
+		if c.rules[i].match(resp, body) {
+			return c.rules[i].class
+		}
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+		return OK
+	}
+	return Error
+}
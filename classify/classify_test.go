@@ -0,0 +1,62 @@
+package classify
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDefaultRules(t *testing.T) {
+	c, err := New(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := func(kv ...string) http.Header {
+		h := http.Header{}
+		for i := 0; i+1 < len(kv); i += 2 {
+			h.Set(kv[i], kv[i+1])
+		}
+		return h
+	}
+	tests := []struct {
+		name string
+		resp Response
+		want Class
+	}{
+		{"image", Response{StatusCode: 200, Header: header("Content-Type", "image/jpeg"), Url: "https://example.com/a.jpg"}, OK},
+		{"image named login", Response{StatusCode: 200, Header: header("Content-Type", "image/png"), Url: "https://example.com/img/login.png"}, OK},
+		{"image named signin", Response{StatusCode: 200, Header: header("Content-Type", "image/jpeg"), Url: "https://example.com/assets/signin.jpg"}, OK},
+		{"image under login", Response{StatusCode: 200, Header: header("Content-Type", "image/webp"), Url: "https://example.com/login/bg.webp"}, OK},
+		{"login page", Response{StatusCode: 200, Header: header("Content-Type", "text/html; charset=utf-8"), Url: "https://example.com/login?next=/a.jpg"}, LoginRequired},
+		{"sign-in page", Response{StatusCode: 200, Header: header("Content-Type", "text/html"), Url: "https://example.com/users/sign-in"}, LoginRequired},
+		{"401", Response{StatusCode: 401, Url: "https://example.com/a.jpg"}, LoginRequired},
+		{"redirect to login", Response{StatusCode: 302, Header: header("Location", "/login"), Url: "https://example.com/a.jpg"}, LoginRequired},
+		{"cloudflare", Response{StatusCode: 403, Header: header("Server", "cloudflare", "Content-Type", "text/html"), Body: []byte("<title>Just a moment...</title>")}, Challenge},
+		{"429", Response{StatusCode: 429}, RateLimited},
+		{"404", Response{StatusCode: 404}, NotFound},
+		{"soft 404", Response{StatusCode: 200, Header: header("Content-Type", "text/html"), Body: []byte("<title>Page Not Found</title>")}, Soft404},
+		// the body of an image is never scanned
+		{"binary body", Response{StatusCode: 200, Header: header("Content-Type", "image/png"), Body: []byte("<title>captcha</title>")}, OK},
+		{"500", Response{StatusCode: 500}, Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.Classify(&tt.resp); got != tt.want {
+				t.Fatalf("Classify = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRulesFirst(t *testing.T) {
+	c, err := New([]Rule{{Class: Soft404, Url: []string{`/placeholder\.png$`}}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := c.Classify(&Response{StatusCode: 200, Header: http.Header{"Content-Type": {"image/png"}}, Url: "https://example.com/placeholder.png"})
+	if got != Soft404 {
+		t.Fatalf("Classify = %s, want %s", got, Soft404)
+	}
+	if _, err = New([]Rule{{Class: "unknown"}}, false); err == nil {
+		t.Fatal("New accepted an unknown class")
+	}
+}
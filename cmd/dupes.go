@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/phash"
+	"github.com/spf13/cobra"
+)
+
+const MaxDistanceFlagName = "max_distance"
+
+// clusters groups the images connected by the distance within maxDistance.
+// Only the groups of more than one image are returned.
+func clusters(images []entity.HistoryEntry, maxDistance int) [][]entity.HistoryEntry {
+	hashes := make([]phash.Hashes, len(images))
+	parent := make([]int, len(images))
+	for i, e := range images {
+		hashes[i], _ = phash.ParseHashes(e.AHash, e.DHash)
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if hashes[i].Distance(hashes[j]) <= maxDistance {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+	groups := make(map[int][]entity.HistoryEntry)
+	for i, e := range images {
+		root := find(i)
+		groups[root] = append(groups[root], e)
+	}
+	var found [][]entity.HistoryEntry
+	for _, g := range groups {
+		if len(g) > 1 {
+			found = append(found, g)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i][0].Path < found[j][0].Path
+	})
+	return found
+}
+
+func dupesRun(cmd *cobra.Command, args []string) {
+	config, err := GetPhashConfigFromViper()
+	if err != nil {
+		log.Sugar().Panicw("bad phash config", "error", err)
+	}
+	maxDistance := config.MaxDistance
+	if cmd.Flags().Changed(MaxDistanceFlagName) {
+		maxDistance, _ = cmd.Flags().GetInt(MaxDistanceFlagName)
+	}
+	var only string
+	if len(args) > 0 {
+		only = filepath.Clean(args[0])
+	}
+	images := openHistory().Images()
+	dirs := make([]string, 0, len(images))
+	for dir := range images {
+		if only == "" || dir == only {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	n := 0
+	for _, dir := range dirs {
+		for _, g := range clusters(images[dir], maxDistance) {
+			n++
+			fmt.Printf("# %s (%d images)\n", dir, len(g))
+			first, _ := phash.ParseHashes(g[0].AHash, g[0].DHash)
+			for _, e := range g {
+				h, _ := phash.ParseHashes(e.AHash, e.DHash)
+				fmt.Printf("%d\t%s\t%s\n", first.Distance(h), e.Path, e.Url)
+			}
+			fmt.Println()
+		}
+	}
+	fmt.Printf("%d groups of near duplicates\n", n)
+}
+
+var dupesCmd = cobra.Command{
+	Use:   "dupes [directory]",
+	Short: "report the groups of images in the history that look the same, by directory",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   dupesRun,
+}
+
+func init() {
+	dupesCmd.Flags().Int(MaxDistanceFlagName, 0, "the most bits that could differ. phash.max_distance if not set")
+}
@@ -1,22 +1,31 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/crosstyan/dumb_downloader/global/log"
 	"github.com/panjf2000/ants/v2"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"sort"
-	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/crosstyan/dumb_downloader/breaker"
+	"github.com/crosstyan/dumb_downloader/digest"
 	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/imageinfo"
+	"github.com/crosstyan/dumb_downloader/metrics"
+	"github.com/crosstyan/dumb_downloader/throttle"
 	"github.com/crosstyan/dumb_downloader/utils"
-	"github.com/imroc/req/v3"
 	"github.com/joomcode/errorx"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"golang.org/x/exp/maps"
 )
 
@@ -69,17 +78,22 @@ func runDescription(cmd *cobra.Command, args []string) {
 		log.Sugar().Panicw("failed to get output directory", "error", err)
 	}
 
-	// https://req.cool/zh/docs/tutorial/http-fingerprint/
-	// https://req.cool/zh/docs/tutorial/tls-fingerprint/
-	// [ImpersonateChrome] would also set TLS fingerprint
-	// https://req.cool/zh/docs/tutorial/proxy/
-	client := req.C().ImpersonateChrome()
-	_, f, err := GetHttpProxyFromViper()
+	throttleConfig, err := GetThrottleConfigFromViper()
 	if err != nil {
-		log.Sugar().Errorw("failed to get proxy", "error", err)
-	} else {
-		client = client.SetProxy(f)
+		log.Sugar().Panicw("failed to get bandwidth caps", "error", err)
+	}
+	client := makeClient(throttle.NewLimiter(throttleConfig), nil)
+	sz, err := GetPoolSizeFromViper()
+	if err != nil {
+		log.Sugar().Panicw("failed to get pool size", "error", err)
+	}
+	pipe, err := newPipelineFromViper(outDir, sz)
+	if err != nil {
+		log.Sugar().Panicw("failed to create pipeline", "error", err)
 	}
+	// the downloads in progress are aborted on interrupt, and nothing is saved for them
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	referer, ok := refererO.Get()
 	if ok {
@@ -88,10 +102,6 @@ func runDescription(cmd *cobra.Command, args []string) {
 		log.Sugar().Warnf("no referer set")
 	}
 
-	sz, err := GetPoolSizeFromViper()
-	if err != nil {
-		log.Sugar().Panicw("failed to get pool size", "error", err)
-	}
 	p, err := ants.NewPool(sz)
 	if err != nil {
 		log.Sugar().Panicw("failed to create pool", "error", err)
@@ -99,11 +109,19 @@ func runDescription(cmd *cobra.Command, args []string) {
 	defer p.Release()
 	var wg sync.WaitGroup
 	for _, link := range d.Links {
+		link := link
 		wg.Add(1)
 		dlFn := func() {
 			// get the last part of the path
 			p := path.Base(link.Path)
 			out := path.Join(outDir, p)
+			if ctx.Err() != nil {
+				return
+			}
+			if e, ok := pipe.history.Completed(link.String()); ok && pipe.skipCompleted {
+				log.Sugar().Infow("downloaded before. skip.", "url", link.String(), "output", e.Path, "at", e.Time)
+				return
+			}
 			stat, err := os.Stat(out)
 			if !os.IsNotExist(err) {
 				if stat.IsDir() {
@@ -113,9 +131,13 @@ func runDescription(cmd *cobra.Command, args []string) {
 				log.Sugar().Infow("output file already exists. skip.", "url", link.String(), "output", out)
 				return
 			}
+			fail := func(err error) {
+				pipe.recordHistory(entity.HistoryEntry{Url: link.String(), Status: entity.JobFailed, Error: err.Error()})
+			}
 			// convert to array of pointers...
 			cookies := utils.Map(c, func(c http.Cookie) *http.Cookie { return &c })
-			R := client.R().SetCookies(cookies...)
+			reqCtx, hasher := digest.WithHasher(imageinfo.WithMode(ctx, pipe.validation.Mode), pipe.digests...)
+			R := client.R().SetContext(reqCtx).SetCookies(cookies...)
 			referer, ok := refererO.Get()
 			if ok {
 				R.SetHeader("Referer", referer)
@@ -123,35 +145,75 @@ func runDescription(cmd *cobra.Command, args []string) {
 			R.SetHeader("Sec-Fetch-Dest", "image")
 			R.SetHeader("Sec-Fetch-Mode", "no-cors")
 			R.SetHeader("Sec-Fetch-Site", "same-site")
+			host := link.Hostname()
+			if err := pipe.concurrency.Acquire(ctx, host); err != nil {
+				log.Sugar().Warnw("download cancelled", "url", link.String(), "error", err)
+				return
+			}
+			if err := pipe.breaker.Wait(ctx, host); err != nil {
+				log.Sugar().Errorw("failed to wait for circuit breaker", "url", link.String(), "error", err)
+				pipe.concurrency.Cancel(host)
+				return
+			}
+			start := time.Now()
 			res, err := R.Get(link.String())
+			if err != nil && ctx.Err() != nil {
+				log.Sugar().Warnw("download interrupted", "url", link.String(), "error", err)
+				pipe.breaker.Report(host, breaker.Neutral, 0)
+				pipe.concurrency.Cancel(host)
+				return
+			}
 			if err != nil {
 				log.Sugar().Errorw("failed to download image", "url", link.String(), "error", err)
+				fail(err)
 				utils.PrintHeadersCookies(R)
+				pipe.breaker.Report(host, breaker.Neutral, 0)
+				pipe.concurrency.Cancel(host)
+				metrics.RequestErrors.WithLabelValues(host).Inc()
 				return
 			}
-
-			// TODO: custom content type. For now I only need image
-			if ct := res.Header.Get("Content-Type"); !strings.Contains(ct, "image") {
-				log.Sugar().Errorw("not a image", "url", link.String(), "Content-Type", res.Header.Get("Content-Type"))
+			o, err := pipe.process(fetched{
+				url:      link.String(),
+				method:   http.MethodGet,
+				resp:     res,
+				latency:  time.Since(start),
+				hasher:   hasher,
+				validate: true,
+				out:      out,
+				entry:    entity.HistoryEntry{Url: link.String()},
+			})
+			var invalid *imageinfo.InvalidError
+			switch {
+			case err == nil:
+			case errors.Is(err, errBadResponse):
+				log.Sugar().Errorw("bad response", "url", link.String(), "Content-Type", res.Header.Get("Content-Type"), "status", res.StatusCode, "classification", o.class)
 				log.Sugar().Debugw("response", "headers", res.Header, "response", res.String())
 				utils.PrintHeadersCookies(R)
-				// TODO: retry and max Error to break
-				return
-			}
-			err = os.WriteFile(out, res.Bytes(), 0644)
-			if err != nil {
+				fail(err)
+			case errors.As(err, &invalid):
+				log.Sugar().Errorw("invalid image", "url", link.String(), "error", err)
+				fail(err)
+			default:
 				log.Sugar().Errorw("failed to save image", "url", link.String(), "error", err)
-				return
-			} else {
-				log.Sugar().Infow("downloaded", "url", link.String(), "output", out)
+				fail(err)
 			}
 		}
 		err = p.Submit(func() {
+			metrics.ActiveWorkers.Inc()
 			dlFn()
+			metrics.ActiveWorkers.Dec()
 			wg.Done()
 		})
 	}
 	wg.Wait()
+	if textfile := viper.GetString(MetricsTextfileFlagName); textfile != "" {
+		err = metrics.WriteTextfile(textfile)
+		if err != nil {
+			log.Sugar().Errorw("failed to write metrics", "file", textfile, "error", err)
+		} else {
+			log.Sugar().Infow("metrics written", "file", textfile)
+		}
+	}
 }
 
 var from = cobra.Command{
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/spf13/cobra"
+)
+
+const DryRunFlagName = "dry_run"
+
+func gcRun(cmd *cobra.Command, args []string) {
+	outDir, err := GetOutDirFromViper()
+	if err != nil {
+		log.Sugar().Panicw("failed to get output directory", "error", err)
+	}
+	storage, err := GetStorageFromViper(outDir)
+	if err != nil {
+		log.Sugar().Panicw("bad storage config", "error", err)
+	}
+	if storage == nil {
+		log.Sugar().Panicw("storage layout is not cas. nothing to collect")
+	}
+	dryRun, _ := cmd.Flags().GetBool(DryRunFlagName)
+	result, err := storage.GC(dryRun)
+	if err != nil {
+		log.Sugar().Panicw("failed to collect objects", "error", err)
+	}
+	for _, n := range result.StaleRefs {
+		fmt.Printf("stale\t%s\n", n)
+	}
+	for _, sum := range result.Removed {
+		fmt.Printf("removed\t%s\n", sum)
+	}
+	fmt.Printf("%d stale names, %d objects, %d bytes freed\n", len(result.StaleRefs), len(result.Removed), result.Freed)
+}
+
+var gcCmd = cobra.Command{
+	Use:   "gc",
+	Short: "drop the names removed from the output directory, and the objects nothing refers to, in the cas layout",
+	Args:  cobra.NoArgs,
+	Run:   gcRun,
+}
+
+func init() {
+	gcCmd.Flags().Bool(DryRunFlagName, false, "only report what would be removed")
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/history"
+	"github.com/spf13/cobra"
+)
+
+const (
+	StatusFlagName = "status"
+	SinceFlagName  = "since"
+	LatestFlagName = "latest"
+	FormatFlagName = "format"
+)
+
+// openHistory opens the history for the history commands
+func openHistory() *history.Store {
+	outDir, err := GetOutDirFromViper()
+	if err != nil {
+		log.Sugar().Panicw("bad output directory", "error", err)
+	}
+	c, err := GetHistoryConfigFromViper(outDir)
+	if err != nil {
+		log.Sugar().Panicw("bad history config", "error", err)
+	}
+	downloads, err := history.Open(c)
+	if err != nil {
+		log.Sugar().Panicw("failed to load history", "error", err)
+	}
+	if downloads == nil {
+		log.Sugar().Panicw("history is disabled")
+	}
+	return downloads
+}
+
+// historyQuery builds the query from the flags
+func historyQuery(cmd *cobra.Command, args []string) history.Query {
+	var q history.Query
+	if len(args) > 0 {
+		q.Pattern = args[0]
+	}
+	status, _ := cmd.Flags().GetString(StatusFlagName)
+	q.Status = entity.JobStatus(status)
+	if since, _ := cmd.Flags().GetDuration(SinceFlagName); since > 0 {
+		q.Since = time.Now().Add(-since)
+	}
+	q.Latest, _ = cmd.Flags().GetBool(LatestFlagName)
+	return q
+}
+
+func historySearchRun(cmd *cobra.Command, args []string) {
+	for _, e := range openHistory().Search(historyQuery(cmd, args)) {
+		fmt.Printf("%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Status, e.Url, e.Path)
+	}
+}
+
+var historyCsvHeader = []string{"time", "status", "url", "path", "sha256", "size", "error", "owner", "job_id"}
+
+func historyExportRun(cmd *cobra.Command, args []string) {
+	entries := openHistory().Search(historyQuery(cmd, args))
+	format, _ := cmd.Flags().GetString(FormatFlagName)
+	switch format {
+	case "ndjson":
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				log.Sugar().Panicw("failed to export history", "error", err)
+			}
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		_ = w.Write(historyCsvHeader)
+		for _, e := range entries {
+			_ = w.Write([]string{e.Time.Format(time.RFC3339), string(e.Status), e.Url, e.Path, e.SHA256,
+				strconv.FormatInt(e.Size, 10), e.Error, e.Owner, e.JobID})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Sugar().Panicw("failed to export history", "error", err)
+		}
+	default:
+		log.Sugar().Panicw("bad export format. expect ndjson or csv", "format", format)
+	}
+}
+
+var historyCmd = cobra.Command{
+	Use:   "history",
+	Short: "search or export the history of the downloads",
+}
+
+var historySearchCmd = cobra.Command{
+	Use:   "search [pattern]",
+	Short: "list the downloads whose url or path contains the pattern, the oldest first",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   historySearchRun,
+}
+
+var historyExportCmd = cobra.Command{
+	Use:   "export [pattern]",
+	Short: "write the downloads to stdout as NDJSON or CSV",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   historyExportRun,
+}
+
+func init() {
+	for _, c := range []*cobra.Command{&historySearchCmd, &historyExportCmd} {
+		c.Flags().String(StatusFlagName, "", "only the downloads of the status, done or failed")
+		c.Flags().Duration(SinceFlagName, 0, "only the downloads within the duration, like 24h")
+		c.Flags().Bool(LatestFlagName, false, "only the latest download of each url")
+	}
+	historyExportCmd.Flags().String(FormatFlagName, "ndjson", "ndjson or csv")
+	historyCmd.AddCommand(&historySearchCmd, &historyExportCmd)
+}
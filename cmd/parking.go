@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+)
+
+type parked struct {
+	reqResp entity.ReqResp
+	timer   *time.Timer
+}
+
+// parking holds the requests that would be put back to the queue later
+// (host paused or at its concurrency limit), so that they are not lost on shutdown
+type parking struct {
+	mu     sync.Mutex
+	push   func(reqResp entity.ReqResp)
+	next   uint64
+	timers map[uint64]parked
+	kept   []entity.ReqResp
+	// held until released, like the ones whose host is paused
+	held    []entity.ReqResp
+	closed  bool
+	sending sync.WaitGroup
+}
+
+func newParking(push func(reqResp entity.ReqResp)) *parking {
+	return &parking{push: push, timers: make(map[uint64]parked)}
+}
+
+// park pushes the request back after d
+func (p *parking) park(reqResp entity.ReqResp, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.kept = append(p.kept, reqResp)
+		return
+	}
+	id := p.next
+	p.next++
+	p.timers[id] = parked{reqResp: reqResp, timer: time.AfterFunc(d, func() {
+		p.fire(id)
+	})}
+}
+
+// keep holds the request until close, like the ones interrupted by shutdown
+func (p *parking) keep(reqResp entity.ReqResp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.kept = append(p.kept, reqResp)
+}
+
+// hold holds the request until it's released. See also parking.release
+func (p *parking) hold(reqResp entity.ReqResp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.kept = append(p.kept, reqResp)
+		return
+	}
+	p.held = append(p.held, reqResp)
+}
+
+// release pushes back the held requests that f returns true
+func (p *parking) release(f func(reqResp entity.ReqResp) bool) {
+	p.mu.Lock()
+	var released []entity.ReqResp
+	held := p.held[:0]
+	for _, reqResp := range p.held {
+		if f(reqResp) {
+			released = append(released, reqResp)
+		} else {
+			held = append(held, reqResp)
+		}
+	}
+	p.held = held
+	p.mu.Unlock()
+	for _, reqResp := range released {
+		p.park(reqResp, 0)
+	}
+}
+
+func (p *parking) fire(id uint64) {
+	p.mu.Lock()
+	e, ok := p.timers[id]
+	if !ok || p.closed {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.timers, id)
+	p.sending.Add(1)
+	p.mu.Unlock()
+	defer p.sending.Done()
+	p.push(e.reqResp)
+}
+
+// close stops the timers and returns the requests still held. The ones
+// being pushed back are not included. See also parking.wait
+//
+// The requests parked after close are held as well, and returned by the next close.
+func (p *parking) close() []entity.ReqResp {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	res := append(p.kept, p.held...)
+	p.kept = nil
+	p.held = nil
+	for id, e := range p.timers {
+		e.timer.Stop()
+		res = append(res, e.reqResp)
+		delete(p.timers, id)
+	}
+	return res
+}
+
+// wait waits for the requests being pushed back
+func (p *parking) wait() {
+	p.sending.Wait()
+}
@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/adaptive"
+	"github.com/crosstyan/dumb_downloader/breaker"
+	"github.com/crosstyan/dumb_downloader/cas"
+	"github.com/crosstyan/dumb_downloader/classify"
+	"github.com/crosstyan/dumb_downloader/digest"
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/history"
+	"github.com/crosstyan/dumb_downloader/imageinfo"
+	"github.com/crosstyan/dumb_downloader/metadata"
+	"github.com/crosstyan/dumb_downloader/metrics"
+	"github.com/crosstyan/dumb_downloader/phash"
+	"github.com/crosstyan/dumb_downloader/utils"
+	"github.com/imroc/req/v3"
+	"github.com/joomcode/errorx"
+)
+
+// errBadResponse is returned when the response should be saved but is not an image
+var errBadResponse = errors.New("bad response")
+
+// pipeline handles the responses the same way for `serve` and `from`:
+// classify, breaker, adaptive concurrency, digest, validation, perceptual
+// hashes, storage, history and metadata, in that order.
+type pipeline struct {
+	classifier *classify.Classifier
+	breaker    *breaker.Breaker
+	// nil if adaptive concurrency is disabled
+	concurrency *adaptive.Limiter
+	// digests computed besides SHA-256
+	digests  []string
+	metadata *metadata.Writer
+	// nil if the files are saved as they are
+	storage *cas.Store
+	// nil if the history is disabled
+	history       *history.Store
+	skipCompleted bool
+	phash         phash.Config
+	validation    imageinfo.Config
+}
+
+// newPipelineFromViper creates the pipeline saving to outDir, with at most
+// poolSize requests to a host at once
+func newPipelineFromViper(outDir string, poolSize int) (*pipeline, error) {
+	classifier, err := GetClassifierFromViper()
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to create classifier")
+	}
+	metadataConfig, err := GetMetadataConfigFromViper()
+	if err != nil {
+		return nil, errorx.Decorate(err, "bad metadata config")
+	}
+	metadataWriter, err := metadata.New(metadataConfig.Mode)
+	if err != nil {
+		return nil, errorx.Decorate(err, "bad metadata config")
+	}
+	storage, err := GetStorageFromViper(outDir)
+	if err != nil {
+		return nil, errorx.Decorate(err, "bad storage config")
+	}
+	historyConfig, err := GetHistoryConfigFromViper(outDir)
+	if err != nil {
+		return nil, errorx.Decorate(err, "bad history config")
+	}
+	downloads, err := history.Open(historyConfig)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to load history")
+	}
+	phashConfig, err := GetPhashConfigFromViper()
+	if err != nil {
+		return nil, errorx.Decorate(err, "bad phash config")
+	}
+	if phashConfig.NearDuplicate == phash.NearDuplicateFlag || phashConfig.NearDuplicate == phash.NearDuplicateSkip {
+		if downloads == nil || !phashConfig.Enabled {
+			log.Sugar().Warnw("near duplicates are not checked without the history and phash enabled")
+		}
+	}
+	validationConfig, err := GetValidationConfigFromViper()
+	if err != nil {
+		return nil, errorx.Decorate(err, "bad validation config")
+	}
+	return &pipeline{
+		classifier:    classifier,
+		breaker:       breaker.New(GetBreakerConfigFromViper()),
+		concurrency:   adaptive.New(GetAdaptiveConfigFromViper(), poolSize),
+		digests:       metadataConfig.Digests,
+		metadata:      metadataWriter,
+		storage:       storage,
+		history:       downloads,
+		skipCompleted: historyConfig.SkipCompleted,
+		phash:         phashConfig,
+		validation:    validationConfig,
+	}, nil
+}
+
+// fetched is a response to be handled by the pipeline
+type fetched struct {
+	url     string
+	method  string
+	resp    *req.Response
+	latency time.Duration
+	hasher  *digest.Hasher
+	// checked if not empty
+	expectedDigest string
+	// check the image. Always done if it's saved
+	validate bool
+	// where the body is saved. empty if it's not saved
+	out string
+	// the url, owner and job recorded to the history with the outcome
+	entry entity.HistoryEntry
+	// called once the response has passed the checks, before it's saved. Optional
+	checked func(o outcome)
+	// checked once the file is saved. the file is removed if true. Optional
+	cancelled func() bool
+}
+
+// outcome is what the pipeline has done with the response
+type outcome struct {
+	class classify.Class
+	info  imageinfo.Info
+	// recorded to the history once saved or skipped
+	entry entity.HistoryEntry
+	// a near duplicate has been saved, so this one is not
+	skipped bool
+	// cancelled while saving. nothing is left
+	cancelled bool
+}
+
+// recordHistory adds the entry to the history
+func (p *pipeline) recordHistory(e entity.HistoryEntry) {
+	if err := p.history.Record(e); err != nil {
+		log.Sugar().Warnw("failed to record history", "url", e.Url, "error", err)
+	}
+}
+
+// process reports the response to the breaker and the concurrency limiter of
+// its host, checks it, and saves it if f.out is set. The failures are left to
+// the caller to record, since some of them are retried.
+func (p *pipeline) process(f fetched) (outcome, error) {
+	var o outcome
+	host := hostOf(f.url)
+	resp := f.resp
+	o.class = p.classifier.Classify(&classify.Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Url:        finalUrl(resp, f.url),
+		Body:       resp.Bytes(),
+	})
+	metrics.ObserveResponse(host, resp.StatusCode, string(o.class), len(resp.Bytes()), f.latency)
+	retryAfter, _ := utils.ParseRetryAfter(resp.Header.Get("Retry-After"))
+	result := breakerResult(resp.StatusCode, o.class)
+	p.breaker.Report(host, result, retryAfter)
+	p.concurrency.Release(host, f.latency, result == breaker.Failure || resp.StatusCode == http.StatusServiceUnavailable)
+	if f.expectedDigest != "" {
+		if err := f.hasher.Verify(f.expectedDigest); err != nil {
+			return o, err
+		}
+	}
+	// TODO: custom content type. For now only images are saved
+	image := o.class == classify.OK && strings.Contains(resp.Header.Get("Content-Type"), "image")
+	// like invalidImage. a HEAD or a partial (206) response has no whole image to check
+	if image && (f.validate || f.out != "") && f.method == http.MethodGet && resp.StatusCode == http.StatusOK {
+		info, err := imageinfo.Validate(resp.Header, resp.Bytes(), p.validation.Mode)
+		if err != nil {
+			metrics.InvalidImages.WithLabelValues(host).Inc()
+			return o, err
+		}
+		o.info = info
+	}
+	if f.checked != nil {
+		f.checked(o)
+	}
+	if f.out == "" {
+		return o, nil
+	}
+	if !image {
+		return o, errBadResponse
+	}
+	e := imageHashes(p.phash, p.history, f.out, resp.Bytes())
+	e.Url, e.Owner, e.JobID = f.entry.Url, f.entry.Owner, f.entry.JobID
+	e.SHA256, e.Size = f.hasher.Sums()[digest.SHA256], f.hasher.Size()
+	if e.NearDuplicateOf != "" && p.phash.NearDuplicate == phash.NearDuplicateSkip {
+		log.Sugar().Infow("near duplicate. skip.", "url", f.url, "output", f.out, "near_duplicate_of", e.NearDuplicateOf)
+		e.Status, e.Path = entity.JobDone, e.NearDuplicateOf
+		p.recordHistory(e)
+		o.entry, o.skipped = e, true
+		return o, nil
+	}
+	// never leave a half-written file
+	if err := p.storage.Save(f.out, resp.Bytes(), e.SHA256); err != nil {
+		return o, err
+	}
+	m := fileMetadata(f.out, f.url, resp, f.hasher)
+	m.JobID = f.entry.JobID
+	m.Format, m.Width, m.Height = o.info.Format, o.info.Width, o.info.Height
+	if err := p.metadata.Write(m); err != nil {
+		log.Sugar().Warnw("failed to write metadata", "url", f.url, "output", f.out, "error", err)
+	}
+	if f.cancelled != nil && f.cancelled() {
+		log.Sugar().Infow("download cancelled", "url", f.url, "job", f.entry.JobID, "output", f.out)
+		_ = p.storage.Remove(f.out)
+		p.metadata.Remove(f.out)
+		o.cancelled = true
+		return o, nil
+	}
+	log.Sugar().Infow("downloaded", "url", f.url, "output", f.out, "classification", o.class)
+	if e.NearDuplicateOf != "" {
+		log.Sugar().Infow("near duplicate", "url", f.url, "output", f.out, "near_duplicate_of", e.NearDuplicateOf)
+	}
+	e.Status, e.Path = entity.JobDone, f.out
+	p.recordHistory(e)
+	o.entry = e
+	return o, nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/crosstyan/dumb_downloader/adaptive"
+	"github.com/crosstyan/dumb_downloader/breaker"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/proxy"
+	"github.com/crosstyan/dumb_downloader/throttle"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func proxyRun(cmd *cobra.Command, args []string) {
+	listenAddr := viper.GetString("proxy.listen")
+	if listenAddr == "" {
+		log.Sugar().Panicw("no listen address")
+	}
+	certPath := viper.GetString("proxy.ca_cert")
+	keyPath := viper.GetString("proxy.ca_key")
+	ca, created, err := proxy.LoadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		log.Sugar().Panicw("failed to load CA", "error", err, "ca_cert", certPath, "ca_key", keyPath)
+	}
+	if created {
+		log.Sugar().Warnw("generated a new CA. The client should trust it to use HTTPS", "ca_cert", certPath)
+	} else {
+		log.Sugar().Infow("use CA", "ca_cert", certPath)
+	}
+	throttleConfig, err := GetThrottleConfigFromViper()
+	if err != nil {
+		log.Sugar().Panicw("failed to get bandwidth caps", "error", err)
+	}
+	urlPolicy, err := GetPolicyFromViper()
+	if err != nil {
+		log.Sugar().Panicw("bad url policy", "error", err)
+	}
+	poolSize, err := GetPoolSizeFromViper()
+	if err != nil {
+		log.Sugar().Panicw("bad pool size", "pool_size", poolSize)
+	}
+	client := makeClient(throttle.NewLimiter(throttleConfig), urlPolicy)
+	breakers := breaker.New(GetBreakerConfigFromViper())
+	concurrency := adaptive.New(GetAdaptiveConfigFromViper(), poolSize)
+	log.Sugar().Infow("listen", "addr", listenAddr)
+	err = http.ListenAndServe(listenAddr, proxy.New(client, ca, urlPolicy, breakers, concurrency))
+	if err != nil {
+		log.Sugar().Panicw("listen", "err", err)
+	}
+}
+
+var proxyCmd = cobra.Command{
+	Use:   "proxy",
+	Short: "serve as an HTTP forward proxy that impersonates the browser fingerprint",
+	Args:  cobra.NoArgs,
+	Run:   proxyRun,
+}
@@ -11,10 +11,15 @@ import (
 )
 
 const (
-	ListenFlagName    = "listen"
-	HttpProxyFlagName = "http_proxy"
-	PoolSizeFlagName  = "pool_size"
-	OutputDirFlagName = "output_dir"
+	ListenFlagName          = "listen"
+	HttpProxyFlagName       = "http_proxy"
+	PoolSizeFlagName        = "pool_size"
+	OutputDirFlagName       = "output_dir"
+	BandwidthFlagName       = "bandwidth"
+	MaxRetriesFlagName      = "max_retries"
+	MetricsTextfileFlagName = "metrics_textfile"
+	CACertFlagName          = "ca_cert"
+	CAKeyFlagName           = "ca_key"
 )
 
 var root = cobra.Command{
@@ -25,7 +30,7 @@ var root = cobra.Command{
 var cfgFile string
 
 func Execute() error {
-	root.AddCommand(&serve, &from)
+	root.AddCommand(&serve, &from, &proxyCmd, &tokenCmd, &gcCmd, &historyCmd, &dupesCmd)
 	return root.Execute()
 }
 
@@ -65,11 +70,45 @@ func init() {
 		log.Sugar().Panicw("failed to bind flag", "flag", OutputDirFlagName, "error", err)
 	}
 
+	root.PersistentFlags().Int64(BandwidthFlagName, 0, "global bandwidth cap in bytes per second. 0 means unlimited")
+	err = viper.BindPFlag("throttle.global", root.PersistentFlags().Lookup(BandwidthFlagName))
+	if err != nil {
+		log.Sugar().Panicw("failed to bind flag", "flag", BandwidthFlagName, "error", err)
+	}
+
+	root.PersistentFlags().Int(MaxRetriesFlagName, DefaultMaxRetries, "max retries of a GET or HEAD request on transport errors, 5xx and broken images. 0 disables retries")
+	err = viper.BindPFlag(MaxRetriesFlagName, root.PersistentFlags().Lookup(MaxRetriesFlagName))
+	if err != nil {
+		log.Sugar().Panicw("failed to bind flag", "flag", MaxRetriesFlagName, "error", err)
+	}
+
+	from.Flags().String(MetricsTextfileFlagName, "", "write the metrics to this file when finished, for the textfile collector of node_exporter")
+	err = viper.BindPFlag(MetricsTextfileFlagName, from.Flags().Lookup(MetricsTextfileFlagName))
+	if err != nil {
+		log.Sugar().Panicw("failed to bind flag", "flag", MetricsTextfileFlagName, "error", err)
+	}
+
 	serve.PersistentFlags().StringP(ListenFlagName, "l", "127.0.0.1:8888", "listen address")
 	err = viper.BindPFlag(ListenFlagName, serve.PersistentFlags().Lookup(ListenFlagName))
 	if err != nil {
 		log.Sugar().Panicw("failed to bind flag", "flag", ListenFlagName, "error", err)
 	}
+
+	proxyCmd.PersistentFlags().StringP(ListenFlagName, "l", "127.0.0.1:8889", "listen address")
+	err = viper.BindPFlag("proxy.listen", proxyCmd.PersistentFlags().Lookup(ListenFlagName))
+	if err != nil {
+		log.Sugar().Panicw("failed to bind flag", "flag", ListenFlagName, "error", err)
+	}
+	proxyCmd.PersistentFlags().String(CACertFlagName, "dumbdl-ca.pem", "CA certificate used to intercept HTTPS. generated if not exists")
+	err = viper.BindPFlag("proxy.ca_cert", proxyCmd.PersistentFlags().Lookup(CACertFlagName))
+	if err != nil {
+		log.Sugar().Panicw("failed to bind flag", "flag", CACertFlagName, "error", err)
+	}
+	proxyCmd.PersistentFlags().String(CAKeyFlagName, "dumbdl-ca-key.pem", "private key of the CA certificate")
+	err = viper.BindPFlag("proxy.ca_key", proxyCmd.PersistentFlags().Lookup(CAKeyFlagName))
+	if err != nil {
+		log.Sugar().Panicw("failed to bind flag", "flag", CAKeyFlagName, "error", err)
+	}
 }
 
 func initConfig() {
@@ -2,23 +2,33 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"github.com/crosstyan/dumb_downloader/api"
+	"github.com/crosstyan/dumb_downloader/auth"
+	"github.com/crosstyan/dumb_downloader/dedup"
 	"github.com/crosstyan/dumb_downloader/entity"
 	"github.com/crosstyan/dumb_downloader/global/log"
-	"github.com/crosstyan/dumb_downloader/utils"
-	"github.com/imroc/req/v3"
+	"github.com/crosstyan/dumb_downloader/job"
+	"github.com/crosstyan/dumb_downloader/metrics"
+	"github.com/crosstyan/dumb_downloader/pause"
+	"github.com/crosstyan/dumb_downloader/queue"
+	"github.com/crosstyan/dumb_downloader/session"
+	"github.com/crosstyan/dumb_downloader/throttle"
+	"github.com/crosstyan/dumb_downloader/webhook"
 	"github.com/joomcode/errorx"
 	"github.com/panjf2000/ants/v2"
-	"github.com/samber/mo"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
-	"strings"
-	"time"
+	"sync"
+	"syscall"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	httpSwagger "github.com/swaggo/http-swagger/v2"
 	"moul.io/chizap"
 
@@ -26,8 +36,6 @@ import (
 	_ "github.com/crosstyan/dumb_downloader/docs"
 )
 
-const ChannelSize = 128
-
 func makeSubDirectory(baseOutDir string, sub string) (string, error) {
 	outDir := path.Join(baseOutDir, sub)
 	stat, err := os.Stat(outDir)
@@ -48,6 +56,10 @@ func makeSubDirectory(baseOutDir string, sub string) (string, error) {
 // @version 1.0
 // @license.name Do What the Fuck You Want to Public License
 // @license.url http://www.wtfpl.net/
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+// @description `Bearer <token>`. Only required if tokens are configured.
 func serveRun(cmd *cobra.Command, args []string) {
 	listenAddr, err := GetListenAddrFromViper()
 	if err != nil {
@@ -68,163 +80,180 @@ func serveRun(cmd *cobra.Command, args []string) {
 	// middleware
 	chiZapM := chizap.New(log.Logger(), &chizap.Opts{})
 	corsM := cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
+		AllowedOrigins:   GetCorsOriginsFromViper(),
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
-		AllowCredentials: true,
+		AllowCredentials: viper.GetBool("cors.allow_credentials"),
 	})
+	authn, err := GetAuthenticatorFromViper()
+	if err != nil {
+		log.Sugar().Panicw("failed to load tokens", "error", err)
+	}
+	if authn == nil {
+		log.Sugar().Warnw("no token configured. authentication is disabled")
+	}
+	need := func(scope auth.Scope) func(http.Handler) http.Handler {
+		return api.RequireScope(authn, scope)
+	}
 	swaggerH := httpSwagger.Handler(
 		// The url pointing to API definition
 		// this is a magic path...
 		httpSwagger.URL("/swagger/doc.json"),
 	)
-	ch := make(chan entity.ReqResp, ChannelSize)
-	ctx := context.Background()
+	q := queue.New(GetQueueConfigFromViper())
+	sigCtx, stopSignal := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignal()
+	// cancelled when the downloads in progress should be aborted
+	workCtx, abort := context.WithCancel(context.Background())
+	defer abort()
 	po, err := ants.NewPool(poolSize)
 	if err != nil {
 		log.Sugar().Panicw("failed to create pool", "error", err, "pool_size", poolSize)
 	}
 
-	client := req.C().ImpersonateChrome()
-	_, f, err := GetHttpProxyFromViper()
+	throttleConfig, err := GetThrottleConfigFromViper()
 	if err != nil {
-		log.Sugar().Infow("no http proxy", "error", err.Error())
-	} else {
-		client = client.SetProxy(f)
+		log.Sugar().Panicw("failed to get bandwidth caps", "error", err)
+	}
+	limiter := throttle.NewLimiter(throttleConfig)
+	urlPolicy, err := GetPolicyFromViper()
+	if err != nil {
+		log.Sugar().Panicw("bad url policy", "error", err)
+	}
+	if urlPolicy == nil {
+		log.Sugar().Warnw("url policy is disabled. the server could be used to reach internal addresses")
+	}
+	client := makeClient(limiter, urlPolicy)
+	pipe, err := newPipelineFromViper(baseOutDir, poolSize)
+	if err != nil {
+		log.Sugar().Panicw("failed to create pipeline", "error", err)
+	}
+	dedupConfig := GetDedupConfigFromViper()
+	retention := GetJobRetentionFromViper()
+	// the index should not refer to a job already forgotten, or the submission is made again
+	if retention > 0 && retention < dedupConfig.Window {
+		log.Sugar().Warnw("job_retention is shorter than the dedup window. extended to the window", "job_retention", retention, "window", dedupConfig.Window)
+		retention = dedupConfig.Window
+	}
+	jobs := job.NewStore(retention)
+	webhookConfig, err := GetWebhookConfigFromViper()
+	if err != nil {
+		log.Sugar().Panicw("bad webhook config", "error", err)
 	}
+	if webhookConfig.Secret == "" {
+		log.Sugar().Warnw("no webhook secret configured. callbacks are not signed")
+	}
+	notifier := webhook.New(webhookConfig, urlPolicy)
+	jobs.OnTerminal(notifier.Notify)
+	w := &worker{
+		pipeline:   pipe,
+		client:     client,
+		baseOutDir: baseOutDir,
+		jobs:       jobs,
+		parking:    newParking(q.Push),
+	}
+	w.gate = pause.New(func() {
+		q.Wake()
+		w.parking.release(func(reqResp entity.ReqResp) bool {
+			return w.gate.Check(hostOf(reqResp.Request.Url), reqResp.Request.OutPrefix) == nil
+		})
+	})
+	var workers sync.WaitGroup
 	for i := range make([]struct{}, poolSize) {
+		workers.Add(1)
 		err = po.Submit(func() {
-			tryDownload(ctx, ch, client, baseOutDir)
+			defer workers.Done()
+			w.tryDownload(workCtx, q)
 		})
 		if err != nil {
 			log.Sugar().Panicw("failed to submit task", "error", err, "iteration", i)
 		}
 	}
+	queueFile := GetQueueFileFromViper()
+	restoreQueue(queueFile, jobs, w.parking)
+	metrics.RegisterQueue(q.Len)
+	if pipe.concurrency != nil {
+		metrics.RegisterConcurrency(pipe.concurrency)
+	}
+	index := dedup.New(dedupConfig)
+	var flights *dedup.Group[entity.RespV]
+	if dedupConfig.ShareSync {
+		flights = dedup.NewGroup[entity.RespV]()
+	}
 	r.Use(chiZapM, corsM)
-	one := time.Second
 	// dumb swagger handler
 	r.Get("/swagger", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/swagger/", http.StatusMovedPermanently)
 	})
 	r.Get("/swagger/*", swaggerH)
-	r.Post("/download/sync", api.MakeSyncPushHandler(ch))
-	r.Post("/download", api.MakeAsyncPushHandler(ch, one))
-	err = http.ListenAndServe(listenAddr, r)
-	if err != nil {
-		log.Sugar().Panicw("listen", "err", err)
-	}
-}
-
-func tryDownload(ctx context.Context, reqChan <-chan entity.ReqResp, client *req.Client, baseOutDir string) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case reqResp := <-reqChan:
-			{
-				r := reqResp.Request
-				if r == nil {
-					log.Sugar().Errorw("nil request")
-					continue
-				}
-				R := client.R()
-				cookies := utils.Map(r.Cookies, func(c http.Cookie) *http.Cookie { return &c })
-				R.SetCookies(cookies...)
-				// don't break the impersonation
-				for k, v := range r.Headers {
-					R.SetHeader(k, v)
-				}
-				var resp *req.Response
-				var err error
-				// if it's async we could just use this goroutine to get the response
-				if !reqResp.IsSync {
-					resp, err = R.Get(r.Url)
-				} else {
-					// otherwise we have to poll the context
-					type ResponseV = *req.Response
-					c := make(chan mo.Result[ResponseV])
-					go func() {
-						resp, err := R.Get(r.Url)
-						if err != nil {
-							c <- mo.Err[ResponseV](err)
-							return
-						}
-						c <- mo.Ok[ResponseV](resp)
-					}()
-					select {
-					case <-ctx.Done():
-						log.Sugar().Warnw("request context cancelled", "url", r.Url)
-						continue
-					case result := <-c:
-						resp, err = result.Get()
-					}
-				}
-				reCh, chOk := reqResp.ResponseChannel.Get()
-				if err != nil {
-					if chOk && reqResp.IsSync {
-						reCh <- mo.Err[entity.RespV](err)
-					}
-					log.Sugar().Errorw("failed to download", "url", r.Url, "error", err)
-					utils.PrintHeadersCookies(R)
-					continue
-				}
-				if chOk && reqResp.IsSync {
-					dlR := entity.DownloadResponse{}
-					header := make(map[string]string)
-					dlR.Headers = header
-					if resp.Header != nil {
-						for k, v := range resp.Header {
-							vv := strings.Join(v, ",")
-							dlR.Headers[k] = vv
-						}
-					}
-					ct, ok := utils.TryGet(dlR.Headers, "Content-Type", "content-type", "Content-type", "content-Type", "Content-TYPE").Get()
-					if ok {
-						dlR.MIMEType = ct
-					}
-					dlR.StatusCode = resp.StatusCode
-					dlR.Url = r.Url
-					dlR.Body = resp.Bytes()
+	r.With(need(auth.ScopeSync)).Post("/download/sync", api.MakeSyncPushHandler(q, urlPolicy, flights))
+	r.With(need(auth.ScopeSync)).Post("/download/sync/batch", api.MakeSyncBatchHandler(q, urlPolicy, poolSize))
+	r.With(need(auth.ScopeSubmit)).Post("/download", api.MakeAsyncPushHandler(q, jobs, urlPolicy, index))
+	r.With(need(auth.ScopeSubmit)).Post("/download/batch", api.MakeBatchPushHandler(q, jobs, urlPolicy, index))
+	r.With(need(auth.ScopeSubmit)).Get("/jobs/{id}", api.MakeGetJobHandler(jobs))
+	r.With(need(auth.ScopeSubmit)).Get("/jobs/{id}/wait", api.MakeWaitJobHandler(jobs))
+	r.With(need(auth.ScopeSubmit)).Get("/batches/{id}", api.MakeGetBatchHandler(jobs))
+	r.With(need(auth.ScopeSubmit)).Get("/batches/{id}/wait", api.MakeWaitBatchHandler(jobs))
+	r.With(need(auth.ScopeSubmit)).Delete("/jobs/{id}", api.MakeCancelJobHandler(jobs))
+	r.With(need(auth.ScopeSubmit)).Get("/history", api.MakeHistoryHandler(pipe.history))
+	r.With(need(auth.ScopeSync)).Get("/fetch", api.MakeFetchHandler(session.NewStore(client, GetSessionConfigFromViper()), urlPolicy))
+	r.With(need(auth.ScopeReadFiles)).Get("/files/*", api.MakeFilesHandler(baseOutDir))
+	r.With(need(auth.ScopeAdmin)).Handle("/metrics", promhttp.Handler())
+	r.Route("/queue", func(r chi.Router) {
+		r.Use(need(auth.ScopeAdmin))
+		r.Get("/", api.MakeGetQueueHandler(w.gate, q))
+		r.Post("/pause", api.MakePauseHandler(w.gate))
+		r.Post("/resume", api.MakeResumeHandler(w.gate))
+	})
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(need(auth.ScopeAdmin))
+		r.Get("/throttle", api.MakeGetThrottleHandler(limiter))
+		r.Put("/throttle", api.MakePutThrottleHandler(limiter))
+		r.Get("/breakers", api.MakeGetBreakersHandler(pipe.breaker))
+		r.Get("/concurrency", api.MakeGetConcurrencyHandler(pipe.concurrency))
+	})
+	srv := &http.Server{Addr: listenAddr, Handler: r}
+	// the long-polls shouldn't hold the shutdown
+	srv.RegisterOnShutdown(jobs.StopWaiting)
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Sugar().Panicw("listen", "err", err)
+		}
+	}()
 
-					reCh <- mo.Ok[entity.RespV](&dlR)
-				}
-				if r.OutPrefix == nil {
-					log.Sugar().Infow("proxy", "url", r.Url)
-					continue
-				}
-				isGoodStatusCode := func() bool {
-					return resp.StatusCode >= 200 && resp.StatusCode < 300
-				}()
-				// only save image type
-				ct := resp.Header.Get("Content-Type")
-				// TODO: custom content type
-				if !strings.Contains(ct, "image") || !isGoodStatusCode {
-					log.Sugar().Errorw("bad response", "url", r.Url, "Content-Type", ct, "status", resp.StatusCode)
-					utils.PrintHeadersCookies(R)
-					log.Sugar().Debugw("response", "headers", resp.Header, "response", resp.String())
-					return
-				}
-				var out string
-				prefix := *r.OutPrefix
-				if prefix == "" {
-					out = baseOutDir
-				} else {
-					out, err = makeSubDirectory(baseOutDir, *r.OutPrefix)
-					if err != nil {
-						log.Sugar().Errorw("failed to create sub directory", "error", err, "url", r.Url, "prefix", prefix, "fallback", baseOutDir)
-						out = baseOutDir
-					}
-				}
-				err = os.WriteFile(out, resp.Bytes(), 0644)
-				if err != nil {
-					log.Sugar().Errorw("failed to save", "url", r.Url, "output", out, "error", err)
-					continue
-				} else {
-					log.Sugar().Infow("downloaded", "url", r.Url, "output", out)
-				}
-			}
+	<-sigCtx.Done()
+	// a second signal kills the process
+	stopSignal()
+	timeout := GetShutdownTimeoutFromViper()
+	log.Sugar().Infow("shutting down", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// no new connections. the handlers in progress are waited
+	srvDone := make(chan struct{})
+	go func() {
+		defer close(srvDone)
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Sugar().Warnw("failed to shutdown server gracefully", "error", err)
 		}
+	}()
+	// the workers stop taking new requests
+	q.Close()
+	// the sync callers in the queue are answered right away
+	left := drainQueue(q, w.parking)
+	if !waitTimeout(shutdownCtx, &workers) {
+		log.Sugar().Warnw("downloads in progress aborted", "timeout", timeout)
 	}
+	abort()
+	workers.Wait()
+	// the interrupted ones and the ones pushed meanwhile
+	left = append(left, drainQueue(q, w.parking)...)
+	persistQueue(queueFile, jobs, left)
+	// the callbacks not delivered in time are dead-lettered
+	notifier.Close(shutdownCtx)
+	<-srvDone
+	po.Release()
+	log.Sugar().Infow("bye")
 }
 
 var serve = cobra.Command{
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/crosstyan/dumb_downloader/api"
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/job"
+	"github.com/crosstyan/dumb_downloader/queue"
+	"github.com/samber/mo"
+)
+
+// waitTimeout waits for wg until ctx is done. Returns false if ctx is done first.
+func waitTimeout(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// drainQueue takes everything left in the queue and the parking. Should be
+// called after the queue is closed. The sync callers are answered with an error.
+// Could be called again to take the ones parked or pushed since the last call.
+func drainQueue(q *queue.Scheduler, p *parking) []entity.ReqResp {
+	left := p.close()
+	// the parked ones being pushed back
+	p.wait()
+	for {
+		reqResp, ok := q.TryPop()
+		if !ok {
+			return left
+		}
+		if reqResp.IsSync {
+			if reCh, ok := reqResp.ResponseChannel.Get(); ok {
+				reCh <- mo.Err[entity.RespV](api.ErrShuttingDown)
+			}
+			continue
+		}
+		left = append(left, reqResp)
+	}
+}
+
+// persistQueue saves the jobs of the requests to filename
+func persistQueue(filename string, jobs *job.Store, left []entity.ReqResp) {
+	saved := make([]entity.Job, 0, len(left))
+	for _, reqResp := range left {
+		j, ok := jobs.Get(reqResp.JobID)
+		if !ok {
+			log.Sugar().Warnw("request without job dropped", "url", reqResp.Request.Url)
+			continue
+		}
+		if j.Status == entity.JobCancelled {
+			continue
+		}
+		j.Status = entity.JobQueued
+		saved = append(saved, j)
+	}
+	if len(saved) == 0 {
+		return
+	}
+	if err := job.SaveQueue(filename, saved); err != nil {
+		log.Sugar().Errorw("failed to persist queue", "file", filename, "jobs", len(saved), "error", err)
+		return
+	}
+	log.Sugar().Infow("queue persisted", "file", filename, "jobs", len(saved))
+}
+
+// restoreQueue puts back the jobs persisted by the last shutdown. The file
+// is removed once loaded, since the jobs are in the queue again.
+func restoreQueue(filename string, jobs *job.Store, p *parking) {
+	saved, err := job.LoadQueue(filename)
+	if err != nil {
+		log.Sugar().Errorw("failed to load queue", "file", filename, "error", err)
+		return
+	}
+	if len(saved) == 0 {
+		return
+	}
+	if err = os.Remove(filename); err != nil {
+		log.Sugar().Warnw("failed to remove queue file", "file", filename, "error", err)
+	}
+	for _, j := range saved {
+		j = jobs.Restore(j)
+		p.park(entity.ReqResp{
+			Request:         j.Request,
+			ResponseChannel: mo.None[entity.ResponseChannelV](),
+			Context:         context.Background(),
+			JobID:           j.ID,
+			Owner:           j.Owner,
+		}, 0)
+	}
+	log.Sugar().Infow("queue restored", "file", filename, "jobs", len(saved))
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/crosstyan/dumb_downloader/auth"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/spf13/cobra"
+)
+
+func tokenRun(cmd *cobra.Command, args []string) {
+	var token string
+	if len(args) > 0 {
+		token = args[0]
+	} else {
+		t, err := auth.NewToken()
+		if err != nil {
+			log.Sugar().Panicw("failed to generate token", "error", err)
+		}
+		token = t
+		fmt.Printf("token = %s\n", token)
+	}
+	fmt.Printf("hash = %q\n", auth.Hash(token))
+}
+
+var tokenCmd = cobra.Command{
+	Use:   "token [token]",
+	Short: "generate a token, or hash the given one, for `auth.tokens` in config",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   tokenRun,
+}
@@ -1,10 +1,35 @@
 package cmd
 
 import (
+	"github.com/crosstyan/dumb_downloader/adaptive"
+	"github.com/crosstyan/dumb_downloader/auth"
+	"github.com/crosstyan/dumb_downloader/breaker"
+	"github.com/crosstyan/dumb_downloader/cas"
+	"github.com/crosstyan/dumb_downloader/classify"
+	"github.com/crosstyan/dumb_downloader/dedup"
+	"github.com/crosstyan/dumb_downloader/digest"
+	"github.com/crosstyan/dumb_downloader/entity"
 	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/history"
+	"github.com/crosstyan/dumb_downloader/imageinfo"
+	"github.com/crosstyan/dumb_downloader/metadata"
+	"github.com/crosstyan/dumb_downloader/metrics"
+	"github.com/crosstyan/dumb_downloader/phash"
+	"github.com/crosstyan/dumb_downloader/policy"
+	"github.com/crosstyan/dumb_downloader/queue"
+	"github.com/crosstyan/dumb_downloader/redirect"
+	"github.com/crosstyan/dumb_downloader/session"
+	"github.com/crosstyan/dumb_downloader/throttle"
+	"github.com/crosstyan/dumb_downloader/webhook"
+	"github.com/imroc/req/v3"
+	"github.com/spf13/cast"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/joomcode/errorx"
 	"github.com/spf13/viper"
@@ -59,3 +84,348 @@ func GetPoolSizeFromViper() (int, error) {
 	}
 	return poolSize, nil
 }
+
+func GetThrottleConfigFromViper() (throttle.Config, error) {
+	c := throttle.Config{
+		Global:  viper.GetInt64("throttle.global"),
+		PerHost: viper.GetInt64("throttle.per_host"),
+		Hosts:   make(map[string]int64),
+	}
+	for h, v := range viper.GetStringMap("throttle.hosts") {
+		i, err := cast.ToInt64E(v)
+		if err != nil {
+			return c, errorx.Decorate(err, "bad bandwidth cap for host %s", h)
+		}
+		c.Hosts[h] = i
+	}
+	return c, nil
+}
+
+func GetRedirectPolicyFromViper() (entity.RedirectPolicy, error) {
+	p := entity.RedirectPolicy{
+		MaxRedirects: viper.GetInt("redirect.max_redirects"),
+		SameHostOnly: viper.GetBool("redirect.same_host_only"),
+		NoFollow:     viper.GetBool("redirect.no_follow"),
+	}
+	if p.MaxRedirects < 0 {
+		return p, errorx.IllegalArgument.New("max redirects should not be negative")
+	}
+	return p, nil
+}
+
+func GetClassifierFromViper() (*classify.Classifier, error) {
+	var rules []classify.Rule
+	err := viper.UnmarshalKey("classify.rules", &rules)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to parse classification rules")
+	}
+	return classify.New(rules, !viper.GetBool("classify.no_default_rules"))
+}
+
+func GetBreakerConfigFromViper() breaker.Config {
+	c := breaker.DefaultConfig
+	if viper.IsSet("breaker.window") {
+		c.Window = viper.GetInt("breaker.window")
+	}
+	if viper.IsSet("breaker.min_requests") {
+		c.MinRequests = viper.GetInt("breaker.min_requests")
+	}
+	if viper.IsSet("breaker.error_ratio") {
+		c.ErrorRatio = viper.GetFloat64("breaker.error_ratio")
+	}
+	if viper.IsSet("breaker.cooldown") {
+		c.Cooldown = viper.GetDuration("breaker.cooldown")
+	}
+	if viper.IsSet("breaker.max_cooldown") {
+		c.MaxCooldown = viper.GetDuration("breaker.max_cooldown")
+	}
+	return c
+}
+
+func GetAdaptiveConfigFromViper() adaptive.Config {
+	c := adaptive.DefaultConfig
+	c.Enabled = viper.GetBool("adaptive.enabled")
+	if viper.IsSet("adaptive.initial") {
+		c.Initial = viper.GetInt("adaptive.initial")
+	}
+	if viper.IsSet("adaptive.min") {
+		c.Min = viper.GetInt("adaptive.min")
+	}
+	if viper.IsSet("adaptive.max") {
+		c.Max = viper.GetInt("adaptive.max")
+	}
+	if viper.IsSet("adaptive.spike_factor") {
+		c.SpikeFactor = viper.GetFloat64("adaptive.spike_factor")
+	}
+	return c
+}
+
+func GetAuthenticatorFromViper() (*auth.Authenticator, error) {
+	var tokens []auth.TokenConfig
+	err := viper.UnmarshalKey("auth.tokens", &tokens)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to parse tokens")
+	}
+	return auth.New(tokens)
+}
+
+func GetCorsOriginsFromViper() []string {
+	origins := viper.GetStringSlice("cors.allowed_origins")
+	if len(origins) == 0 {
+		return []string{"*"}
+	}
+	return origins
+}
+
+func GetPolicyFromViper() (*policy.Policy, error) {
+	c := policy.DefaultConfig
+	if viper.IsSet("policy") {
+		if err := viper.UnmarshalKey("policy", &c); err != nil {
+			return nil, errorx.Decorate(err, "failed to parse url policy")
+		}
+	}
+	return policy.New(c)
+}
+
+// GetStorageFromViper returns the store of the output directory, or nil if
+// the files are saved as they are
+func GetStorageFromViper(outDir string) (*cas.Store, error) {
+	c := cas.DefaultConfig
+	if viper.IsSet("storage") {
+		if err := viper.UnmarshalKey("storage", &c); err != nil {
+			return nil, errorx.Decorate(err, "failed to parse storage config")
+		}
+	}
+	return cas.New(c, outDir)
+}
+
+// GetHistoryConfigFromViper returns the history config, whose relative file
+// is in the output directory
+func GetHistoryConfigFromViper(outDir string) (history.Config, error) {
+	c := history.DefaultConfig
+	if viper.IsSet("history") {
+		if err := viper.UnmarshalKey("history", &c); err != nil {
+			return c, errorx.Decorate(err, "failed to parse history config")
+		}
+	}
+	if c.MaxPerUrl < 0 {
+		return c, errorx.IllegalArgument.New("history max_per_url should not be negative")
+	}
+	if c.File != "" && !filepath.IsAbs(c.File) {
+		c.File = filepath.Join(outDir, c.File)
+	}
+	return c, nil
+}
+
+func GetPhashConfigFromViper() (phash.Config, error) {
+	c := phash.DefaultConfig
+	if viper.IsSet("phash") {
+		if err := viper.UnmarshalKey("phash", &c); err != nil {
+			return c, errorx.Decorate(err, "failed to parse phash config")
+		}
+	}
+	return c, c.Check()
+}
+
+func GetValidationConfigFromViper() (imageinfo.Config, error) {
+	c := imageinfo.DefaultConfig
+	if viper.IsSet("validation") {
+		if err := viper.UnmarshalKey("validation", &c); err != nil {
+			return c, errorx.Decorate(err, "failed to parse validation config")
+		}
+	}
+	return c, c.Check()
+}
+
+func GetQueueConfigFromViper() queue.Config {
+	c := queue.DefaultConfig
+	if viper.IsSet("queue.fair_by") {
+		c.FairBy = viper.GetString("queue.fair_by")
+	}
+	if viper.IsSet("queue.capacity") {
+		c.Capacity = viper.GetInt("queue.capacity")
+	}
+	c.Weights = make(map[string]float64)
+	for k, v := range viper.GetStringMap("queue.weights") {
+		w, err := cast.ToFloat64E(v)
+		if err != nil {
+			log.Sugar().Warnw("bad queue weight", "key", k, "weight", v)
+			continue
+		}
+		c.Weights[k] = w
+	}
+	return c
+}
+
+func GetSessionConfigFromViper() session.Config {
+	c := session.DefaultConfig
+	if viper.IsSet("session.max") {
+		c.Max = viper.GetInt("session.max")
+	}
+	if viper.IsSet("session.idle_timeout") {
+		c.IdleTimeout = viper.GetDuration("session.idle_timeout")
+	}
+	return c
+}
+
+func GetDedupConfigFromViper() dedup.Config {
+	c := dedup.DefaultConfig
+	if viper.IsSet("dedup.window") {
+		c.Window = viper.GetDuration("dedup.window")
+	}
+	if viper.IsSet("dedup.by_url") {
+		c.ByUrl = viper.GetBool("dedup.by_url")
+	}
+	if viper.IsSet("dedup.share_sync") {
+		c.ShareSync = viper.GetBool("dedup.share_sync")
+	}
+	return c
+}
+
+func GetWebhookConfigFromViper() (webhook.Config, error) {
+	c := webhook.DefaultConfig
+	if viper.IsSet("webhook") {
+		if err := viper.UnmarshalKey("webhook", &c); err != nil {
+			return c, errorx.Decorate(err, "failed to parse webhook config")
+		}
+	}
+	if c.DefaultUrl != "" {
+		u, err := url.Parse(c.DefaultUrl)
+		if err != nil || !u.IsAbs() {
+			return c, errorx.IllegalArgument.New("bad default callback url %s", c.DefaultUrl)
+		}
+	}
+	return c, nil
+}
+
+func GetMetadataConfigFromViper() (metadata.Config, error) {
+	c := metadata.DefaultConfig
+	if viper.IsSet("metadata.mode") {
+		c.Mode = viper.GetString("metadata.mode")
+	}
+	c.Digests = viper.GetStringSlice("metadata.digests")
+	for i, d := range c.Digests {
+		c.Digests[i] = strings.ToLower(d)
+		if err := digest.Check(c.Digests[i]); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// DefaultShutdownTimeout is how long the downloads in progress could take on shutdown
+const DefaultShutdownTimeout = 30 * time.Second
+
+// DefaultJobRetention is how long the finished jobs and batches could be looked up
+const DefaultJobRetention = 24 * time.Hour
+
+// DefaultQueueFile is where the queue is persisted on shutdown
+const DefaultQueueFile = "dumbdl-queue.json"
+
+func GetShutdownTimeoutFromViper() time.Duration {
+	if !viper.IsSet("shutdown_timeout") {
+		return DefaultShutdownTimeout
+	}
+	return viper.GetDuration("shutdown_timeout")
+}
+
+func GetJobRetentionFromViper() time.Duration {
+	if !viper.IsSet("job_retention") {
+		return DefaultJobRetention
+	}
+	return viper.GetDuration("job_retention")
+}
+
+func GetQueueFileFromViper() string {
+	if f := viper.GetString("queue_file"); f != "" {
+		return f
+	}
+	return DefaultQueueFile
+}
+
+// DefaultMaxRetries is how many times a request is retried by the client
+const DefaultMaxRetries = 2
+
+// ImpersonationProfile is the browser the client of makeClient impersonates
+const ImpersonationProfile = "chrome"
+
+// makeClient creates the impersonated client with the proxy, the redirect policy
+// and the bandwidth limiter applied. The url policy is optional.
+func makeClient(limiter *throttle.Limiter, urlPolicy *policy.Policy) *req.Client {
+	// https://req.cool/zh/docs/tutorial/http-fingerprint/
+	// https://req.cool/zh/docs/tutorial/tls-fingerprint/
+	// [ImpersonateChrome] would also set TLS fingerprint
+	// https://req.cool/zh/docs/tutorial/proxy/
+	client := req.C().ImpersonateChrome()
+	u, f, err := GetHttpProxyFromViper()
+	if err != nil {
+		log.Sugar().Infow("no http proxy", "error", err.Error())
+	} else {
+		client = client.SetProxy(f)
+		// the proxy itself is trusted. The target is still checked by url.
+		urlPolicy.Exempt(proxyAddr(u))
+	}
+	redirectPolicy, err := GetRedirectPolicyFromViper()
+	if err != nil {
+		log.Sugar().Panicw("bad redirect policy", "error", err)
+	}
+	client.SetRedirectPolicy(redirect.Policy(redirectPolicy))
+	if n := viper.GetInt(MaxRetriesFlagName); n > 0 {
+		client.SetCommonRetryCount(n).
+			SetCommonRetryBackoffInterval(time.Second, 10*time.Second).
+			SetCommonRetryCondition(func(resp *req.Response, err error) bool {
+				// the body might be a stream which could not be sent twice
+				if m := resp.Request.Method; m != http.MethodGet && m != http.MethodHead {
+					return false
+				}
+				// a broken image might be complete next time
+				return err != nil || resp.StatusCode >= 500 || invalidImage(resp)
+			}).
+			AddCommonRetryHook(func(resp *req.Response, err error) {
+				if u := resp.Request.URL; u != nil {
+					metrics.Retries.WithLabelValues(u.Hostname()).Inc()
+				}
+			})
+	}
+	if limiter != nil {
+		limiter.WrapClient(client)
+	}
+	digest.WrapClient(client)
+	urlPolicy.WrapClient(client)
+	return client
+}
+
+// invalidImage returns true if the response is a broken image. Only the
+// requests marked by imageinfo.WithMode are checked, whose body has been read.
+func invalidImage(resp *req.Response) bool {
+	if resp.Response == nil || resp.StatusCode != http.StatusOK || resp.Request.Method != http.MethodGet ||
+		!strings.Contains(resp.Header.Get("Content-Type"), "image") {
+		return false
+	}
+	mode := imageinfo.ModeOf(resp.Request.Context())
+	if mode == imageinfo.ModeNone {
+		return false
+	}
+	_, err := imageinfo.Validate(resp.Header, resp.Bytes(), mode)
+	if err != nil {
+		log.Sugar().Warnw("invalid image", "url", resp.Request.URL.String(), "error", err)
+		metrics.InvalidImages.WithLabelValues(resp.Request.URL.Hostname()).Inc()
+		return true
+	}
+	return false
+}
+
+// proxyAddr is the host:port of the proxy url, with the default port of the scheme
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	switch u.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,493 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/breaker"
+	"github.com/crosstyan/dumb_downloader/classify"
+	"github.com/crosstyan/dumb_downloader/digest"
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/history"
+	"github.com/crosstyan/dumb_downloader/imageinfo"
+	"github.com/crosstyan/dumb_downloader/job"
+	"github.com/crosstyan/dumb_downloader/metadata"
+	"github.com/crosstyan/dumb_downloader/metrics"
+	"github.com/crosstyan/dumb_downloader/pause"
+	"github.com/crosstyan/dumb_downloader/phash"
+	"github.com/crosstyan/dumb_downloader/queue"
+	"github.com/crosstyan/dumb_downloader/redirect"
+	"github.com/crosstyan/dumb_downloader/throttle"
+	"github.com/crosstyan/dumb_downloader/utils"
+	"github.com/imroc/req/v3"
+	"github.com/samber/mo"
+)
+
+// concurrencyRetryDelay is how long an async request waits before being put back
+// when its host is at the concurrency limit
+const concurrencyRetryDelay = 500 * time.Millisecond
+
+// worker is shared by the goroutines in the pool consuming the queue
+type worker struct {
+	*pipeline
+	client     *req.Client
+	baseOutDir string
+	jobs       *job.Store
+	// holds the requests put back to the queue later
+	parking *parking
+	gate    *pause.Gate
+}
+
+// newRequest creates the request with the cookies, headers and body of r.
+// The returned recorder collects the redirects that would be followed, and the
+// hasher computes the digests of the body, including the expected one of r.
+func newRequest(ctx context.Context, client *req.Client, r *entity.DownloadRequest, digests []string) (*req.Request, *redirect.Recorder, *digest.Hasher, error) {
+	R := client.R()
+	cookies := utils.Map(r.Cookies, func(c http.Cookie) *http.Cookie { return &c })
+	R.SetCookies(cookies...)
+	// don't break the impersonation
+	for k, v := range r.Headers {
+		R.SetHeader(k, v)
+	}
+	if r.RateLimit > 0 {
+		ctx = throttle.WithRequestLimit(ctx, r.RateLimit)
+	}
+	if r.Redirect != nil {
+		ctx = redirect.WithPolicy(ctx, *r.Redirect)
+	}
+	ctx, recorder := redirect.WithRecorder(ctx)
+	if r.ExpectedDigest != "" {
+		if algorithm, _, err := digest.Parse(r.ExpectedDigest); err == nil {
+			digests = append(digests, algorithm)
+		}
+	}
+	ctx, hasher := digest.WithHasher(ctx, digests...)
+	R.SetContext(ctx)
+	body, err := r.RawBody()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch {
+	case body != nil:
+		R.SetBodyBytes(body)
+	case r.HasJSON():
+		R.SetBodyJsonBytes(r.JSON)
+	case r.Form != nil:
+		R.SetFormData(r.Form)
+	}
+	return R, recorder, hasher, nil
+}
+
+// fileMetadata describes the file saved from the response
+func fileMetadata(out string, rawUrl string, resp *req.Response, hasher *digest.Hasher) entity.FileMetadata {
+	sums := hasher.Sums()
+	m := entity.FileMetadata{
+		Path:          out,
+		Url:           rawUrl,
+		FinalUrl:      finalUrl(resp, rawUrl),
+		StatusCode:    resp.StatusCode,
+		Headers:       make(map[string]string),
+		Size:          hasher.Size(),
+		SHA256:        sums[digest.SHA256],
+		Digests:       otherDigests(sums),
+		FetchedAt:     time.Now(),
+		Impersonation: ImpersonationProfile,
+	}
+	for _, k := range metadata.HeadersOfInterest {
+		if v := resp.Header.Get(k); v != "" {
+			m.Headers[k] = v
+		}
+	}
+	return m
+}
+
+// imageHashes computes the perceptual hashes of the image to be saved as out.
+// NearDuplicateOf is the existing image of the same directory that looks the
+// same, if near duplicates are checked.
+func imageHashes(config phash.Config, downloads *history.Store, out string, data []byte) entity.HistoryEntry {
+	var e entity.HistoryEntry
+	if !config.Enabled {
+		return e
+	}
+	h, err := phash.Compute(data, config.MaxPixels)
+	if err != nil {
+		log.Sugar().Debugw("failed to hash image", "output", out, "error", err)
+		return e
+	}
+	e.AHash, e.DHash = phash.Format(h.AHash), phash.Format(h.DHash)
+	if config.NearDuplicate == "" || config.NearDuplicate == phash.NearDuplicateNone {
+		return e
+	}
+	if near, ok := downloads.Similar(out, h, config.MaxDistance); ok {
+		e.NearDuplicateOf = near.Path
+	}
+	return e
+}
+
+// otherDigests are the digests other than SHA-256. nil if there's none
+func otherDigests(sums map[string]string) map[string]string {
+	var others map[string]string
+	for k, v := range sums {
+		if k == digest.SHA256 {
+			continue
+		}
+		if others == nil {
+			others = make(map[string]string)
+		}
+		others[k] = v
+	}
+	return others
+}
+
+// outputName is the file name derived from the last part of the url path
+func outputName(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "index"
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return "index"
+	}
+	return name
+}
+
+func hostOf(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// breakerResult tells if the response is a sign of being banned
+func breakerResult(statusCode int, class classify.Class) breaker.Result {
+	switch class {
+	case classify.Challenge, classify.Captcha, classify.RateLimited:
+		return breaker.Failure
+	}
+	if statusCode == http.StatusForbidden || statusCode == http.StatusTooManyRequests {
+		return breaker.Failure
+	}
+	return breaker.Success
+}
+
+func finalUrl(resp *req.Response, fallback string) string {
+	if resp.Response != nil && resp.Response.Request != nil {
+		return resp.Response.Request.URL.String()
+	}
+	return fallback
+}
+
+// tryDownload consumes the queue until it's closed. The downloads in
+// progress are aborted when ctx is done.
+func (w *worker) tryDownload(ctx context.Context, q *queue.Scheduler) {
+	for {
+		reqResp, ok := q.Pop(w.gate.Paused)
+		if !ok {
+			return
+		}
+		w.handle(ctx, reqResp)
+	}
+}
+
+func (w *worker) updateJob(reqResp entity.ReqResp, f func(j *entity.Job)) {
+	if reqResp.JobID == "" {
+		return
+	}
+	w.jobs.Update(reqResp.JobID, f)
+}
+
+func (w *worker) fail(reqResp entity.ReqResp, err error) {
+	w.updateJob(reqResp, func(j *entity.Job) {
+		j.Status = entity.JobFailed
+		j.Error = err.Error()
+	})
+	w.record(reqResp, entity.HistoryEntry{Status: entity.JobFailed, Error: err.Error()})
+}
+
+// record adds the outcome of the request to the history if it's a download
+func (w *worker) record(reqResp entity.ReqResp, e entity.HistoryEntry) {
+	r := reqResp.Request
+	if r.OutPrefix == nil {
+		return
+	}
+	e.Url = r.Url
+	e.Owner = reqResp.Owner
+	e.JobID = reqResp.JobID
+	w.recordHistory(e)
+}
+
+// skipCompletedJob finishes the async job without fetching if its url has been
+// downloaded before
+func (w *worker) skipCompletedJob(reqResp entity.ReqResp) bool {
+	r := reqResp.Request
+	if !w.skipCompleted || reqResp.IsSync || r.OutPrefix == nil {
+		return false
+	}
+	e, ok := w.history.Completed(r.Url)
+	if !ok {
+		return false
+	}
+	if r.ExpectedDigest != "" && !strings.EqualFold(r.ExpectedDigest, digest.SHA256+":"+e.SHA256) {
+		return false
+	}
+	log.Sugar().Infow("downloaded before. skip.", "url", r.Url, "job", reqResp.JobID, "output", e.Path, "at", e.Time)
+	w.updateJob(reqResp, func(j *entity.Job) {
+		j.Status = entity.JobDone
+		j.Output = e.Path
+		j.Size = e.Size
+		j.SHA256 = e.SHA256
+		j.Skipped = true
+	})
+	return true
+}
+
+func (w *worker) handle(ctx context.Context, reqResp entity.ReqResp) {
+	r := reqResp.Request
+	if r == nil {
+		log.Sugar().Errorw("nil request")
+		return
+	}
+	if j, ok := w.jobs.Get(reqResp.JobID); ok && j.Status == entity.JobCancelled {
+		log.Sugar().Infow("job cancelled", "url", r.Url, "job", j.ID)
+		return
+	}
+	if reqResp.IsSync && reqResp.Context != nil && reqResp.Context.Err() != nil {
+		log.Sugar().Infow("caller gone", "url", r.Url)
+		return
+	}
+	if w.skipCompletedJob(reqResp) {
+		return
+	}
+	metrics.ActiveWorkers.Inc()
+	defer metrics.ActiveWorkers.Dec()
+	reCh, chOk := reqResp.ResponseChannel.Get()
+	// cancelled by DELETE /jobs/{id}
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reqCtx := jobCtx
+	if r.ShouldValidate() {
+		reqCtx = imageinfo.WithMode(jobCtx, w.validation.Mode)
+	}
+	R, recorder, hasher, err := newRequest(reqCtx, w.client, r, w.digests)
+	if err != nil {
+		log.Sugar().Errorw("bad request", "url", r.Url, "error", err)
+		if chOk && reqResp.IsSync {
+			reCh <- mo.Err[entity.RespV](err)
+		}
+		w.fail(reqResp, err)
+		return
+	}
+	host := hostOf(r.Url)
+	if err = w.gate.Check(host, r.OutPrefix); err != nil {
+		if chOk && reqResp.IsSync {
+			reCh <- mo.Err[entity.RespV](err)
+			return
+		}
+		log.Sugar().Debugw("request held", "url", r.Url, "reason", err)
+		w.parking.hold(reqResp)
+		return
+	}
+	if reqResp.IsSync {
+		// the caller is waiting anyway
+		if err = w.concurrency.Acquire(reqResp.Context, host); err != nil {
+			log.Sugar().Warnw("request context cancelled", "url", r.Url, "error", err)
+			return
+		}
+	} else if !w.concurrency.TryAcquire(host) {
+		log.Sugar().Debugw("host at its concurrency limit", "url", r.Url, "host", host)
+		w.parking.park(reqResp, concurrencyRetryDelay)
+		return
+	}
+	if d, ok := w.breaker.Allow(host); !ok {
+		w.concurrency.Cancel(host)
+		if chOk && reqResp.IsSync {
+			reCh <- mo.Err[entity.RespV](&breaker.OpenError{Host: host, RetryAfter: d})
+			return
+		}
+		// put it back after the cooldown instead of holding the worker
+		log.Sugar().Infow("host paused by circuit breaker", "url", r.Url, "host", host, "retry_after", d)
+		w.parking.park(reqResp, d)
+		return
+	}
+	if reqResp.JobID != "" {
+		if !w.jobs.Start(reqResp.JobID, cancel) {
+			log.Sugar().Infow("job cancelled", "url", r.Url, "job", reqResp.JobID)
+			// give back the half-open probe Allow might have handed out
+			w.breaker.Report(host, breaker.Neutral, 0)
+			w.concurrency.Cancel(host)
+			return
+		}
+		defer w.jobs.Finish(reqResp.JobID)
+	}
+	var resp *req.Response
+	start := time.Now()
+	// if it's async we could just use this goroutine to get the response
+	if !reqResp.IsSync {
+		resp, err = R.Send(r.GetMethod(), r.Url)
+	} else {
+		// otherwise we have to poll the context
+		type ResponseV = *req.Response
+		c := make(chan mo.Result[ResponseV], 1)
+		go func() {
+			resp, err := R.Send(r.GetMethod(), r.Url)
+			if err != nil {
+				c <- mo.Err[ResponseV](err)
+				return
+			}
+			c <- mo.Ok[ResponseV](resp)
+		}()
+		select {
+		case <-ctx.Done():
+			log.Sugar().Warnw("request context cancelled", "url", r.Url)
+			if chOk {
+				reCh <- mo.Err[entity.RespV](ctx.Err())
+			}
+			w.breaker.Report(host, breaker.Neutral, 0)
+			w.concurrency.Cancel(host)
+			return
+		case result := <-c:
+			resp, err = result.Get()
+		}
+	}
+	if err != nil && ctx.Err() != nil && !reqResp.IsSync {
+		// interrupted by shutdown. it would be persisted and tried again
+		log.Sugar().Warnw("download interrupted", "url", r.Url, "error", err)
+		w.breaker.Report(host, breaker.Neutral, 0)
+		w.concurrency.Cancel(host)
+		w.updateJob(reqResp, func(j *entity.Job) {
+			j.Status = entity.JobQueued
+		})
+		w.parking.keep(reqResp)
+		return
+	}
+	if err != nil && jobCtx.Err() != nil && !reqResp.IsSync {
+		log.Sugar().Infow("download cancelled", "url", r.Url, "job", reqResp.JobID)
+		w.breaker.Report(host, breaker.Neutral, 0)
+		w.concurrency.Cancel(host)
+		return
+	}
+	if err != nil {
+		if chOk && reqResp.IsSync {
+			reCh <- mo.Err[entity.RespV](err)
+		}
+		log.Sugar().Errorw("failed to download", "url", r.Url, "error", err)
+		utils.PrintHeadersCookies(R)
+		w.breaker.Report(host, breaker.Neutral, 0)
+		w.concurrency.Cancel(host)
+		metrics.RequestErrors.WithLabelValues(host).Inc()
+		w.fail(reqResp, err)
+		return
+	}
+	var out string
+	if r.OutPrefix != nil {
+		out = path.Join(w.outDir(r), outputName(r.Url))
+	}
+	replied := false
+	o, err := w.process(fetched{
+		url:            r.Url,
+		method:         r.GetMethod(),
+		resp:           resp,
+		latency:        time.Since(start),
+		hasher:         hasher,
+		expectedDigest: r.ExpectedDigest,
+		validate:       r.ShouldValidate(),
+		out:            out,
+		entry:          entity.HistoryEntry{Url: r.Url, Owner: reqResp.Owner, JobID: reqResp.JobID},
+		checked: func(o outcome) {
+			if chOk && reqResp.IsSync {
+				reCh <- mo.Ok[entity.RespV](syncResponse(r, resp, recorder, hasher, o.class))
+				replied = true
+			}
+		},
+		cancelled: func() bool {
+			j, ok := w.jobs.Get(reqResp.JobID)
+			return ok && j.Status == entity.JobCancelled
+		},
+	})
+	sums := hasher.Sums()
+	w.updateJob(reqResp, func(j *entity.Job) {
+		j.StatusCode = resp.StatusCode
+		j.Classification = string(o.class)
+		j.Size = hasher.Size()
+		j.SHA256 = sums[digest.SHA256]
+		j.Digests = otherDigests(sums)
+	})
+	if err != nil {
+		if chOk && reqResp.IsSync && !replied {
+			reCh <- mo.Err[entity.RespV](err)
+		}
+		var invalid *imageinfo.InvalidError
+		switch {
+		case errors.Is(err, errBadResponse):
+			log.Sugar().Errorw("bad response", "url", r.Url, "Content-Type", resp.Header.Get("Content-Type"), "status", resp.StatusCode, "classification", o.class)
+			utils.PrintHeadersCookies(R)
+			log.Sugar().Debugw("response", "headers", resp.Header, "response", resp.String())
+		case errors.As(err, &invalid):
+			// already retried by the client up to `max_retries`
+			log.Sugar().Errorw("invalid image", "url", r.Url, "error", err)
+		default:
+			log.Sugar().Errorw("failed to download", "url", r.Url, "output", out, "error", err)
+		}
+		w.fail(reqResp, err)
+		return
+	}
+	if o.cancelled {
+		return
+	}
+	if r.OutPrefix == nil {
+		log.Sugar().Infow("proxy", "url", r.Url, "status", resp.StatusCode, "classification", o.class)
+	}
+	w.updateJob(reqResp, func(j *entity.Job) {
+		j.Status = entity.JobDone
+		j.Output = o.entry.Path
+		j.NearDuplicateOf = o.entry.NearDuplicateOf
+		j.Skipped = o.skipped
+	})
+}
+
+// outDir is the directory the request is saved to, created if needed
+func (w *worker) outDir(r *entity.DownloadRequest) string {
+	prefix := *r.OutPrefix
+	if prefix == "" {
+		return w.baseOutDir
+	}
+	outDir, err := makeSubDirectory(w.baseOutDir, prefix)
+	if err != nil {
+		log.Sugar().Errorw("failed to create sub directory", "error", err, "url", r.Url, "prefix", prefix, "fallback", w.baseOutDir)
+		return w.baseOutDir
+	}
+	return outDir
+}
+
+// syncResponse is the response handed to the caller of a sync request
+func syncResponse(r *entity.DownloadRequest, resp *req.Response, recorder *redirect.Recorder, hasher *digest.Hasher, class classify.Class) *entity.DownloadResponse {
+	dlR := entity.DownloadResponse{}
+	header := make(map[string]string)
+	dlR.Headers = header
+	if resp.Header != nil {
+		for k, v := range resp.Header {
+			vv := strings.Join(v, ",")
+			dlR.Headers[k] = vv
+		}
+	}
+	ct, ok := utils.TryGet(dlR.Headers, "Content-Type", "content-type", "Content-type", "content-Type", "Content-TYPE").Get()
+	if ok {
+		dlR.MIMEType = ct
+	}
+	dlR.StatusCode = resp.StatusCode
+	dlR.Url = r.Url
+	dlR.FinalUrl = finalUrl(resp, r.Url)
+	dlR.Redirects = recorder.Hops()
+	dlR.Classification = string(class)
+	dlR.Digests = hasher.Sums()
+	dlR.Body = resp.Bytes()
+	return &dlR
+}
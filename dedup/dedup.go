@@ -0,0 +1,195 @@
+package dedup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+)
+
+type Config struct {
+	// how long a submission is remembered. 0 disables the deduplication,
+	// including the Idempotency-Key header
+	Window time.Duration `mapstructure:"window"`
+	// the async submissions of the same url and out_prefix are the same one
+	// even without Idempotency-Key
+	ByUrl bool `mapstructure:"by_url"`
+	// identical concurrent sync requests (GET or HEAD) share one fetch
+	ShareSync bool `mapstructure:"share_sync"`
+}
+
+var DefaultConfig = Config{
+	Window:    time.Hour,
+	ByUrl:     false,
+	ShareSync: true,
+}
+
+// MismatchError is returned when an Idempotency-Key is reused with a different request
+type MismatchError struct {
+	// the job of the key
+	JobID string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("idempotency key has been used by a different request of job %s", e.JobID)
+}
+
+type entry struct {
+	jobID       string
+	fingerprint string
+	expires     time.Time
+	// closed when the job is created, or the creation fails
+	done chan struct{}
+}
+
+// Index remembers the submitted jobs by the idempotency key or the url.
+// A nil Index remembers nothing.
+type Index struct {
+	mu        sync.Mutex
+	window    time.Duration
+	byUrl     bool
+	entries   map[string]*entry
+	lastSweep time.Time
+}
+
+// New creates the index. Returns nil if the window is not positive.
+func New(config Config) *Index {
+	if config.Window <= 0 {
+		return nil
+	}
+	return &Index{
+		window:    config.Window,
+		byUrl:     config.ByUrl,
+		entries:   make(map[string]*entry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Fingerprint identifies the request by its content
+func Fingerprint(r *entity.DownloadRequest) string {
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyOf is the key of the submission of owner. The Idempotency-Key takes
+// precedence, then the url and out_prefix if ByUrl is enabled. The fingerprint
+// is only set for the Idempotency-Key, whose request must not change.
+// Returns false if the submission should not be deduplicated.
+func (x *Index) KeyOf(owner string, idempotencyKey string, r *entity.DownloadRequest) (key string, fingerprint string, ok bool) {
+	if x == nil {
+		return "", "", false
+	}
+	if idempotencyKey != "" {
+		return "key\x00" + owner + "\x00" + idempotencyKey, Fingerprint(r), true
+	}
+	if !x.byUrl {
+		return "", "", false
+	}
+	prefix := ""
+	if r.OutPrefix != nil {
+		prefix = *r.OutPrefix
+	}
+	return "url\x00" + owner + "\x00" + r.Url + "\x00" + prefix, "", true
+}
+
+// Do returns the ID of the job remembered by key, or creates the job with create
+// and remembers it. The concurrent calls of the same key wait for the first one,
+// and try themselves if it fails. existed is true if the job is not created by this call.
+// An empty fingerprint skips the check of the request.
+func (x *Index) Do(key string, fingerprint string, create func() (string, error)) (id string, existed bool, err error) {
+	if x == nil {
+		id, err = create()
+		return id, false, err
+	}
+	for {
+		x.mu.Lock()
+		x.sweepLocked()
+		e, ok := x.lookupLocked(key)
+		if !ok {
+			break
+		}
+		select {
+		case <-e.done:
+			x.mu.Unlock()
+			if fingerprint != "" && e.fingerprint != fingerprint {
+				return e.jobID, true, &MismatchError{JobID: e.jobID}
+			}
+			return e.jobID, true, nil
+		default:
+			x.mu.Unlock()
+			<-e.done
+		}
+	}
+	e := &entry{fingerprint: fingerprint, done: make(chan struct{})}
+	x.entries[key] = e
+	x.mu.Unlock()
+
+	id, err = create()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err != nil {
+		delete(x.entries, key)
+	} else {
+		e.jobID = id
+		e.expires = time.Now().Add(x.window)
+	}
+	close(e.done)
+	return id, false, err
+}
+
+// Forget removes the key if it still refers to the job
+func (x *Index) Forget(key string, jobID string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[key]; ok && e.jobID == jobID {
+		select {
+		case <-e.done:
+			delete(x.entries, key)
+		default:
+		}
+	}
+}
+
+// lookupLocked returns the entry of key, removing it if it has expired
+func (x *Index) lookupLocked(key string) (*entry, bool) {
+	e, ok := x.entries[key]
+	if !ok {
+		return nil, false
+	}
+	select {
+	case <-e.done:
+		if time.Now().After(e.expires) {
+			delete(x.entries, key)
+			return nil, false
+		}
+	default:
+	}
+	return e, true
+}
+
+// sweepLocked removes the expired entries, at most once a minute
+func (x *Index) sweepLocked() {
+	now := time.Now()
+	if now.Sub(x.lastSweep) < time.Minute {
+		return
+	}
+	x.lastSweep = now
+	for k, e := range x.entries {
+		select {
+		case <-e.done:
+			if now.After(e.expires) {
+				delete(x.entries, k)
+			}
+		default:
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package dedup
+
+import (
+	"context"
+	"sync"
+)
+
+type call[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+	// callers still waiting for the result
+	waiters int
+	// callers ever joined the call after the first one
+	dups   int
+	cancel context.CancelFunc
+}
+
+// Group runs the identical concurrent calls once. Unlike singleflight, the call
+// is only cancelled when all of its callers have gone.
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+func NewGroup[T any]() *Group[T] {
+	return &Group[T]{calls: make(map[string]*call[T])}
+}
+
+// Do runs f, or waits for the call of the same key in progress. shared is true
+// if the result is shared with other callers. Returns ctx.Err() if ctx is done
+// before the result.
+func (g *Group[T]) Do(ctx context.Context, key string, f func(ctx context.Context) (T, error)) (v T, shared bool, err error) {
+	g.mu.Lock()
+	c, ok := g.calls[key]
+	if ok {
+		c.waiters++
+		c.dups++
+	} else {
+		var callCtx context.Context
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &call[T]{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			c.val, c.err = f(callCtx)
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		g.mu.Lock()
+		shared = c.dups > 0
+		g.mu.Unlock()
+		return c.val, shared, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		c.waiters--
+		if c.waiters == 0 {
+			// nobody else could join a call that is being cancelled
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			c.cancel()
+		}
+		return v, ok, ctx.Err()
+	}
+}
@@ -0,0 +1,192 @@
+package digest
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/imroc/req/v3"
+)
+
+// SHA256 is always computed
+const SHA256 = "sha256"
+
+var algorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	SHA256:   sha256.New,
+	"sha512": sha512.New,
+}
+
+// Algorithms returns the names of the supported algorithms
+func Algorithms() []string {
+	names := make([]string, 0, len(algorithms))
+	for k := range algorithms {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check returns an error if the algorithm is not supported
+func Check(algorithm string) error {
+	if _, ok := algorithms[algorithm]; !ok {
+		return fmt.Errorf("unsupported digest algorithm %s. expect one of %s", algorithm, strings.Join(Algorithms(), ", "))
+	}
+	return nil
+}
+
+// Parse splits the digest like `sha256:<hex>` into the algorithm and the lower case hex
+func Parse(d string) (algorithm string, sum string, err error) {
+	algorithm, sum, ok := strings.Cut(d, ":")
+	if !ok {
+		return "", "", fmt.Errorf("bad digest %s. expect <algorithm>:<hex>", d)
+	}
+	algorithm = strings.ToLower(algorithm)
+	if err = Check(algorithm); err != nil {
+		return "", "", err
+	}
+	sum = strings.ToLower(sum)
+	b, err := hex.DecodeString(sum)
+	if err != nil || len(b) != algorithms[algorithm]().Size() {
+		return "", "", fmt.Errorf("bad %s digest %s", algorithm, sum)
+	}
+	return algorithm, sum, nil
+}
+
+// MismatchError is returned when the body doesn't match the expected digest
+type MismatchError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s digest mismatch. expected %s, got %s", e.Algorithm, e.Expected, e.Actual)
+}
+
+type hasherKey struct{}
+
+// Hasher computes the digests of the response body while it's read.
+// Only the body of the last response (after the redirects) is counted.
+type Hasher struct {
+	mu         sync.Mutex
+	algorithms []string
+	hashes     map[string]hash.Hash
+	size       int64
+}
+
+// WithHasher attaches a new Hasher of SHA-256 and the given algorithms to the context.
+// The unsupported algorithms are ignored.
+func WithHasher(ctx context.Context, algorithms ...string) (context.Context, *Hasher) {
+	h := &Hasher{algorithms: append([]string{SHA256}, algorithms...)}
+	h.reset()
+	return context.WithValue(ctx, hasherKey{}, h), h
+}
+
+func (h *Hasher) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hashes = make(map[string]hash.Hash, len(h.algorithms))
+	for _, a := range h.algorithms {
+		if f, ok := algorithms[a]; ok {
+			h.hashes[a] = f()
+		}
+	}
+	h.size = 0
+}
+
+func (h *Hasher) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, hh := range h.hashes {
+		hh.Write(p)
+	}
+	h.size += int64(len(p))
+	return len(p), nil
+}
+
+// Size is the number of bytes of the body that have been read
+func (h *Hasher) Size() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.size
+}
+
+// Sums returns the hex digests by algorithm
+func (h *Hasher) Sums() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sums := make(map[string]string, len(h.hashes))
+	for a, hh := range h.hashes {
+		sums[a] = hex.EncodeToString(hh.Sum(nil))
+	}
+	return sums
+}
+
+// Verify checks the body against the expected digest like `sha256:<hex>`.
+// The algorithm must have been computed by the Hasher.
+func (h *Hasher) Verify(expected string) error {
+	algorithm, sum, err := Parse(expected)
+	if err != nil {
+		return err
+	}
+	actual, ok := h.Sums()[algorithm]
+	if !ok {
+		return fmt.Errorf("%s digest is not computed", algorithm)
+	}
+	if actual != sum {
+		return &MismatchError{Algorithm: algorithm, Expected: sum, Actual: actual}
+	}
+	return nil
+}
+
+type reader struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		_, _ = r.w.Write(p[:n])
+	}
+	return n, err
+}
+
+// Wrap tees the response body of each round trip to the Hasher in the context
+// of the request, if any.
+//
+// See also req.Transport.WrapRoundTripFunc
+func Wrap(rt http.RoundTripper) req.HttpRoundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		resp, err := rt.RoundTrip(r)
+		if err != nil || resp == nil || resp.Body == nil {
+			return resp, err
+		}
+		h, ok := r.Context().Value(hasherKey{}).(*Hasher)
+		if !ok {
+			return resp, err
+		}
+		// a redirect starts over
+		h.reset()
+		resp.Body = &reader{ReadCloser: resp.Body, w: h}
+		return resp, nil
+	}
+}
+
+// WrapClient installs the hashing on the transport of the client
+func WrapClient(client *req.Client) *req.Client {
+	client.GetTransport().WrapRoundTripFunc(Wrap)
+	return client
+}
@@ -19,9 +19,219 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/admin/breakers": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get the state of the circuit breaker of each host",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get Circuit Breakers",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/breaker.HostState"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/concurrency": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get the current concurrency limit of each host. Empty if adaptive concurrency is disabled",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get Adaptive Concurrency",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/adaptive.HostState"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/throttle": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get the bandwidth caps in bytes per second",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get Bandwidth Caps",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/throttle.Config"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Replace the bandwidth caps. Downloads in progress are affected as well",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Set Bandwidth Caps",
+                "parameters": [
+                    {
+                        "description": "bandwidth caps",
+                        "name": "config",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/throttle.Config"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/throttle.Config"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/batches/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get the aggregate progress of the jobs of a batch",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get Batch",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "batch ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/entity.BatchProgress"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/batches/{id}/wait": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Block until all the jobs of the batch are done, failed or cancelled, or the timeout elapses.\nResponds 200 if the batch has finished, otherwise 202 with the progress as it is.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Wait Batch",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "batch ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "default": "30s",
+                        "description": "how long to wait, like ` + "`" + `30s` + "`" + `. at most 5 minutes",
+                        "name": "timeout",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "the batch has finished",
+                        "schema": {
+                            "$ref": "#/definitions/entity.BatchProgress"
+                        }
+                    },
+                    "202": {
+                        "description": "some jobs are still queued or running",
+                        "schema": {
+                            "$ref": "#/definitions/entity.BatchProgress"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
         "/download": {
             "post": {
-                "description": "Push a download request to the queue",
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Push a download request to the queue\n\nWith ` + "`" + `Idempotency-Key` + "`" + `, or with ` + "`" + `dedup.by_url` + "`" + ` for the same url and out_prefix, a repeated\nsubmission within ` + "`" + `dedup.window` + "`" + ` returns the original job with 200 instead of queuing again.",
                 "consumes": [
                     "application/json"
                 ],
@@ -30,6 +240,18 @@ const docTemplate = `{
                 ],
                 "summary": "Async Download",
                 "parameters": [
+                    {
+                        "type": "string",
+                        "description": "how long to wait for the space if the queue is full, like ` + "`" + `10s` + "`" + `. not waiting by default",
+                        "name": "wait",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "the retries with the same key return the original job",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    },
                     {
                         "description": "download request",
                         "name": "request",
@@ -41,8 +263,33 @@ const docTemplate = `{
                     }
                 ],
                 "responses": {
+                    "200": {
+                        "description": "the original job of a repeated submission",
+                        "schema": {
+                            "$ref": "#/definitions/entity.Job"
+                        },
+                        "headers": {
+                            "Idempotent-Replayed": {
+                                "type": "boolean",
+                                "description": "true if the job is the original one"
+                            }
+                        }
+                    },
                     "202": {
-                        "description": "Accepted"
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/entity.Job"
+                        },
+                        "headers": {
+                            "X-Queue-Depth": {
+                                "type": "integer",
+                                "description": "requests in the queue"
+                            },
+                            "X-Queue-Estimated-Wait-Ms": {
+                                "type": "integer",
+                                "description": "estimated wait of the queue in milliseconds"
+                            }
+                        }
                     },
                     "400": {
                         "description": "Bad Request",
@@ -50,18 +297,104 @@ const docTemplate = `{
                             "$ref": "#/definitions/entity.ErrorResponse"
                         }
                     },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "out_prefix or url not allowed",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Idempotency-Key reused with a different request",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
                             "$ref": "#/definitions/entity.ErrorResponse"
                         }
+                    },
+                    "503": {
+                        "description": "queue is full. see ` + "`" + `Retry-After` + "`" + `",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/download/batch": {
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Push many download requests to the queue. The body is either a JSON array or\nNDJSON (one request per line), which could be streamed. The result of each item\nis streamed back as a line of NDJSON as soon as it's queued, followed by a summary line.\nWith ` + "`" + `wait` + "`" + `, each item waits for the space of the queue.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/x-ndjson"
+                ],
+                "summary": "Batch Async Download",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "how long each item waits for the space if the queue is full, like ` + "`" + `10s` + "`" + `",
+                        "name": "wait",
+                        "in": "query"
+                    },
+                    {
+                        "description": "download requests",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/entity.DownloadRequest"
+                            }
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "one line per item, and then entity.BatchSummary",
+                        "schema": {
+                            "$ref": "#/definitions/entity.BatchItemResult"
+                        },
+                        "headers": {
+                            "X-Batch-Id": {
+                                "type": "string",
+                                "description": "ID of the batch"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
                     }
                 }
             }
         },
         "/download/sync": {
             "post": {
-                "description": "Push a download request to the queue and wait for the response",
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Push a download request to the queue and wait for the response.\nIdentical concurrent GET or HEAD requests of the same token share one fetch unless ` + "`" + `dedup.share_sync` + "`" + ` is false.",
                 "consumes": [
                     "application/json"
                 ],
@@ -76,6 +409,12 @@ const docTemplate = `{
                         "name": "transparent",
                         "in": "query"
                     },
+                    {
+                        "type": "string",
+                        "description": "how long to wait for the space if the queue is full, like ` + "`" + `10s` + "`" + `. not waiting by default",
+                        "name": "wait",
+                        "in": "query"
+                    },
                     {
                         "description": "download request",
                         "name": "request",
@@ -91,6 +430,16 @@ const docTemplate = `{
                         "description": "OK",
                         "schema": {
                             "$ref": "#/definitions/entity.DownloadResponse"
+                        },
+                        "headers": {
+                            "X-Queue-Depth": {
+                                "type": "integer",
+                                "description": "requests in the queue"
+                            },
+                            "X-Queue-Estimated-Wait-Ms": {
+                                "type": "integer",
+                                "description": "estimated wait of the queue in milliseconds"
+                            }
                         }
                     },
                     "400": {
@@ -99,42 +448,758 @@ const docTemplate = `{
                             "$ref": "#/definitions/entity.ErrorResponse"
                         }
                     },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "out_prefix or url not allowed",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
                             "$ref": "#/definitions/entity.ErrorResponse"
                         }
+                    },
+                    "502": {
+                        "description": "body doesn't match expected_digest, or the image is broken",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "queue is full, circuit breaker of the host is open, host or out_prefix paused, or server is shutting down",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "entity.DownloadRequest": {
-            "type": "object",
-            "properties": {
-                "cookies": {
-                    "description": "Array of cookies. See also ` + "`" + `entity.TempCookie` + "`" + `.\n\nhttps://chromedevtools.github.io/devtools-protocol/tot/Network/#type-Cookie",
-                    "type": "array",
-                    "items": {
-                        "type": "object"
+        },
+        "/download/sync/batch": {
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
                     }
-                },
-                "headers": {
-                    "description": "recommended to remove \"User-Agent\" from headers",
-                    "type": "object",
-                    "additionalProperties": {
-                        "type": "string"
+                ],
+                "description": "Send many download requests concurrently within the worker pool. The body is either\na JSON array or NDJSON. Each response is streamed back as a line of NDJSON as soon as it\ncompletes (not in order), followed by a summary line. An item failing doesn't fail the others.\nAt most as many items as the worker pool are in flight at once; the rest of the body is read\nas they complete.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/x-ndjson"
+                ],
+                "summary": "Batch Sync Download",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "how long each item waits for the space if the queue is full, like ` + "`" + `10s` + "`" + `",
+                        "name": "wait",
+                        "in": "query"
+                    },
+                    {
+                        "description": "download requests",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/entity.DownloadRequest"
+                            }
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "one line per item, and then entity.SyncBatchSummary",
+                        "schema": {
+                            "$ref": "#/definitions/entity.SyncBatchItem"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/fetch": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Fetch the url and stream the upstream status, headers and body back.\n` + "`" + `Range` + "`" + ` and conditional headers are passed through.",
+                "produces": [
+                    "application/octet-stream"
+                ],
+                "summary": "Fetch",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "the url to fetch",
+                        "name": "url",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "named session of the token. Cookies are shared among the requests in the same session",
+                        "name": "session",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Referer header",
+                        "name": "referer",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "extra header in the form of ` + "`" + `Name: Value` + "`" + `",
+                        "name": "header",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "url not allowed",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Bad Gateway",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/files/{path}": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Read the saved files, or list a directory",
+                "produces": [
+                    "application/octet-stream"
+                ],
+                "summary": "Read Files",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "path relative to the output directory",
+                        "name": "path",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/history": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Whether the url has been downloaded, wherever the file is now, and the outcomes\nof its downloads, the latest first. The downloads of others are invisible unless admin.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Download History",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "the url",
+                        "name": "url",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/entity.HistoryResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "history is disabled",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/jobs/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get the status and the result of an async download",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get Job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "job ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/entity.Job"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Cancel a queued or running async download. The download in progress is aborted\nand nothing is saved.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Cancel Job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "job ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/entity.Job"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "job has finished",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/jobs/{id}/wait": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Block until the job is done, failed or cancelled, or the timeout elapses.\nResponds 200 if the job has finished, otherwise 202 with the job as it is.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Wait Job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "job ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "default": "30s",
+                        "description": "how long to wait, like ` + "`" + `30s` + "`" + `. at most 5 minutes",
+                        "name": "timeout",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "the job has finished",
+                        "schema": {
+                            "$ref": "#/definitions/entity.Job"
+                        }
+                    },
+                    "202": {
+                        "description": "the job is still queued or running",
+                        "schema": {
+                            "$ref": "#/definitions/entity.Job"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/queue": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get what is paused, the depth and the estimated wait of the queue",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get Queue State",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.QueueState"
+                        }
+                    }
+                }
+            }
+        },
+        "/queue/pause": {
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Stop the workers from picking up new requests, of a host or an out_prefix if given.\nThe downloads in progress are not affected.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Pause Queue",
+                "parameters": [
+                    {
+                        "description": "what to pause. the whole queue if empty",
+                        "name": "scope",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/pause.Scope"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pause.State"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/queue/resume": {
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Resume the queue, a host or an out_prefix",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Resume Queue",
+                "parameters": [
+                    {
+                        "description": "what to resume. the whole queue if empty",
+                        "name": "scope",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/pause.Scope"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pause.State"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/entity.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "adaptive.HostState": {
+            "description": "adaptive concurrency of a host",
+            "type": "object",
+            "properties": {
+                "host": {
+                    "type": "string",
+                    "example": "example.com"
+                },
+                "in_flight": {
+                    "type": "integer",
+                    "example": 2
+                },
+                "latency_ms": {
+                    "description": "moving average of the latency in milliseconds",
+                    "type": "integer",
+                    "example": 250
+                },
+                "limit": {
+                    "type": "integer",
+                    "example": 4
+                }
+            }
+        },
+        "api.QueueState": {
+            "description": "what is paused and the depth of the queue",
+            "type": "object",
+            "properties": {
+                "capacity": {
+                    "description": "0 means unlimited",
+                    "type": "integer",
+                    "example": 4096
+                },
+                "depth": {
+                    "type": "integer",
+                    "example": 42
+                },
+                "estimated_wait_ms": {
+                    "description": "estimated wait of an async request pushed now, in milliseconds.\n0 if there's nothing to estimate with yet",
+                    "type": "integer",
+                    "example": 1500
+                },
+                "hosts": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "out_prefixes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "paused": {
+                    "description": "the whole queue is paused",
+                    "type": "boolean"
+                }
+            }
+        },
+        "breaker.HostState": {
+            "description": "state of the circuit breaker of a host",
+            "type": "object",
+            "properties": {
+                "error_ratio": {
+                    "type": "number",
+                    "example": 0.1
+                },
+                "host": {
+                    "type": "string",
+                    "example": "example.com"
+                },
+                "open_until": {
+                    "type": "string"
+                },
+                "requests": {
+                    "description": "number of results in the window",
+                    "type": "integer",
+                    "example": 20
+                },
+                "state": {
+                    "enum": [
+                        "closed",
+                        "open",
+                        "half-open"
+                    ],
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/breaker.State"
+                        }
+                    ],
+                    "example": "closed"
+                },
+                "trips": {
+                    "description": "consecutive times the breaker opened",
+                    "type": "integer",
+                    "example": 0
+                }
+            }
+        },
+        "breaker.State": {
+            "type": "string",
+            "enum": [
+                "closed",
+                "open",
+                "half-open"
+            ],
+            "x-enum-varnames": [
+                "Closed",
+                "Open",
+                "HalfOpen"
+            ]
+        },
+        "entity.BatchItemResult": {
+            "description": "the result of queuing an item of a batch",
+            "type": "object",
+            "properties": {
+                "duplicate": {
+                    "description": "the url has been submitted within the dedup window. job_id is the original job,\nwhich might not be in this batch",
+                    "type": "boolean",
+                    "example": false
+                },
+                "error": {
+                    "type": "string"
+                },
+                "index": {
+                    "description": "index of the item in the batch, starting from 0",
+                    "type": "integer",
+                    "example": 0
+                },
+                "job_id": {
+                    "description": "empty if the item is rejected",
+                    "type": "string",
+                    "example": "5f0c4d2e8a9b4c1d9e7f6a5b4c3d2e1f"
+                },
+                "url": {
+                    "type": "string",
+                    "example": "https://example.com/1.jpg"
+                }
+            }
+        },
+        "entity.BatchProgress": {
+            "description": "the aggregate progress of the jobs of a batch",
+            "type": "object",
+            "properties": {
+                "cancelled": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "done": {
+                    "type": "integer",
+                    "example": 40
+                },
+                "failed": {
+                    "type": "integer",
+                    "example": 3
+                },
+                "finished": {
+                    "description": "every job has finished",
+                    "type": "boolean",
+                    "example": false
+                },
+                "id": {
+                    "type": "string",
+                    "example": "9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d"
+                },
+                "job_ids": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "owner": {
+                    "type": "string",
+                    "example": "crawler"
+                },
+                "queued": {
+                    "type": "integer",
+                    "example": 50
+                },
+                "running": {
+                    "type": "integer",
+                    "example": 4
+                },
+                "total": {
+                    "description": "number of the jobs in each status",
+                    "type": "integer",
+                    "example": 98
+                }
+            }
+        },
+        "entity.DownloadRequest": {
+            "type": "object",
+            "properties": {
+                "body": {
+                    "description": "raw request body. Interpreted according to ` + "`" + `body_encoding` + "`" + `.\nAt most one of ` + "`" + `body` + "`" + `, ` + "`" + `json` + "`" + ` and ` + "`" + `form` + "`" + ` could be set.",
+                    "type": "string",
+                    "example": "query=example"
+                },
+                "body_encoding": {
+                    "description": "encoding of ` + "`" + `body` + "`" + `, either ` + "`" + `text` + "`" + ` (default) or ` + "`" + `base64` + "`" + `",
+                    "type": "string",
+                    "enum": [
+                        "text",
+                        "base64"
+                    ],
+                    "example": "text"
+                },
+                "callback_url": {
+                    "description": "where the result of an async job is POSTed once it finishes.\nOverrides ` + "`" + `webhook.default_url` + "`" + `. Ignored by sync requests",
+                    "type": "string",
+                    "example": "https://example.com/hooks/dumbdl"
+                },
+                "cookies": {
+                    "description": "Array of cookies. See also ` + "`" + `entity.TempCookie` + "`" + `.\n\nhttps://chromedevtools.github.io/devtools-protocol/tot/Network/#type-Cookie",
+                    "type": "array",
+                    "items": {
+                        "type": "object"
+                    }
+                },
+                "expected_digest": {
+                    "description": "` + "`" + `\u003calgorithm\u003e:\u003chex\u003e` + "`" + ` the body must match, like ` + "`" + `sha256:e3b0...` + "`" + `.\nOtherwise the download fails and nothing is saved",
+                    "type": "string",
+                    "example": "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+                },
+                "form": {
+                    "description": "form request body. ` + "`" + `Content-Type` + "`" + ` would be ` + "`" + `application/x-www-form-urlencoded` + "`" + `",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
                     }
                 },
+                "headers": {
+                    "description": "recommended to remove \"User-Agent\" from headers",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "json": {
+                    "description": "JSON request body. ` + "`" + `Content-Type` + "`" + ` would be ` + "`" + `application/json` + "`" + ` unless set in headers",
+                    "type": "object"
+                },
+                "method": {
+                    "description": "HTTP method. ` + "`" + `GET` + "`" + ` if it's empty",
+                    "type": "string",
+                    "example": "GET"
+                },
                 "out_prefix": {
                     "description": "if it not exists it won't be saved.\nif it's empty then it would be saved at root of output directory.\nOtherwise, it would be saved at ` + "`" + `output_dir/out_prefix` + "`" + `",
                     "type": "string",
                     "example": "example"
                 },
+                "priority": {
+                    "description": "async requests of higher priority are picked first.\nSync requests are always picked before async ones.",
+                    "type": "integer",
+                    "maximum": 10,
+                    "minimum": -10,
+                    "example": 0
+                },
+                "rate_limit": {
+                    "description": "bandwidth cap of this request in bytes per second.\n0 means only the global and per-host caps apply.",
+                    "type": "integer",
+                    "example": 1048576
+                },
+                "redirect": {
+                    "description": "overrides the global redirect policy",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/entity.RedirectPolicy"
+                        }
+                    ]
+                },
                 "url": {
                     "type": "string",
                     "example": "https://example.com/"
+                },
+                "validate_image": {
+                    "description": "check the image by ` + "`" + `validation.mode` + "`" + ` even if it's not saved, so that a sync\nrequest fails on a broken image. The saved images are always checked",
+                    "type": "boolean",
+                    "example": false
                 }
             }
         },
@@ -146,6 +1211,33 @@ const docTemplate = `{
                     "type": "string",
                     "example": "\u003chtml\u003e...\u003c/html\u003e"
                 },
+                "classification": {
+                    "description": "label of the response. See also ` + "`" + `classify.Class` + "`" + `",
+                    "type": "string",
+                    "enum": [
+                        "ok",
+                        "challenge",
+                        "captcha",
+                        "rate-limited",
+                        "login-required",
+                        "not-found",
+                        "soft-404",
+                        "error"
+                    ],
+                    "example": "ok"
+                },
+                "digests": {
+                    "description": "hex digests of the body by algorithm, including ` + "`" + `sha256` + "`" + `",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "final_url": {
+                    "description": "the url after following the redirects",
+                    "type": "string",
+                    "example": "https://example.com/"
+                },
                 "headers": {
                     "type": "object",
                     "additionalProperties": {
@@ -156,6 +1248,13 @@ const docTemplate = `{
                     "type": "string",
                     "example": "text/html"
                 },
+                "redirects": {
+                    "description": "the redirects that have been followed, in order",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/entity.RedirectHop"
+                    }
+                },
                 "status_code": {
                     "type": "integer",
                     "example": 200
@@ -174,6 +1273,345 @@ const docTemplate = `{
                     "example": "error message"
                 }
             }
+        },
+        "entity.HistoryEntry": {
+            "description": "the outcome of a download",
+            "type": "object",
+            "properties": {
+                "ahash": {
+                    "description": "perceptual hashes of the image as 16 hex digits, see ` + "`" + `phash.Hashes` + "`" + `",
+                    "type": "string",
+                    "example": "ffe7c3c3c3c3e7ff"
+                },
+                "dhash": {
+                    "type": "string",
+                    "example": "0e1e3c7870e0c081"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "job_id": {
+                    "type": "string",
+                    "example": "5f0c4d2e8a9b4c1d9e7f6a5b4c3d2e1f"
+                },
+                "near_duplicate_of": {
+                    "description": "path of the existing image of the same directory that looks the same",
+                    "type": "string",
+                    "example": "out/example/0.jpg"
+                },
+                "owner": {
+                    "description": "name of the token that submitted the download",
+                    "type": "string",
+                    "example": "crawler"
+                },
+                "path": {
+                    "description": "where the file was saved. empty if failed",
+                    "type": "string",
+                    "example": "out/example/1.jpg"
+                },
+                "sha256": {
+                    "description": "hex encoded SHA-256 of the saved file",
+                    "type": "string",
+                    "example": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+                },
+                "size": {
+                    "type": "integer",
+                    "example": 102400
+                },
+                "status": {
+                    "enum": [
+                        "done",
+                        "failed"
+                    ],
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/entity.JobStatus"
+                        }
+                    ],
+                    "example": "done"
+                },
+                "time": {
+                    "type": "string"
+                },
+                "url": {
+                    "type": "string",
+                    "example": "https://example.com/1.jpg"
+                }
+            }
+        },
+        "entity.HistoryResponse": {
+            "description": "the history of a url, the latest first",
+            "type": "object",
+            "properties": {
+                "completed": {
+                    "description": "true if the url has been downloaded",
+                    "type": "boolean",
+                    "example": true
+                },
+                "entries": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/entity.HistoryEntry"
+                    }
+                },
+                "url": {
+                    "type": "string",
+                    "example": "https://example.com/1.jpg"
+                }
+            }
+        },
+        "entity.Job": {
+            "description": "an async download request and its result",
+            "type": "object",
+            "properties": {
+                "batch_id": {
+                    "description": "ID of the batch if it's submitted in a batch",
+                    "type": "string",
+                    "example": "9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d"
+                },
+                "classification": {
+                    "description": "see also ` + "`" + `classify.Class` + "`" + `",
+                    "type": "string",
+                    "example": "ok"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "digests": {
+                    "description": "the other digests by algorithm, like ` + "`" + `md5` + "`" + `",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "error": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "5f0c4d2e8a9b4c1d9e7f6a5b4c3d2e1f"
+                },
+                "near_duplicate_of": {
+                    "description": "path of the existing image of the same directory that looks the same",
+                    "type": "string",
+                    "example": "out/example/0.jpg"
+                },
+                "output": {
+                    "description": "where the file is saved",
+                    "type": "string",
+                    "example": "out/example/1.jpg"
+                },
+                "owner": {
+                    "description": "name of the token that submitted the job",
+                    "type": "string",
+                    "example": "crawler"
+                },
+                "request": {
+                    "description": "without the cookies and the sensitive headers when shown, see Job.Redacted",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/entity.DownloadRequest"
+                        }
+                    ]
+                },
+                "sha256": {
+                    "description": "hex encoded SHA-256 of the response body",
+                    "type": "string",
+                    "example": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+                },
+                "size": {
+                    "description": "size of the response body in bytes",
+                    "type": "integer",
+                    "example": 102400
+                },
+                "skipped": {
+                    "description": "true if nothing is saved, since the url has been downloaded before or the\nimage is a near duplicate",
+                    "type": "boolean",
+                    "example": false
+                },
+                "status": {
+                    "enum": [
+                        "queued",
+                        "running",
+                        "done",
+                        "failed",
+                        "cancelled"
+                    ],
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/entity.JobStatus"
+                        }
+                    ],
+                    "example": "done"
+                },
+                "status_code": {
+                    "description": "status code of the upstream response. 0 if there's no response",
+                    "type": "integer",
+                    "example": 200
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "entity.JobStatus": {
+            "type": "string",
+            "enum": [
+                "queued",
+                "running",
+                "done",
+                "failed",
+                "cancelled"
+            ],
+            "x-enum-varnames": [
+                "JobQueued",
+                "JobRunning",
+                "JobDone",
+                "JobFailed",
+                "JobCancelled"
+            ]
+        },
+        "entity.RedirectHop": {
+            "description": "a redirect response that has been followed",
+            "type": "object",
+            "properties": {
+                "location": {
+                    "type": "string",
+                    "example": "https://example.com/login"
+                },
+                "set_cookies": {
+                    "description": "raw ` + "`" + `Set-Cookie` + "`" + ` headers of the redirect response",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "status_code": {
+                    "type": "integer",
+                    "example": 302
+                },
+                "url": {
+                    "type": "string",
+                    "example": "https://example.com/"
+                }
+            }
+        },
+        "entity.RedirectPolicy": {
+            "description": "redirect policy. See also entity.DownloadRequest",
+            "type": "object",
+            "properties": {
+                "max_redirects": {
+                    "description": "max number of redirects to follow. 0 means the default (10)",
+                    "type": "integer",
+                    "example": 10
+                },
+                "no_follow": {
+                    "description": "don't follow any redirect",
+                    "type": "boolean"
+                },
+                "same_host_only": {
+                    "description": "only follow the redirects to the same host as the original request",
+                    "type": "boolean"
+                }
+            }
+        },
+        "entity.SyncBatchItem": {
+            "description": "the response of an item of a sync batch",
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "error_status": {
+                    "description": "what the status code would be if the item was sent to ` + "`" + `/download/sync` + "`" + `",
+                    "type": "integer",
+                    "example": 503
+                },
+                "index": {
+                    "description": "index of the item in the batch, starting from 0",
+                    "type": "integer",
+                    "example": 0
+                },
+                "response": {
+                    "description": "empty if there's an error",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/entity.DownloadResponse"
+                        }
+                    ]
+                },
+                "url": {
+                    "type": "string",
+                    "example": "https://example.com/api?page=1"
+                }
+            }
+        },
+        "pause.Scope": {
+            "description": "what to pause or resume. empty means the whole queue",
+            "type": "object",
+            "properties": {
+                "host": {
+                    "type": "string",
+                    "example": "i.example.com"
+                },
+                "out_prefix": {
+                    "type": "string",
+                    "example": "example"
+                }
+            }
+        },
+        "pause.State": {
+            "description": "the paused scopes",
+            "type": "object",
+            "properties": {
+                "hosts": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "out_prefixes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "paused": {
+                    "description": "the whole queue is paused",
+                    "type": "boolean"
+                }
+            }
+        },
+        "throttle.Config": {
+            "description": "bandwidth caps in bytes per second. 0 means unlimited",
+            "type": "object",
+            "properties": {
+                "global": {
+                    "description": "cap shared by every download",
+                    "type": "integer",
+                    "example": 10485760
+                },
+                "hosts": {
+                    "description": "override of PerHost for specific hosts",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
+                },
+                "per_host": {
+                    "description": "default cap for each host",
+                    "type": "integer",
+                    "example": 2097152
+                }
+            }
+        }
+    },
+    "securityDefinitions": {
+        "BearerAuth": {
+            "description": "` + "`" + `Bearer \u003ctoken\u003e` + "`" + `. Only required if tokens are configured.",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
         }
     }
 }`
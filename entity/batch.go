@@ -0,0 +1,74 @@
+package entity
+
+import "time"
+
+// BatchItemResult is the result of queuing an item of a batch
+//
+// @Description the result of queuing an item of a batch
+type BatchItemResult struct {
+	// index of the item in the batch, starting from 0
+	Index int    `json:"index" example:"0"`
+	Url   string `json:"url,omitempty" example:"https://example.com/1.jpg"`
+	// empty if the item is rejected
+	JobID string `json:"job_id,omitempty" example:"5f0c4d2e8a9b4c1d9e7f6a5b4c3d2e1f"`
+	// the url has been submitted within the dedup window. job_id is the original job,
+	// which might not be in this batch
+	Duplicate bool   `json:"duplicate,omitempty" example:"false"`
+	Error     string `json:"error,omitempty"`
+}
+
+// BatchSummary is the last line of the response of a batch submission
+//
+// @Description the last line of the response of a batch submission
+type BatchSummary struct {
+	BatchID  string `json:"batch_id" example:"9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d"`
+	Total    int    `json:"total" example:"100"`
+	Accepted int    `json:"accepted" example:"98"`
+	Rejected int    `json:"rejected" example:"2"`
+	// the body could not be decoded any more. the items after it are not read
+	Error string `json:"error,omitempty"`
+}
+
+// BatchProgress is the aggregate progress of the jobs of a batch
+//
+// @Description the aggregate progress of the jobs of a batch
+type BatchProgress struct {
+	ID    string `json:"id" example:"9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d"`
+	Owner string `json:"owner,omitempty" example:"crawler"`
+	// number of the jobs in each status
+	Total     int `json:"total" example:"98"`
+	Queued    int `json:"queued" example:"50"`
+	Running   int `json:"running" example:"4"`
+	Done      int `json:"done" example:"40"`
+	Failed    int `json:"failed" example:"3"`
+	Cancelled int `json:"cancelled" example:"1"`
+	// every job has finished
+	Finished  bool      `json:"finished" example:"false"`
+	JobIDs    []string  `json:"job_ids"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SyncBatchItem is the response of an item of a sync batch
+//
+// @Description the response of an item of a sync batch
+type SyncBatchItem struct {
+	// index of the item in the batch, starting from 0
+	Index int    `json:"index" example:"0"`
+	Url   string `json:"url,omitempty" example:"https://example.com/api?page=1"`
+	// empty if there's an error
+	Response *DownloadResponse `json:"response,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	// what the status code would be if the item was sent to `/download/sync`
+	ErrorStatus int `json:"error_status,omitempty" example:"503"`
+}
+
+// SyncBatchSummary is the last line of the response of a sync batch
+//
+// @Description the last line of the response of a sync batch
+type SyncBatchSummary struct {
+	Total     int `json:"total" example:"20"`
+	Succeeded int `json:"succeeded" example:"19"`
+	Failed    int `json:"failed" example:"1"`
+	// the body could not be decoded any more. the items after it are not read
+	Error string `json:"error,omitempty"`
+}
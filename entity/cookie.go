@@ -46,3 +46,21 @@ func (t TempCookie) ToNetCookie() http.Cookie {
 		SameSite: http.SameSiteDefaultMode,
 	}
 }
+
+// FromNetCookie is the inverse of TempCookie.ToNetCookie
+func FromNetCookie(c http.Cookie) TempCookie {
+	t := TempCookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		HttpOnly: c.HttpOnly,
+		Secure:   c.Secure,
+	}
+	if c.Expires.IsZero() {
+		t.Session = true
+	} else {
+		t.Expires = float64(c.Expires.Unix())
+	}
+	return t
+}
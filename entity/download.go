@@ -1,10 +1,17 @@
 package entity
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"path"
+	"path/filepath"
 	"strings"
+
+	"github.com/crosstyan/dumb_downloader/digest"
 )
 
 type DownloadRequest struct {
@@ -19,13 +26,134 @@ type DownloadRequest struct {
 	// if it's empty then it would be saved at root of output directory.
 	// Otherwise, it would be saved at `output_dir/out_prefix`
 	OutPrefix *string `json:"out_prefix,omitempty" example:"example"`
+	// bandwidth cap of this request in bytes per second.
+	// 0 means only the global and per-host caps apply.
+	RateLimit int64 `json:"rate_limit,omitempty" example:"1048576"`
+	// HTTP method. `GET` if it's empty
+	Method string `json:"method,omitempty" example:"GET"`
+	// raw request body. Interpreted according to `body_encoding`.
+	// At most one of `body`, `json` and `form` could be set.
+	Body *string `json:"body,omitempty" example:"query=example"`
+	// encoding of `body`, either `text` (default) or `base64`
+	BodyEncoding string `json:"body_encoding,omitempty" example:"text" enums:"text,base64"`
+	// JSON request body. `Content-Type` would be `application/json` unless set in headers
+	JSON json.RawMessage `json:"json,omitempty" swaggertype:"object"`
+	// form request body. `Content-Type` would be `application/x-www-form-urlencoded`
+	Form map[string]string `json:"form,omitempty"`
+	// overrides the global redirect policy
+	Redirect *RedirectPolicy `json:"redirect,omitempty"`
+	// async requests of higher priority are picked first.
+	// Sync requests are always picked before async ones.
+	Priority int `json:"priority,omitempty" example:"0" minimum:"-10" maximum:"10"`
+	// where the result of an async job is POSTed once it finishes.
+	// Overrides `webhook.default_url`. Ignored by sync requests
+	CallbackUrl string `json:"callback_url,omitempty" example:"https://example.com/hooks/dumbdl"`
+	// `<algorithm>:<hex>` the body must match, like `sha256:e3b0...`.
+	// Otherwise the download fails and nothing is saved
+	ExpectedDigest string `json:"expected_digest,omitempty" example:"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"`
+	// check the image by `validation.mode` even if it's not saved, so that a sync
+	// request fails on a broken image. The saved images are always checked
+	ValidateImage bool `json:"validate_image,omitempty" example:"false"`
+}
+
+// ShouldValidate reports whether the image of the response should be checked
+func (r *DownloadRequest) ShouldValidate() bool {
+	return r.OutPrefix != nil || r.ValidateImage
+}
+
+const (
+	BodyEncodingText   = "text"
+	BodyEncodingBase64 = "base64"
+)
+
+const (
+	MinPriority = -10
+	MaxPriority = 10
+)
+
+// GetMethod returns the HTTP method in upper case. `GET` by default.
+func (r *DownloadRequest) GetMethod() string {
+	if r.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(r.Method)
+}
+
+// HasJSON reports whether the JSON body is set. `"json": null` is the same as unset
+func (r *DownloadRequest) HasJSON() bool {
+	return len(r.JSON) > 0 && !bytes.Equal(r.JSON, []byte("null"))
+}
+
+// Validate checks the fields that could not be checked by json.Unmarshal
+func (r *DownloadRequest) Validate() error {
+	if r.Url == "" {
+		return errors.New("url is required")
+	}
+	n := 0
+	if r.Body != nil {
+		n++
+	}
+	if r.HasJSON() {
+		n++
+	}
+	if r.Form != nil {
+		n++
+	}
+	if n > 1 {
+		return errors.New("at most one of body, json and form could be set")
+	}
+	switch r.BodyEncoding {
+	case "", BodyEncodingText, BodyEncodingBase64:
+	default:
+		return fmt.Errorf("unknown body encoding %s", r.BodyEncoding)
+	}
+	if r.Priority < MinPriority || r.Priority > MaxPriority {
+		return fmt.Errorf("priority should be between %d and %d", MinPriority, MaxPriority)
+	}
+	if r.OutPrefix != nil {
+		p := filepath.ToSlash(*r.OutPrefix)
+		clean := path.Clean(p)
+		if path.IsAbs(p) || filepath.IsAbs(*r.OutPrefix) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("out_prefix %s should be inside the output directory", *r.OutPrefix)
+		}
+	}
+	if r.ExpectedDigest != "" {
+		if _, _, err := digest.Parse(r.ExpectedDigest); err != nil {
+			return err
+		}
+	}
+	_, err := r.RawBody()
+	return err
+}
+
+// RawBody returns the decoded `body`. nil if it's not set.
+func (r *DownloadRequest) RawBody() ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	if r.BodyEncoding == BodyEncodingBase64 {
+		b, err := base64.StdEncoding.DecodeString(*r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("bad base64 body: %w", err)
+		}
+		return b, nil
+	}
+	return []byte(*r.Body), nil
 }
 
 type DownloadResponse struct {
-	Url        string            `json:"url" example:"https://example.com/"`
+	Url string `json:"url" example:"https://example.com/"`
+	// the url after following the redirects
+	FinalUrl string `json:"final_url" example:"https://example.com/"`
+	// the redirects that have been followed, in order
+	Redirects  []RedirectHop     `json:"redirects,omitempty"`
 	StatusCode int               `json:"status_code" example:"200"`
 	Headers    map[string]string `json:"headers"`
 	MIMEType   string            `json:"mime_type" example:"text/html"`
+	// label of the response. See also `classify.Class`
+	Classification string `json:"classification" example:"ok" enums:"ok,challenge,captcha,rate-limited,login-required,not-found,soft-404,error"`
+	// hex digests of the body by algorithm, including `sha256`
+	Digests map[string]string `json:"digests,omitempty"`
 	// if it's binary, it's base64 encoded. Otherwise,
 	// it's text
 	Body []byte `json:"body,omitempty" example:"<html>...</html>" swaggertype:"string"`
@@ -69,6 +197,22 @@ type ErrorResponse struct {
 	Error string `json:"error" example:"error message"`
 }
 
+// MarshalJSON writes the cookies as TempCookie, the same as UnmarshalJSON reads
+func (r DownloadRequest) MarshalJSON() ([]byte, error) {
+	type Alias DownloadRequest
+	cookies := make([]TempCookie, len(r.Cookies))
+	for i, c := range r.Cookies {
+		cookies[i] = FromNetCookie(c)
+	}
+	return json.Marshal(&struct {
+		Cookies []TempCookie `json:"cookies"`
+		Alias
+	}{
+		Cookies: cookies,
+		Alias:   Alias(r),
+	})
+}
+
 // UnmarshalJSON
 //
 // @see https://gist.github.com/miguelmota/904f0fdad34eaac09c5d53098f960c5c
@@ -0,0 +1,34 @@
+package entity
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		valid bool
+	}{
+		{"url only", `{"url":"https://example.com/a.jpg"}`, true},
+		{"null json with body", `{"url":"https://example.com/a.jpg","json":null,"body":"a"}`, true},
+		{"json with body", `{"url":"https://example.com/a.jpg","json":{},"body":"a"}`, false},
+		{"prefix starting with dots", `{"url":"https://example.com/a.jpg","out_prefix":"..foo/a"}`, true},
+		{"prefix in the directory", `{"url":"https://example.com/a.jpg","out_prefix":"a/../b"}`, true},
+		{"prefix of the parent", `{"url":"https://example.com/a.jpg","out_prefix":".."}`, false},
+		{"prefix outside", `{"url":"https://example.com/a.jpg","out_prefix":"a/../../b"}`, false},
+		{"absolute prefix", `{"url":"https://example.com/a.jpg","out_prefix":"/tmp/a"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r DownloadRequest
+			if err := json.Unmarshal([]byte(tt.json), &r); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Validate(); (err == nil) != tt.valid {
+				t.Fatalf("Validate = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package entity
+
+import "time"
+
+// HistoryEntry is the outcome of a download
+//
+// @Description the outcome of a download
+type HistoryEntry struct {
+	Url    string    `json:"url" example:"https://example.com/1.jpg"`
+	Status JobStatus `json:"status" example:"done" enums:"done,failed"`
+	// where the file was saved. empty if failed
+	Path string `json:"path,omitempty" example:"out/example/1.jpg"`
+	// hex encoded SHA-256 of the saved file
+	SHA256 string `json:"sha256,omitempty" example:"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"`
+	Size   int64  `json:"size,omitempty" example:"102400"`
+	// perceptual hashes of the image as 16 hex digits, see `phash.Hashes`
+	AHash string `json:"ahash,omitempty" example:"ffe7c3c3c3c3e7ff"`
+	DHash string `json:"dhash,omitempty" example:"0e1e3c7870e0c081"`
+	// path of the existing image of the same directory that looks the same
+	NearDuplicateOf string    `json:"near_duplicate_of,omitempty" example:"out/example/0.jpg"`
+	Error           string    `json:"error,omitempty"`
+	Time            time.Time `json:"time"`
+	// name of the token that submitted the download
+	Owner string `json:"owner,omitempty" example:"crawler"`
+	JobID string `json:"job_id,omitempty" example:"5f0c4d2e8a9b4c1d9e7f6a5b4c3d2e1f"`
+}
+
+// HistoryResponse is the history of a url
+//
+// @Description the history of a url, the latest first
+type HistoryResponse struct {
+	Url string `json:"url" example:"https://example.com/1.jpg"`
+	// true if the url has been downloaded
+	Completed bool           `json:"completed" example:"true"`
+	Entries   []HistoryEntry `json:"entries"`
+}
@@ -0,0 +1,97 @@
+package entity
+
+import (
+	"strings"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobDone      JobStatus = "done"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// IsTerminal returns true if the job would not change anymore
+func (s JobStatus) IsTerminal() bool {
+	return s == JobDone || s == JobFailed || s == JobCancelled
+}
+
+// Job is an async download request and its result
+//
+// @Description an async download request and its result
+type Job struct {
+	ID string `json:"id" example:"5f0c4d2e8a9b4c1d9e7f6a5b4c3d2e1f"`
+	// without the cookies and the sensitive headers when shown, see Job.Redacted
+	Request *DownloadRequest `json:"request"`
+	// name of the token that submitted the job
+	Owner string `json:"owner,omitempty" example:"crawler"`
+	// ID of the batch if it's submitted in a batch
+	BatchID string    `json:"batch_id,omitempty" example:"9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d"`
+	Status  JobStatus `json:"status" example:"done" enums:"queued,running,done,failed,cancelled"`
+	// status code of the upstream response. 0 if there's no response
+	StatusCode int `json:"status_code,omitempty" example:"200"`
+	// see also `classify.Class`
+	Classification string `json:"classification,omitempty" example:"ok"`
+	// where the file is saved
+	Output string `json:"output,omitempty" example:"out/example/1.jpg"`
+	// size of the response body in bytes
+	Size int64 `json:"size,omitempty" example:"102400"`
+	// hex encoded SHA-256 of the response body
+	SHA256 string `json:"sha256,omitempty" example:"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"`
+	// the other digests by algorithm, like `md5`
+	Digests map[string]string `json:"digests,omitempty"`
+	// path of the existing image of the same directory that looks the same
+	NearDuplicateOf string `json:"near_duplicate_of,omitempty" example:"out/example/0.jpg"`
+	// true if nothing is saved, since the url has been downloaded before or the
+	// image is a near duplicate
+	Skipped   bool      `json:"skipped,omitempty" example:"false"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SensitiveHeaders are the request headers never shown in a job, like
+// the credentials of the target site
+var SensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+	"X-Csrf-Token",
+}
+
+// Redacted returns a copy of the job to show to the clients and the webhooks,
+// without the cookies and the sensitive headers of its request
+func (j Job) Redacted() Job {
+	if j.Request == nil {
+		return j
+	}
+	r := *j.Request
+	r.Cookies = nil
+	r.Headers = nil
+	for k, v := range j.Request.Headers {
+		if isSensitiveHeader(k) {
+			continue
+		}
+		if r.Headers == nil {
+			r.Headers = make(map[string]string)
+		}
+		r.Headers[k] = v
+	}
+	j.Request = &r
+	return j
+}
+
+func isSensitiveHeader(name string) bool {
+	for _, h := range SensitiveHeaders {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package entity
+
+import "time"
+
+// FileMetadata is what is known about a saved file
+//
+// @Description what is known about a saved file
+type FileMetadata struct {
+	// where the file is saved
+	Path       string `json:"path" example:"out/example/1.jpg"`
+	Url        string `json:"url" example:"https://example.com/1.jpg"`
+	FinalUrl   string `json:"final_url" example:"https://cdn.example.com/1.jpg"`
+	StatusCode int    `json:"status_code" example:"200"`
+	// the response headers of interest, like `Content-Type` and `ETag`
+	Headers map[string]string `json:"headers,omitempty"`
+	Size    int64             `json:"size" example:"102400"`
+	SHA256  string            `json:"sha256" example:"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"`
+	// the other digests by algorithm, like `md5`
+	Digests   map[string]string `json:"digests,omitempty"`
+	FetchedAt time.Time         `json:"fetched_at"`
+	// like `jpeg`, `png`, `gif` or `webp`. empty if unknown
+	Format string `json:"format,omitempty" example:"jpeg"`
+	Width  int    `json:"width,omitempty" example:"1920"`
+	Height int    `json:"height,omitempty" example:"1080"`
+	// the browser the client impersonates
+	Impersonation string `json:"impersonation" example:"chrome"`
+	JobID         string `json:"job_id,omitempty" example:"5f0c4d2e8a9b4c1d9e7f6a5b4c3d2e1f"`
+}
@@ -0,0 +1,25 @@
+package entity
+
+// RedirectPolicy controls how the redirect responses are followed.
+// When a redirect is not allowed, the redirect response itself is returned.
+//
+// @Description redirect policy. See also entity.DownloadRequest
+type RedirectPolicy struct {
+	// max number of redirects to follow. 0 means the default (10)
+	MaxRedirects int `json:"max_redirects,omitempty" mapstructure:"max_redirects" example:"10"`
+	// only follow the redirects to the same host as the original request
+	SameHostOnly bool `json:"same_host_only,omitempty" mapstructure:"same_host_only"`
+	// don't follow any redirect
+	NoFollow bool `json:"no_follow,omitempty" mapstructure:"no_follow"`
+}
+
+// RedirectHop is a redirect response that has been followed
+//
+// @Description a redirect response that has been followed
+type RedirectHop struct {
+	Url        string `json:"url" example:"https://example.com/"`
+	StatusCode int    `json:"status_code" example:"302"`
+	Location   string `json:"location" example:"https://example.com/login"`
+	// raw `Set-Cookie` headers of the redirect response
+	SetCookies []string `json:"set_cookies,omitempty"`
+}
@@ -21,4 +21,8 @@ type ReqResp struct {
 	ResponseChannel ResponseChannelT
 	IsSync          bool
 	Context         context.Context
+	// ID of the job in the job store. Empty for sync requests.
+	JobID string
+	// name of the token that submitted the request. Empty if authentication is disabled.
+	Owner string
 }
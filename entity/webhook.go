@@ -0,0 +1,23 @@
+package entity
+
+import "time"
+
+// JobEvent is POSTed to the callback url when a job finishes
+//
+// @Description POSTed to the callback url when a job finishes
+type JobEvent struct {
+	// `job.done`, `job.failed` or `job.cancelled`
+	Event string `json:"event" example:"job.done" enums:"job.done,job.failed,job.cancelled"`
+	// the same across the retries of a delivery
+	DeliveryID string `json:"delivery_id" example:"0f1e2d3c4b5a69788796a5b4c3d2e1f0"`
+	Job        Job    `json:"job"`
+}
+
+// DeadLetter is a callback that could not be delivered
+type DeadLetter struct {
+	CallbackUrl string    `json:"callback_url"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error"`
+	Event       JobEvent  `json:"event"`
+	Time        time.Time `json:"time"`
+}
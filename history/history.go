@@ -0,0 +1,307 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/phash"
+	"github.com/crosstyan/dumb_downloader/utils"
+	"github.com/joomcode/errorx"
+)
+
+type Config struct {
+	// NDJSON file of the entries. empty disables the history
+	File string `mapstructure:"file"`
+	// skip the urls that have been downloaded, wherever the files are now
+	SkipCompleted bool `mapstructure:"skip_completed"`
+	// the latest entries of each url kept when the file is loaded. The older
+	// ones are dropped from the file. 0 keeps everything
+	MaxPerUrl int `mapstructure:"max_per_url"`
+}
+
+var DefaultConfig = Config{
+	File:          "dumbdl-history.ndjson",
+	SkipCompleted: true,
+	MaxPerUrl:     10,
+}
+
+// Store is the history of the downloads, by url. The entries are appended
+// to the file and loaded in memory. A nil Store records nothing.
+type Store struct {
+	mu        sync.RWMutex
+	file      string
+	maxPerUrl int
+	// the entries of each url, in the order they are recorded
+	entries map[string][]entity.HistoryEntry
+	// the latest entry of each hashed image by path, by directory
+	images map[string]map[string]entity.HistoryEntry
+	// the images of images by bands of their hashes. Built by Similar
+	index *bandIndex
+}
+
+// Open loads the history from the file of config, and compacts the file if
+// an url has more entries than MaxPerUrl. Returns nil if the file is not configured.
+func Open(config Config) (*Store, error) {
+	if config.File == "" {
+		return nil, nil
+	}
+	s := &Store{
+		file:      config.File,
+		maxPerUrl: config.MaxPerUrl,
+		entries:   make(map[string][]entity.HistoryEntry),
+		images:    make(map[string]map[string]entity.HistoryEntry),
+	}
+	f, err := os.Open(config.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to open history %s", config.File)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line, dropped := 0, 0
+	for scanner.Scan() {
+		line++
+		var e entity.HistoryEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Url == "" {
+			// a line cut by a crash
+			log.Sugar().Warnw("bad history entry. skip.", "file", config.File, "line", line, "error", err)
+			continue
+		}
+		dropped += s.addLocked(e)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errorx.Decorate(err, "failed to read history %s", config.File)
+	}
+	if dropped > 0 {
+		if err = s.compact(); err != nil {
+			return nil, errorx.Decorate(err, "failed to compact history %s", config.File)
+		}
+		log.Sugar().Infow("history compacted", "file", config.File, "dropped", dropped)
+	}
+	return s, nil
+}
+
+// compact rewrites the file with the entries kept in memory, the oldest first
+func (s *Store) compact() error {
+	var kept []entity.HistoryEntry
+	for _, entries := range s.entries {
+		kept = append(kept, entries...)
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].Time.Before(kept[j].Time)
+	})
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range kept {
+		if err := enc.Encode(&kept[i]); err != nil {
+			return err
+		}
+	}
+	return utils.WriteFileAtomic(s.file, buf.Bytes(), 0644)
+}
+
+// Record appends the entry to the history
+func (s *Store) Record(e entity.HistoryEntry) error {
+	if s == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	s.addLocked(e)
+	return nil
+}
+
+// addLocked adds the entry in memory, and returns the number of the older
+// entries of the url dropped beyond maxPerUrl
+func (s *Store) addLocked(e entity.HistoryEntry) int {
+	entries := append(s.entries[e.Url], e)
+	dropped := 0
+	if s.maxPerUrl > 0 && len(entries) > s.maxPerUrl {
+		dropped = len(entries) - s.maxPerUrl
+		entries = append([]entity.HistoryEntry(nil), entries[dropped:]...)
+	}
+	s.entries[e.Url] = entries
+	// the near duplicate skipped refers to the file of another
+	if e.Status != entity.JobDone || e.AHash == "" || e.Path == "" || e.Path == e.NearDuplicateOf {
+		return dropped
+	}
+	h, ok := phash.ParseHashes(e.AHash, e.DHash)
+	if !ok {
+		return dropped
+	}
+	dir := filepath.Dir(e.Path)
+	if s.images[dir] == nil {
+		s.images[dir] = make(map[string]entity.HistoryEntry)
+	}
+	if old, ok := s.images[dir][e.Path]; ok {
+		s.index.remove(old)
+	}
+	s.images[dir][e.Path] = e
+	s.index.add(e.Path, h)
+	return dropped
+}
+
+// Get returns the entries of the url, the latest first
+func (s *Store) Get(url string) []entity.HistoryEntry {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := s.entries[url]
+	latest := make([]entity.HistoryEntry, len(entries))
+	for i, e := range entries {
+		latest[len(entries)-1-i] = e
+	}
+	return latest
+}
+
+// Completed returns the latest entry of the url that is done
+func (s *Store) Completed(url string) (entity.HistoryEntry, bool) {
+	if s == nil {
+		return entity.HistoryEntry{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := s.entries[url]
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Status == entity.JobDone {
+			return entries[i], true
+		}
+	}
+	return entity.HistoryEntry{}, false
+}
+
+// Query filters the entries. The zero value matches everything.
+type Query struct {
+	// substring of the url or the path
+	Pattern string
+	Status  entity.JobStatus
+	Since   time.Time
+	// only the latest entry of each url
+	Latest bool
+}
+
+func (q *Query) match(e *entity.HistoryEntry) bool {
+	if q.Status != "" && e.Status != q.Status {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	return q.Pattern == "" || strings.Contains(e.Url, q.Pattern) || strings.Contains(e.Path, q.Pattern)
+}
+
+// Search returns the entries matching the query, the oldest first
+func (s *Store) Search(q Query) []entity.HistoryEntry {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	var found []entity.HistoryEntry
+	for _, entries := range s.entries {
+		if q.Latest && len(entries) > 0 {
+			entries = entries[len(entries)-1:]
+		}
+		for i := range entries {
+			if q.match(&entries[i]) {
+				found = append(found, entries[i])
+			}
+		}
+	}
+	s.mu.RUnlock()
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Time.Before(found[j].Time)
+	})
+	return found
+}
+
+// Similar returns the image nearest to the hashes within maxDistance in the
+// directory of path, other than the image at path. Only the images sharing a
+// band of the hashes are compared, see bandIndex.
+func (s *Store) Similar(path string, h phash.Hashes, maxDistance int) (entity.HistoryEntry, bool) {
+	if s == nil {
+		return entity.HistoryEntry{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index == nil || s.index.n != bandsFor(maxDistance) {
+		s.index = newBandIndex(bandsFor(maxDistance))
+		for _, byPath := range s.images {
+			for p, e := range byPath {
+				if eh, ok := phash.ParseHashes(e.AHash, e.DHash); ok {
+					s.index.add(p, eh)
+				}
+			}
+		}
+	}
+	dir := filepath.Dir(path)
+	var nearest entity.HistoryEntry
+	found := false
+	best := maxDistance + 1
+	for p := range s.index.candidates(dir, h) {
+		e := s.images[dir][p]
+		if p == path {
+			continue
+		}
+		eh, ok := phash.ParseHashes(e.AHash, e.DHash)
+		if !ok {
+			continue
+		}
+		if d := h.Distance(eh); d < best || (d == best && found && p < nearest.Path) {
+			nearest, found, best = e, true, d
+		}
+	}
+	return nearest, found
+}
+
+// Images returns the latest entry of each hashed image, by directory
+func (s *Store) Images() map[string][]entity.HistoryEntry {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	images := make(map[string][]entity.HistoryEntry, len(s.images))
+	for dir, byPath := range s.images {
+		for _, e := range byPath {
+			images[dir] = append(images[dir], e)
+		}
+		sort.Slice(images[dir], func(i, j int) bool {
+			return images[dir][i].Path < images[dir][j].Path
+		})
+	}
+	return images
+}
@@ -0,0 +1,124 @@
+package history
+
+import (
+	"bufio"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/phash"
+)
+
+func open(t *testing.T, file string, maxPerUrl int) *Store {
+	t.Helper()
+	s, err := Open(Config{File: file, MaxPerUrl: maxPerUrl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func lines(t *testing.T, file string) int {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		n++
+	}
+	return n
+}
+
+// flip flips n bits of h from the bit at offset
+func flip(h uint64, offset int, n int) uint64 {
+	for i := 0; i < n; i++ {
+		h ^= 1 << ((offset + i*7) % 64)
+	}
+	return h
+}
+
+func TestSimilar(t *testing.T) {
+	s := open(t, filepath.Join(t.TempDir(), "history.ndjson"), 0)
+	r := rand.New(rand.NewSource(1))
+	var hashes []phash.Hashes
+	for i := 0; i < 200; i++ {
+		h := phash.Hashes{AHash: r.Uint64(), DHash: r.Uint64()}
+		hashes = append(hashes, h)
+		err := s.Record(entity.HistoryEntry{
+			Url: "https://example.com/" + strconv.Itoa(i), Status: entity.JobDone, Path: "out/" + strconv.Itoa(i) + ".jpg",
+			AHash: phash.Format(h.AHash), DHash: phash.Format(h.DHash),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	const maxDistance = 5
+	tests := []struct {
+		name  string
+		path  string
+		h     phash.Hashes
+		found string
+	}{
+		{"same", "out/new.jpg", hashes[3], "out/3.jpg"},
+		{"within", "out/new.jpg", phash.Hashes{AHash: flip(hashes[7].AHash, 0, 5), DHash: flip(hashes[7].DHash, 3, 5)}, "out/7.jpg"},
+		{"too far", "out/new.jpg", phash.Hashes{AHash: flip(hashes[7].AHash, 0, 6), DHash: hashes[7].DHash}, ""},
+		{"itself", "out/9.jpg", hashes[9], ""},
+		{"another directory", "other/new.jpg", hashes[3], ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, ok := s.Similar(tt.path, tt.h, maxDistance)
+			if ok != (tt.found != "") || e.Path != tt.found {
+				t.Fatalf("Similar = %s, %v, want %q", e.Path, ok, tt.found)
+			}
+		})
+	}
+
+	// replacing the image drops its old hashes
+	h := phash.Hashes{AHash: r.Uint64(), DHash: r.Uint64()}
+	err := s.Record(entity.HistoryEntry{Url: "https://example.com/3", Status: entity.JobDone, Path: "out/3.jpg",
+		AHash: phash.Format(h.AHash), DHash: phash.Format(h.DHash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := s.Similar("out/new.jpg", hashes[3], maxDistance); ok {
+		t.Fatalf("Similar = %s, want the replaced image gone", e.Path)
+	}
+	if e, ok := s.Similar("out/new.jpg", h, maxDistance); !ok || e.Path != "out/3.jpg" {
+		t.Fatalf("Similar = %s, %v, want out/3.jpg", e.Path, ok)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.ndjson")
+	s := open(t, file, 0)
+	for i := 0; i < 5; i++ {
+		for _, u := range []string{"https://example.com/a", "https://example.com/b"} {
+			if err := s.Record(entity.HistoryEntry{Url: u, Status: entity.JobFailed, Error: strconv.Itoa(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := lines(t, file); n != 10 {
+		t.Fatalf("%d lines, want 10", n)
+	}
+	s = open(t, file, 2)
+	if n := lines(t, file); n != 4 {
+		t.Fatalf("%d lines after compaction, want 4", n)
+	}
+	entries := s.Get("https://example.com/a")
+	if len(entries) != 2 || entries[0].Error != "4" || entries[1].Error != "3" {
+		t.Fatalf("entries = %+v, want the latest 2", entries)
+	}
+	// nothing to drop
+	open(t, file, 2)
+	if n := lines(t, file); n != 4 {
+		t.Fatalf("%d lines, want 4", n)
+	}
+}
@@ -0,0 +1,105 @@
+package history
+
+import (
+	"path/filepath"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/phash"
+)
+
+// bandsFor is the number of bands that finds every image within maxDistance.
+// Both hashes of such an image differ in at most 2*maxDistance of the 128 bits,
+// so at least one of 2*maxDistance+1 bands is the same.
+func bandsFor(maxDistance int) int {
+	n := 2*maxDistance + 1
+	if n < 1 {
+		return 1
+	}
+	if n > 128 {
+		return 128
+	}
+	return n
+}
+
+// band is the bits of the hashes in a band, by the masks of the band
+type band struct {
+	a uint64
+	d uint64
+}
+
+type bandKey struct {
+	dir   string
+	i     int
+	value band
+}
+
+// bandIndex buckets the images of each directory by the bands of their
+// hashes (aHash and dHash as 128 bits), so that only the images sharing a
+// band are compared. Nil indexes nothing.
+type bandIndex struct {
+	n       int
+	masks   []band
+	buckets map[bandKey]map[string]struct{}
+}
+
+func newBandIndex(n int) *bandIndex {
+	x := &bandIndex{n: n, masks: make([]band, n), buckets: make(map[bandKey]map[string]struct{})}
+	for i := 0; i < n; i++ {
+		for bit := i * 128 / n; bit < (i+1)*128/n; bit++ {
+			if bit < 64 {
+				x.masks[i].a |= 1 << bit
+			} else {
+				x.masks[i].d |= 1 << (bit - 64)
+			}
+		}
+	}
+	return x
+}
+
+func (x *bandIndex) key(path string, i int, h phash.Hashes) bandKey {
+	m := x.masks[i]
+	return bandKey{dir: filepath.Dir(path), i: i, value: band{a: h.AHash & m.a, d: h.DHash & m.d}}
+}
+
+func (x *bandIndex) add(path string, h phash.Hashes) {
+	if x == nil {
+		return
+	}
+	for i := 0; i < x.n; i++ {
+		k := x.key(path, i, h)
+		if x.buckets[k] == nil {
+			x.buckets[k] = make(map[string]struct{})
+		}
+		x.buckets[k][path] = struct{}{}
+	}
+}
+
+// remove drops the image of the entry
+func (x *bandIndex) remove(e entity.HistoryEntry) {
+	if x == nil {
+		return
+	}
+	h, ok := phash.ParseHashes(e.AHash, e.DHash)
+	if !ok {
+		return
+	}
+	for i := 0; i < x.n; i++ {
+		k := x.key(e.Path, i, h)
+		delete(x.buckets[k], e.Path)
+		if len(x.buckets[k]) == 0 {
+			delete(x.buckets, k)
+		}
+	}
+}
+
+// candidates returns the paths of the images in dir sharing a band with h
+func (x *bandIndex) candidates(dir string, h phash.Hashes) map[string]struct{} {
+	found := make(map[string]struct{})
+	for i := 0; i < x.n; i++ {
+		m := x.masks[i]
+		for p := range x.buckets[bandKey{dir: dir, i: i, value: band{a: h.AHash & m.a, d: h.DHash & m.d}}] {
+			found[p] = struct{}{}
+		}
+	}
+	return found
+}
@@ -0,0 +1,210 @@
+package imageinfo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	// the decoders of the formats that could be checked
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/joomcode/errorx"
+)
+
+const (
+	// ModeNone checks nothing
+	ModeNone = "none"
+	// ModeHeader checks the length, the header and the end of the image
+	ModeHeader = "header"
+	// ModeFull decodes the whole image besides ModeHeader. WebP is only checked by ModeHeader.
+	ModeFull = "full"
+)
+
+type Config struct {
+	// `none`, `header` or `full`
+	Mode string `mapstructure:"mode"`
+}
+
+var DefaultConfig = Config{
+	Mode: ModeHeader,
+}
+
+func (c Config) Check() error {
+	switch c.Mode {
+	case "", ModeNone, ModeHeader, ModeFull:
+		return nil
+	}
+	return errorx.IllegalArgument.New("bad validation mode %s. expect none, header or full", c.Mode)
+}
+
+// MaxDecodePixels is the most pixels of an image decoded by ModeFull. Only the
+// header and the end of a larger image are checked.
+const MaxDecodePixels = 50_000_000
+
+type modeKey struct{}
+
+// WithMode marks the request of the context to be validated by mode, when
+// its response is checked for retry. Only the requests whose body is read
+// as a whole should be marked.
+func WithMode(ctx context.Context, mode string) context.Context {
+	return context.WithValue(ctx, modeKey{}, mode)
+}
+
+// ModeOf returns the mode the request of the context is validated by.
+// ModeNone if it's not marked.
+func ModeOf(ctx context.Context) string {
+	if mode, ok := ctx.Value(modeKey{}).(string); ok && mode != "" {
+		return mode
+	}
+	return ModeNone
+}
+
+// Info is what is known about an image
+type Info struct {
+	// like `jpeg`, `png`, `gif` or `webp`. empty if unknown
+	Format string
+	Width  int
+	Height int
+}
+
+// InvalidError is returned when the image is broken, like truncated
+type InvalidError struct {
+	Reason string
+}
+
+func (e *InvalidError) Error() string {
+	return "invalid image: " + e.Reason
+}
+
+func invalid(format string, a ...any) error {
+	return &InvalidError{Reason: fmt.Sprintf(format, a...)}
+}
+
+// trailerWindow is how far from the end the trailer of JPEG and PNG could be,
+// since some encoders pad the file
+const trailerWindow = 1024
+
+var (
+	jpegEOI = []byte{0xff, 0xd9}
+	pngIEND = []byte("IEND\xae\x42\x60\x82")
+)
+
+// Validate checks the body of the response against its Content-Length, and
+// the image in it by mode. An image of unknown format is not checked.
+func Validate(header http.Header, data []byte, mode string) (Info, error) {
+	if mode == ModeNone || mode == "" {
+		return Info{}, nil
+	}
+	if err := checkLength(header, len(data)); err != nil {
+		return Info{}, err
+	}
+	return Inspect(data, mode == ModeFull)
+}
+
+// checkLength compares the size of the body with Content-Length, which is
+// the size before decoding if Content-Encoding is set
+func checkLength(header http.Header, size int) error {
+	if enc := header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return nil
+	}
+	v := header.Get("Content-Length")
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return nil
+	}
+	if n != int64(size) {
+		return invalid("content length mismatch. expected %d bytes, got %d", n, size)
+	}
+	return nil
+}
+
+// Inspect reads the format and the dimensions of the image, and checks that it's
+// complete. The image is decoded if full, unless it has more than MaxDecodePixels.
+func Inspect(data []byte, full bool) (Info, error) {
+	if isWebP(data) {
+		return inspectWebP(data)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == image.ErrFormat {
+		return Info{}, nil
+	}
+	if err != nil {
+		return Info{Format: format}, invalid("bad %s header: %s", format, err)
+	}
+	info := Info{Format: format, Width: config.Width, Height: config.Height}
+	if info.Width <= 0 || info.Height <= 0 {
+		return info, invalid("bad %s dimensions %dx%d", format, info.Width, info.Height)
+	}
+	switch format {
+	case "jpeg":
+		if i := bytes.LastIndex(data, jpegEOI); i < 0 || len(data)-i-len(jpegEOI) > trailerWindow {
+			return info, invalid("truncated jpeg. no end of image marker")
+		}
+	case "png":
+		if i := bytes.LastIndex(data, pngIEND); i < 0 || len(data)-i-len(pngIEND) > trailerWindow {
+			return info, invalid("truncated png. no IEND chunk")
+		}
+	case "gif":
+		if trimmed := bytes.TrimRight(data, "\x00"); len(trimmed) == 0 || trimmed[len(trimmed)-1] != 0x3b {
+			return info, invalid("truncated gif. no trailer")
+		}
+	}
+	// a small body could declare a huge image to allocate gigabytes
+	if full && int64(info.Width)*int64(info.Height) <= MaxDecodePixels {
+		if _, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			return info, invalid("failed to decode %s: %s", format, err)
+		}
+	}
+	return info, nil
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// inspectWebP checks the RIFF size and reads the dimensions of the first chunk.
+// See https://developers.google.com/speed/webp/docs/riff_container
+func inspectWebP(data []byte) (Info, error) {
+	info := Info{Format: "webp"}
+	if size := binary.LittleEndian.Uint32(data[4:8]); uint64(size)+8 > uint64(len(data)) {
+		return info, invalid("truncated webp. expected %d bytes, got %d", uint64(size)+8, len(data))
+	}
+	if len(data) < 30 {
+		return info, invalid("truncated webp header")
+	}
+	chunk := data[12:16]
+	payload := data[20:]
+	switch string(chunk) {
+	case "VP8X":
+		info.Width = 1 + (int(payload[4]) | int(payload[5])<<8 | int(payload[6])<<16)
+		info.Height = 1 + (int(payload[7]) | int(payload[8])<<8 | int(payload[9])<<16)
+	case "VP8L":
+		if payload[0] != 0x2f {
+			return info, invalid("bad webp lossless signature")
+		}
+		b := binary.LittleEndian.Uint32(payload[1:5])
+		info.Width = 1 + int(b&0x3fff)
+		info.Height = 1 + int(b>>14&0x3fff)
+	case "VP8 ":
+		if !bytes.Equal(payload[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return info, invalid("bad webp lossy signature")
+		}
+		info.Width = int(binary.LittleEndian.Uint16(payload[6:8]) & 0x3fff)
+		info.Height = int(binary.LittleEndian.Uint16(payload[8:10]) & 0x3fff)
+	default:
+		return info, invalid("unknown webp chunk %q", chunk)
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return info, invalid("bad webp dimensions %dx%d", info.Width, info.Height)
+	}
+	return info, nil
+}
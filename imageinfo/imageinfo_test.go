@@ -0,0 +1,85 @@
+package imageinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func encode(t *testing.T, format string) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 16, 8))
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withSize rewrites the dimensions declared in the IHDR chunk of the PNG
+func withSize(data []byte, w uint32, h uint32) []byte {
+	data = append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(data[16:20], w)
+	binary.BigEndian.PutUint32(data[20:24], h)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestValidate(t *testing.T) {
+	pngData, jpegData := encode(t, "png"), encode(t, "jpeg")
+	length := func(n int) http.Header {
+		return http.Header{"Content-Length": {strconv.Itoa(n)}}
+	}
+	tests := []struct {
+		name    string
+		header  http.Header
+		data    []byte
+		mode    string
+		invalid bool
+	}{
+		{"png", length(len(pngData)), pngData, ModeFull, false},
+		{"jpeg", length(len(jpegData)), jpegData, ModeFull, false},
+		{"truncated png", nil, pngData[:len(pngData)-20], ModeHeader, true},
+		{"truncated jpeg", nil, jpegData[:len(jpegData)/2], ModeHeader, true},
+		{"short body", length(len(pngData) + 10), pngData, ModeHeader, true},
+		{"length of the encoded body", http.Header{"Content-Length": {"10"}, "Content-Encoding": {"gzip"}}, pngData, ModeHeader, false},
+		{"unknown format", nil, []byte("not an image"), ModeFull, false},
+		{"not checked", nil, pngData[:30], ModeNone, false},
+		// too large to decode. the header and the end are still checked
+		{"huge png", nil, withSize(pngData, 40000, 40000), ModeFull, false},
+		{"truncated huge png", nil, withSize(pngData, 40000, 40000)[:40], ModeFull, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Validate(tt.header, tt.data, tt.mode)
+			var invalid *InvalidError
+			if tt.invalid != errors.As(err, &invalid) {
+				t.Fatalf("Validate = %v, want invalid %v", err, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestInspectDimensions(t *testing.T) {
+	info, err := Inspect(encode(t, "png"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != "png" || info.Width != 16 || info.Height != 8 {
+		t.Fatalf("info = %+v, want png of 16x8", info)
+	}
+}
@@ -0,0 +1,411 @@
+package job
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/joomcode/errorx"
+)
+
+// Conflict is returned when the job could not be cancelled since it has finished
+var Conflict = errorx.CommonErrors.NewType("conflict")
+
+type batch struct {
+	id        string
+	owner     string
+	jobIDs    []string
+	createdAt time.Time
+	// when the last job is added
+	updatedAt time.Time
+	// closed and replaced when a job of the batch reaches a terminal state
+	changed chan struct{}
+}
+
+func newBatch(id string, owner string, createdAt time.Time) *batch {
+	return &batch{id: id, owner: owner, createdAt: createdAt, updatedAt: createdAt, changed: make(chan struct{})}
+}
+
+// Store keeps the jobs in memory
+type Store struct {
+	mu   sync.RWMutex
+	jobs map[string]*entity.Job
+	// cancel functions of the running jobs
+	cancels map[string]context.CancelFunc
+	batches map[string]*batch
+	// called when a job reaches a terminal state
+	listeners []func(j entity.Job)
+	// closed when the job reaches a terminal state
+	waiters map[string]chan struct{}
+	// Wait returns right away once it's set
+	stopped bool
+	// how long the finished jobs and batches are kept. 0 keeps them forever
+	retention time.Duration
+	lastSweep time.Time
+}
+
+// NewStore creates the store that forgets the finished jobs and batches after
+// retention. 0 retention keeps them forever.
+func NewStore(retention time.Duration) *Store {
+	return &Store{
+		jobs:      make(map[string]*entity.Job),
+		cancels:   make(map[string]context.CancelFunc),
+		batches:   make(map[string]*batch),
+		waiters:   make(map[string]chan struct{}),
+		retention: retention,
+		lastSweep: time.Now(),
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Create creates a queued job of the request
+func (s *Store) Create(r *entity.DownloadRequest, owner string) entity.Job {
+	now := time.Now()
+	j := &entity.Job{
+		ID:        newID(),
+		Request:   r,
+		Owner:     owner,
+		Status:    entity.JobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepLocked(now)
+	s.jobs[j.ID] = j
+	return *j
+}
+
+// CreateBatch creates an empty batch and returns its ID
+func (s *Store) CreateBatch(owner string) string {
+	b := newBatch(newID(), owner, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepLocked(b.createdAt)
+	s.batches[b.id] = b
+	return b.id
+}
+
+// CreateInBatch creates a queued job of the request in the batch
+func (s *Store) CreateInBatch(r *entity.DownloadRequest, owner string, batchID string) entity.Job {
+	j := s.Create(r, owner)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[batchID]
+	if !ok {
+		return j
+	}
+	s.jobs[j.ID].BatchID = batchID
+	b.jobIDs = append(b.jobIDs, j.ID)
+	b.updatedAt = j.CreatedAt
+	return *s.jobs[j.ID]
+}
+
+// Progress counts the jobs of the batch by status
+func (s *Store) Progress(batchID string) (entity.BatchProgress, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.batches[batchID]
+	if !ok {
+		return entity.BatchProgress{}, false
+	}
+	return s.progressLocked(b), true
+}
+
+func (s *Store) progressLocked(b *batch) entity.BatchProgress {
+	p := entity.BatchProgress{
+		ID:        b.id,
+		Owner:     b.owner,
+		JobIDs:    make([]string, 0, len(b.jobIDs)),
+		CreatedAt: b.createdAt,
+	}
+	for _, id := range b.jobIDs {
+		j, ok := s.jobs[id]
+		if !ok {
+			continue
+		}
+		p.JobIDs = append(p.JobIDs, id)
+		p.Total++
+		switch j.Status {
+		case entity.JobQueued:
+			p.Queued++
+		case entity.JobRunning:
+			p.Running++
+		case entity.JobDone:
+			p.Done++
+		case entity.JobFailed:
+			p.Failed++
+		case entity.JobCancelled:
+			p.Cancelled++
+		}
+	}
+	p.Finished = p.Queued == 0 && p.Running == 0
+	return p
+}
+
+// Wait blocks until the job reaches a terminal state, ctx is done or
+// StopWaiting is called. Returns the job as it is then.
+func (s *Store) Wait(ctx context.Context, id string) (entity.Job, bool) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	if !ok || j.Status.IsTerminal() || s.stopped {
+		defer s.mu.Unlock()
+		if !ok {
+			return entity.Job{}, false
+		}
+		return *j, true
+	}
+	ch, ok := s.waiters[id]
+	if !ok {
+		ch = make(chan struct{})
+		s.waiters[id] = ch
+	}
+	s.mu.Unlock()
+	select {
+	case <-ch:
+	case <-ctx.Done():
+	}
+	return s.Get(id)
+}
+
+// WaitBatch blocks until all the jobs of the batch reach a terminal state, ctx is
+// done or StopWaiting is called. Returns the progress as it is then.
+func (s *Store) WaitBatch(ctx context.Context, batchID string) (entity.BatchProgress, bool) {
+	for {
+		s.mu.RLock()
+		b, ok := s.batches[batchID]
+		if !ok {
+			s.mu.RUnlock()
+			return entity.BatchProgress{}, false
+		}
+		p := s.progressLocked(b)
+		changed := b.changed
+		stopped := s.stopped
+		s.mu.RUnlock()
+		if p.Finished || stopped {
+			return p, true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return s.Progress(batchID)
+		}
+	}
+}
+
+// StopWaiting wakes up all the waiters, and makes the later Wait return right away,
+// like when the server is shutting down
+func (s *Store) StopWaiting() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for id, ch := range s.waiters {
+		close(ch)
+		delete(s.waiters, id)
+	}
+	for _, b := range s.batches {
+		close(b.changed)
+		b.changed = make(chan struct{})
+	}
+}
+
+// wakeLocked wakes up the waiters of the job and its batch
+func (s *Store) wakeLocked(j *entity.Job) {
+	if ch, ok := s.waiters[j.ID]; ok {
+		close(ch)
+		delete(s.waiters, j.ID)
+	}
+	if b, ok := s.batches[j.BatchID]; ok {
+		close(b.changed)
+		b.changed = make(chan struct{})
+	}
+}
+
+// Get returns a copy of the job
+func (s *Store) Get(id string) (entity.Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return entity.Job{}, false
+	}
+	return *j, true
+}
+
+// OnTerminal registers f to be called, outside the lock, with the job once it's
+// done, failed or cancelled
+func (s *Store) OnTerminal(f func(j entity.Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, f)
+}
+
+func (s *Store) notify(j entity.Job) {
+	s.mu.RLock()
+	listeners := s.listeners
+	s.mu.RUnlock()
+	for _, f := range listeners {
+		f(j)
+	}
+}
+
+// Update modifies the job with f. It's a no-op if the job doesn't exist
+// or has been cancelled.
+func (s *Store) Update(id string, f func(j *entity.Job)) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	if !ok || j.Status == entity.JobCancelled {
+		s.mu.Unlock()
+		return
+	}
+	wasTerminal := j.Status.IsTerminal()
+	f(j)
+	j.UpdatedAt = time.Now()
+	finished := !wasTerminal && j.Status.IsTerminal()
+	if finished {
+		s.wakeLocked(j)
+	}
+	snapshot := *j
+	s.mu.Unlock()
+	if finished {
+		s.notify(snapshot)
+	}
+}
+
+// Start marks the job as running with the cancel function of its download.
+// Returns false if the job has been cancelled (or doesn't exist).
+func (s *Store) Start(id string, cancel context.CancelFunc) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.Status == entity.JobCancelled {
+		return false
+	}
+	j.Status = entity.JobRunning
+	j.UpdatedAt = time.Now()
+	s.cancels[id] = cancel
+	return true
+}
+
+// Finish forgets the cancel function registered by Start
+func (s *Store) Finish(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cancels, id)
+}
+
+// Cancel marks the job as cancelled and aborts its download if it's running
+func (s *Store) Cancel(id string) (entity.Job, error) {
+	j, err := s.cancel(id)
+	if err == nil {
+		s.notify(j)
+	}
+	return j, err
+}
+
+func (s *Store) cancel(id string) (entity.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return entity.Job{}, errorx.DataUnavailable.New("job %s not found", id)
+	}
+	if j.Status.IsTerminal() {
+		return *j, Conflict.New("job %s is %s", id, j.Status)
+	}
+	j.Status = entity.JobCancelled
+	j.UpdatedAt = time.Now()
+	s.wakeLocked(j)
+	if cancel, ok := s.cancels[id]; ok {
+		cancel()
+		delete(s.cancels, id)
+	}
+	return *j, nil
+}
+
+// Restore puts back a job loaded from disk as queued, keeping its ID
+func (s *Store) Restore(j entity.Job) entity.Job {
+	j.Status = entity.JobQueued
+	j.Error = ""
+	j.UpdatedAt = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.ID] = &j
+	// only the unfinished jobs of the batch are restored
+	if j.BatchID != "" {
+		b, ok := s.batches[j.BatchID]
+		if !ok {
+			b = newBatch(j.BatchID, j.Owner, j.CreatedAt)
+			s.batches[b.id] = b
+		}
+		b.jobIDs = append(b.jobIDs, j.ID)
+	}
+	return j
+}
+
+// Delete removes the job, like the one that could not be queued
+func (s *Store) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	// the waiters see it's gone
+	s.wakeLocked(j)
+	if b, ok := s.batches[j.BatchID]; ok {
+		for i, jid := range b.jobIDs {
+			if jid == id {
+				b.jobIDs = append(b.jobIDs[:i], b.jobIDs[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(s.jobs, id)
+	delete(s.cancels, id)
+}
+
+// sweepLocked forgets the jobs finished for longer than the retention, at most
+// once a minute. The jobs of a batch are forgotten with the batch, once all of
+// them have finished for that long, so that its progress stays whole.
+func (s *Store) sweepLocked(now time.Time) {
+	if s.retention <= 0 || now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	expired := func(j *entity.Job) bool {
+		return j.Status.IsTerminal() && now.Sub(j.UpdatedAt) >= s.retention
+	}
+	for id, b := range s.batches {
+		if now.Sub(b.updatedAt) < s.retention {
+			continue
+		}
+		all := true
+		for _, jid := range b.jobIDs {
+			if j, ok := s.jobs[jid]; ok && !expired(j) {
+				all = false
+				break
+			}
+		}
+		if !all {
+			continue
+		}
+		for _, jid := range b.jobIDs {
+			delete(s.jobs, jid)
+		}
+		delete(s.batches, id)
+	}
+	for id, j := range s.jobs {
+		if j.BatchID == "" && expired(j) {
+			delete(s.jobs, id)
+		}
+	}
+}
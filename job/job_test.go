@@ -0,0 +1,122 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+)
+
+func TestRestoreBatchUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		status entity.JobStatus
+	}{
+		{"done", entity.JobDone},
+		{"failed", entity.JobFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStore(0)
+			r := &entity.DownloadRequest{Url: "https://example.com/1.jpg"}
+			restored := s.Restore(entity.Job{ID: "a", BatchID: "b", Owner: "crawler", Request: r, CreatedAt: time.Now()})
+			if restored.Status != entity.JobQueued {
+				t.Fatalf("restored status = %s, want queued", restored.Status)
+			}
+			s.Restore(entity.Job{ID: "c", BatchID: "b", Owner: "crawler", Request: r, CreatedAt: time.Now()})
+
+			done := make(chan entity.BatchProgress, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				p, _ := s.WaitBatch(ctx, "b")
+				done <- p
+			}()
+
+			for _, id := range []string{"a", "c"} {
+				s.Update(id, func(j *entity.Job) {
+					j.Status = tt.status
+				})
+			}
+			p := <-done
+			if !p.Finished || p.Total != 2 {
+				t.Fatalf("progress = %+v, want 2 finished", p)
+			}
+			// the store must not be left locked
+			if _, ok := s.Get("a"); !ok {
+				t.Fatal("job a not found")
+			}
+			s.StopWaiting()
+		})
+	}
+}
+
+func TestWaitWokenByUpdate(t *testing.T) {
+	s := NewStore(0)
+	j := s.Create(&entity.DownloadRequest{Url: "https://example.com/1.jpg"}, "")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Update(j.ID, func(j *entity.Job) {
+			j.Status = entity.JobDone
+		})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, ok := s.Wait(ctx, j.ID)
+	if !ok || got.Status != entity.JobDone {
+		t.Fatalf("Wait = %+v, %v, want done", got, ok)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	s := NewStore(time.Hour)
+	r := &entity.DownloadRequest{Url: "https://example.com/1.jpg"}
+	done := s.Create(r, "")
+	queued := s.Create(r, "")
+	batchID := s.CreateBatch("")
+	inBatch := s.CreateInBatch(r, "", batchID)
+	running := s.CreateInBatch(r, "", batchID)
+	for _, id := range []string{done.ID, inBatch.ID} {
+		s.Update(id, func(j *entity.Job) {
+			j.Status = entity.JobDone
+		})
+	}
+	s.Update(running.ID, func(j *entity.Job) {
+		j.Status = entity.JobRunning
+	})
+	// as if they were updated 2 hours ago
+	past := time.Now().Add(-2 * time.Hour)
+	for _, j := range s.jobs {
+		j.UpdatedAt = past
+	}
+	s.batches[batchID].updatedAt = past
+
+	s.mu.Lock()
+	s.sweepLocked(time.Now().Add(2 * time.Minute))
+	s.mu.Unlock()
+	if _, ok := s.Get(done.ID); ok {
+		t.Fatal("the finished job is kept")
+	}
+	if _, ok := s.Get(queued.ID); !ok {
+		t.Fatal("the queued job is forgotten")
+	}
+	// the batch has a job still running
+	if p, ok := s.Progress(batchID); !ok || p.Total != 2 {
+		t.Fatalf("progress = %+v, %v, want 2 jobs", p, ok)
+	}
+
+	s.Update(running.ID, func(j *entity.Job) {
+		j.Status = entity.JobFailed
+	})
+	s.jobs[running.ID].UpdatedAt = past
+	s.mu.Lock()
+	s.sweepLocked(time.Now().Add(4 * time.Minute))
+	s.mu.Unlock()
+	if _, ok := s.Progress(batchID); ok {
+		t.Fatal("the finished batch is kept")
+	}
+	if _, ok := s.Get(inBatch.ID); ok {
+		t.Fatal("the job of the finished batch is kept")
+	}
+}
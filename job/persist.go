@@ -0,0 +1,43 @@
+package job
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/utils"
+	"github.com/joomcode/errorx"
+)
+
+// queueFile is the content of the file the queue is persisted to
+type queueFile struct {
+	Jobs []entity.Job `json:"jobs"`
+}
+
+// SaveQueue writes the queued jobs to filename. The file is replaced atomically.
+func SaveQueue(filename string, jobs []entity.Job) error {
+	b, err := json.MarshalIndent(queueFile{Jobs: jobs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = utils.WriteFileAtomic(filename, b, 0600); err != nil {
+		return errorx.Decorate(err, "failed to save queue to %s", filename)
+	}
+	return nil
+}
+
+// LoadQueue reads the jobs saved by SaveQueue. No jobs and no error if the file doesn't exist.
+func LoadQueue(filename string) ([]entity.Job, error) {
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var q queueFile
+	if err = json.Unmarshal(b, &q); err != nil {
+		return nil, errorx.Decorate(err, "bad queue file %s", filename)
+	}
+	return q.Jobs, nil
+}
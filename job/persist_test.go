@@ -0,0 +1,73 @@
+package job
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+)
+
+func TestSaveLoadQueue(t *testing.T) {
+	prefix := "example"
+	expires := time.Unix(1893456000, 0)
+	jobs := []entity.Job{
+		{
+			ID: "a",
+			Request: &entity.DownloadRequest{
+				Url: "https://example.com/1.jpg",
+				Cookies: []http.Cookie{
+					{Name: "session", Value: "s3cret", Domain: ".example.com", Path: "/", HttpOnly: true, Secure: true},
+					{Name: "pref", Value: "1", Domain: "example.com", Expires: expires},
+				},
+				Headers:   map[string]string{"Referer": "https://example.com/"},
+				OutPrefix: &prefix,
+			},
+			Status: entity.JobQueued,
+		},
+		{ID: "b", Request: &entity.DownloadRequest{Url: "https://example.com/2.jpg"}, Status: entity.JobQueued},
+	}
+	filename := filepath.Join(t.TempDir(), "queue.json")
+	if err := SaveQueue(filename, jobs); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadQueue(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(jobs) {
+		t.Fatalf("loaded %d jobs, want %d", len(loaded), len(jobs))
+	}
+	r := loaded[0].Request
+	if r.Url != jobs[0].Request.Url || *r.OutPrefix != prefix || r.Headers["Referer"] != "https://example.com/" {
+		t.Fatalf("request = %+v", r)
+	}
+	if len(r.Cookies) != 2 {
+		t.Fatalf("cookies = %+v, want 2", r.Cookies)
+	}
+	tests := []struct {
+		got  http.Cookie
+		want http.Cookie
+	}{
+		{r.Cookies[0], jobs[0].Request.Cookies[0]},
+		{r.Cookies[1], jobs[0].Request.Cookies[1]},
+	}
+	for _, tt := range tests {
+		if tt.got.Name != tt.want.Name || tt.got.Value != tt.want.Value || tt.got.Domain != tt.want.Domain ||
+			tt.got.Path != tt.want.Path || tt.got.HttpOnly != tt.want.HttpOnly || tt.got.Secure != tt.want.Secure ||
+			!tt.got.Expires.Equal(tt.want.Expires) {
+			t.Errorf("cookie = %+v, want %+v", tt.got, tt.want)
+		}
+	}
+	if len(loaded[1].Request.Cookies) != 0 {
+		t.Errorf("cookies of b = %+v, want none", loaded[1].Request.Cookies)
+	}
+}
+
+func TestLoadQueueMissing(t *testing.T) {
+	jobs, err := LoadQueue(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || jobs != nil {
+		t.Fatalf("LoadQueue = %v, %v, want nothing", jobs, err)
+	}
+}
@@ -0,0 +1,105 @@
+package metadata
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/utils"
+	"github.com/joomcode/errorx"
+)
+
+const (
+	// ModeNone writes no metadata
+	ModeNone = "none"
+	// ModeSidecar writes `<file>.json` next to each file
+	ModeSidecar = "sidecar"
+	// ModeManifest appends a line to `manifest.ndjson` of the directory for each file
+	ModeManifest = "manifest"
+)
+
+// ManifestName is the name of the manifest of a directory
+const ManifestName = "manifest.ndjson"
+
+// SidecarSuffix is appended to the name of the file for its sidecar
+const SidecarSuffix = ".json"
+
+// HeadersOfInterest are the response headers recorded in the metadata
+var HeadersOfInterest = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Encoding",
+	"Content-Disposition",
+	"ETag",
+	"Last-Modified",
+	"Cache-Control",
+	"Date",
+	"Server",
+}
+
+type Config struct {
+	// `none`, `sidecar` or `manifest`
+	Mode string `mapstructure:"mode"`
+	// digests computed besides SHA-256, like `md5`, `sha1` or `sha512`
+	Digests []string `mapstructure:"digests"`
+}
+
+var DefaultConfig = Config{
+	Mode: ModeSidecar,
+}
+
+// Writer records the metadata of the saved files
+type Writer struct {
+	mode string
+	// guards the manifests
+	mu sync.Mutex
+}
+
+func New(mode string) (*Writer, error) {
+	switch mode {
+	case "":
+		mode = ModeNone
+	case ModeNone, ModeSidecar, ModeManifest:
+	default:
+		return nil, errorx.IllegalArgument.New("bad metadata mode %s. expect none, sidecar or manifest", mode)
+	}
+	return &Writer{mode: mode}, nil
+}
+
+// Write records the metadata of the file at m.Path
+func (w *Writer) Write(m entity.FileMetadata) error {
+	switch w.mode {
+	case ModeSidecar:
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		return utils.WriteFileAtomic(m.Path+SidecarSuffix, b, 0644)
+	case ModeManifest:
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		f, err := os.OpenFile(filepath.Join(filepath.Dir(m.Path), ManifestName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		_, err = f.Write(append(b, '\n'))
+		return err
+	}
+	return nil
+}
+
+// Remove removes the sidecar of the file, if any
+func (w *Writer) Remove(path string) {
+	if w.mode == ModeSidecar {
+		_ = os.Remove(path + SidecarSuffix)
+	}
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/adaptive"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "dumbdl"
+
+var (
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Number of upstream responses by host, status code and classification.",
+	}, []string{"host", "status", "classification"})
+	RequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "request_errors_total",
+		Help:      "Number of upstream requests failed without a response.",
+	}, []string{"host"})
+	DownloadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Number of bytes of the upstream response bodies.",
+	}, []string{"host"})
+	Retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Number of retried upstream requests.",
+	}, []string{"host"})
+	Latency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the upstream requests, including reading the body.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"host"})
+	ActiveWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_workers",
+		Help:      "Number of workers processing a request.",
+	})
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Number of callback attempts by result: delivered, retried or dead.",
+	}, []string{"result"})
+	InvalidImages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "invalid_images_total",
+		Help:      "Number of responses with a broken image, like truncated, including the retried ones.",
+	}, []string{"host"})
+)
+
+// ObserveResponse records an upstream response
+func ObserveResponse(host string, statusCode int, classification string, size int, latency time.Duration) {
+	Requests.WithLabelValues(host, strconv.Itoa(statusCode), classification).Inc()
+	DownloadedBytes.WithLabelValues(host).Add(float64(size))
+	Latency.WithLabelValues(host).Observe(latency.Seconds())
+}
+
+// RegisterQueue exposes the depth of the request queue
+func RegisterQueue(depth func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Number of requests waiting in the queue.",
+	}, func() float64 { return float64(depth()) })
+}
+
+type concurrencyCollector struct {
+	limiter *adaptive.Limiter
+	limit   *prometheus.Desc
+	running *prometheus.Desc
+}
+
+// RegisterConcurrency exposes the adaptive concurrency of each host
+func RegisterConcurrency(limiter *adaptive.Limiter) {
+	prometheus.MustRegister(&concurrencyCollector{
+		limiter: limiter,
+		limit: prometheus.NewDesc(prometheus.BuildFQName(namespace, "host", "concurrency_limit"),
+			"Adaptive concurrency limit of the host.", []string{"host"}, nil),
+		running: prometheus.NewDesc(prometheus.BuildFQName(namespace, "host", "in_flight"),
+			"Number of requests in flight to the host.", []string{"host"}, nil),
+	})
+}
+
+func (c *concurrencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.limit
+	ch <- c.running
+}
+
+func (c *concurrencyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.limiter.States() {
+		ch <- prometheus.MustNewConstMetric(c.limit, prometheus.GaugeValue, float64(s.Limit), s.Host)
+		ch <- prometheus.MustNewConstMetric(c.running, prometheus.GaugeValue, float64(s.InFlight), s.Host)
+	}
+}
+
+// WriteTextfile writes a snapshot of the metrics in the format of
+// the textfile collector of node_exporter
+func WriteTextfile(filename string) error {
+	return prometheus.WriteToTextfile(filename, prometheus.DefaultGatherer)
+}
@@ -0,0 +1,133 @@
+package pause
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Scope is what to pause or resume. Empty scope means the whole queue.
+//
+// @Description what to pause or resume. empty means the whole queue
+type Scope struct {
+	Host      string  `json:"host,omitempty" example:"i.example.com"`
+	OutPrefix *string `json:"out_prefix,omitempty" example:"example"`
+}
+
+// State is the paused scopes
+//
+// @Description the paused scopes
+type State struct {
+	// the whole queue is paused
+	Paused      bool     `json:"paused"`
+	Hosts       []string `json:"hosts"`
+	OutPrefixes []string `json:"out_prefixes"`
+}
+
+// PausedError is returned for the request whose host or out_prefix is paused
+type PausedError struct {
+	Reason string
+}
+
+func (e *PausedError) Error() string {
+	return "paused: " + e.Reason
+}
+
+// Gate tells if the workers could pick up the requests
+type Gate struct {
+	mu       sync.Mutex
+	all      bool
+	hosts    map[string]struct{}
+	prefixes map[string]struct{}
+	onResume func()
+}
+
+// New creates a gate. onResume (could be nil) is called after every resume,
+// which should put back the requests held.
+func New(onResume func()) *Gate {
+	return &Gate{
+		hosts:    make(map[string]struct{}),
+		prefixes: make(map[string]struct{}),
+		onResume: onResume,
+	}
+}
+
+func cleanPrefix(prefix string) string {
+	return strings.Trim(path.Clean("/"+prefix), "/")
+}
+
+func (g *Gate) Pause(scope Scope) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case scope.Host != "":
+		g.hosts[strings.ToLower(scope.Host)] = struct{}{}
+	case scope.OutPrefix != nil:
+		g.prefixes[cleanPrefix(*scope.OutPrefix)] = struct{}{}
+	default:
+		g.all = true
+	}
+}
+
+func (g *Gate) Resume(scope Scope) {
+	g.mu.Lock()
+	switch {
+	case scope.Host != "":
+		delete(g.hosts, strings.ToLower(scope.Host))
+	case scope.OutPrefix != nil:
+		delete(g.prefixes, cleanPrefix(*scope.OutPrefix))
+	default:
+		g.all = false
+	}
+	g.mu.Unlock()
+	if g.onResume != nil {
+		g.onResume()
+	}
+}
+
+// Check returns a PausedError if the queue, the host or the out_prefix is paused.
+// A paused out_prefix covers its sub directories as well. prefix is nil
+// if the request is not saved.
+func (g *Gate) Check(host string, prefix *string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.all {
+		return &PausedError{Reason: "queue"}
+	}
+	if _, ok := g.hosts[strings.ToLower(host)]; ok {
+		return &PausedError{Reason: "host " + host}
+	}
+	if prefix == nil {
+		return nil
+	}
+	p := cleanPrefix(*prefix)
+	for paused := range g.prefixes {
+		if paused == "" || p == paused || strings.HasPrefix(p, paused+"/") {
+			return &PausedError{Reason: "out_prefix " + paused}
+		}
+	}
+	return nil
+}
+
+// Paused tells if the whole queue is paused
+func (g *Gate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.all
+}
+
+func keys(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (g *Gate) State() State {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return State{Paused: g.all, Hosts: keys(g.hosts), OutPrefixes: keys(g.prefixes)}
+}
@@ -0,0 +1,175 @@
+package phash
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	// the decoders of the formats that could be hashed
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+	"strconv"
+
+	"github.com/joomcode/errorx"
+)
+
+const (
+	// NearDuplicateNone saves the near duplicates like any other image
+	NearDuplicateNone = "none"
+	// NearDuplicateFlag saves the near duplicates and marks them
+	NearDuplicateFlag = "flag"
+	// NearDuplicateSkip doesn't save the near duplicates
+	NearDuplicateSkip = "skip"
+)
+
+type Config struct {
+	// compute the hashes of the saved images
+	Enabled bool `mapstructure:"enabled"`
+	// `none`, `flag` or `skip` the image within MaxDistance of an existing
+	// image of the same directory
+	NearDuplicate string `mapstructure:"near_duplicate"`
+	// the most bits of aHash and of dHash that could differ for near duplicates
+	MaxDistance int `mapstructure:"max_distance"`
+	// the larger images are not hashed, since the whole image is decoded
+	MaxPixels int `mapstructure:"max_pixels"`
+}
+
+var DefaultConfig = Config{
+	Enabled:       true,
+	NearDuplicate: NearDuplicateNone,
+	MaxDistance:   5,
+	MaxPixels:     50_000_000,
+}
+
+func (c Config) Check() error {
+	switch c.NearDuplicate {
+	case "", NearDuplicateNone, NearDuplicateFlag, NearDuplicateSkip:
+	default:
+		return errorx.IllegalArgument.New("bad near_duplicate %s. expect none, flag or skip", c.NearDuplicate)
+	}
+	if c.MaxDistance < 0 || c.MaxDistance > 64 {
+		return errorx.IllegalArgument.New("max_distance should be in [0, 64]")
+	}
+	if c.MaxPixels <= 0 {
+		return errorx.IllegalArgument.New("max_pixels should be positive")
+	}
+	return nil
+}
+
+// Hashes are the perceptual hashes of an image
+type Hashes struct {
+	// each bit is whether the pixel of the 8x8 thumbnail is brighter than the mean
+	AHash uint64
+	// each bit is whether the pixel of the 9x8 thumbnail is brighter than the one on its right
+	DHash uint64
+}
+
+// Distance is the larger Hamming distance of aHash and dHash
+func (h Hashes) Distance(o Hashes) int {
+	return max(bits.OnesCount64(h.AHash^o.AHash), bits.OnesCount64(h.DHash^o.DHash))
+}
+
+// Format returns the hash as 16 hex digits
+func Format(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+// Parse parses the hash formatted by Format
+func Parse(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// ParseHashes parses aHash and dHash. Returns false if any is missing or bad.
+func ParseHashes(a string, d string) (Hashes, bool) {
+	if a == "" || d == "" {
+		return Hashes{}, false
+	}
+	ah, err := Parse(a)
+	if err != nil {
+		return Hashes{}, false
+	}
+	dh, err := Parse(d)
+	if err != nil {
+		return Hashes{}, false
+	}
+	return Hashes{AHash: ah, DHash: dh}, true
+}
+
+// Compute decodes the image and computes its hashes. Only GIF, JPEG and PNG are supported.
+// The image with more than maxPixels pixels is not decoded, which a small body could
+// declare to allocate gigabytes.
+func Compute(data []byte, maxPixels int) (Hashes, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Hashes{}, err
+	}
+	if int64(config.Width)*int64(config.Height) > int64(maxPixels) {
+		return Hashes{}, errorx.IllegalArgument.New("image of %dx%d is too large to hash", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Hashes{}, err
+	}
+	return Of(img), nil
+}
+
+// Of computes the hashes of the image
+func Of(img image.Image) Hashes {
+	var h Hashes
+	a := thumbnail(img, 8, 8)
+	var sum uint32
+	for _, v := range a {
+		sum += v
+	}
+	mean := sum / uint32(len(a))
+	for i, v := range a {
+		if v > mean {
+			h.AHash |= 1 << uint(i)
+		}
+	}
+	d := thumbnail(img, 9, 8)
+	i := 0
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if d[y*9+x] > d[y*9+x+1] {
+				h.DHash |= 1 << uint(i)
+			}
+			i++
+		}
+	}
+	return h
+}
+
+// maxSamples is the most pixels sampled along each side for the thumbnail
+const maxSamples = 256
+
+// thumbnail is the mean luminance of each cell of the w x h grid over the image
+func thumbnail(img image.Image, w int, h int) []uint32 {
+	b := img.Bounds()
+	sums := make([]uint64, w*h)
+	counts := make([]uint64, w*h)
+	dx, dy := b.Dx(), b.Dy()
+	if dx == 0 || dy == 0 {
+		return make([]uint32, w*h)
+	}
+	// large images are sampled, which is good enough for an 8x8 thumbnail
+	stepX, stepY := max(1, dx/maxSamples), max(1, dy/maxSamples)
+	for y := 0; y < dy; y += stepY {
+		cy := y * h / dy
+		for x := 0; x < dx; x += stepX {
+			cx := x * w / dx
+			r, g, bb, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			// ITU-R 601 luma in 16 bits
+			sums[cy*w+cx] += uint64((299*r + 587*g + 114*bb) / 1000)
+			counts[cy*w+cx]++
+		}
+	}
+	cells := make([]uint32, w*h)
+	for i := range cells {
+		if counts[i] > 0 {
+			cells[i] = uint32(sums[i] / counts[i])
+		}
+	}
+	return cells
+}
@@ -0,0 +1,84 @@
+package phash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withSize rewrites the dimensions declared in the IHDR chunk of the PNG
+func withSize(data []byte, w uint32, h uint32) []byte {
+	data = append([]byte(nil), data...)
+	// signature (8), length (4), "IHDR" (4), width (4), height (4)
+	binary.BigEndian.PutUint32(data[16:20], w)
+	binary.BigEndian.PutUint32(data[20:24], h)
+	// the CRC covers the type and the data of the chunk
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func gradient(w int, h int, invert bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x + y) * 255 / (w + h))
+			if invert {
+				v = 255 - v
+			}
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+	return img
+}
+
+func TestCompute(t *testing.T) {
+	a, err := Compute(encodePNG(t, gradient(64, 48, false)), DefaultConfig.MaxPixels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resized, err := Compute(encodePNG(t, gradient(128, 96, false)), DefaultConfig.MaxPixels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inverted, err := Compute(encodePNG(t, gradient(64, 48, true)), DefaultConfig.MaxPixels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := a.Distance(resized); d > DefaultConfig.MaxDistance {
+		t.Errorf("distance to the resized = %d, want at most %d", d, DefaultConfig.MaxDistance)
+	}
+	if d := a.Distance(inverted); d <= DefaultConfig.MaxDistance {
+		t.Errorf("distance to the inverted = %d, want more than %d", d, DefaultConfig.MaxDistance)
+	}
+}
+
+func TestComputeTooLarge(t *testing.T) {
+	data := withSize(encodePNG(t, gradient(2, 2, false)), 40000, 40000)
+	if _, err := Compute(data, DefaultConfig.MaxPixels); err == nil {
+		t.Fatal("Compute decoded an image of 40000x40000")
+	}
+}
+
+func TestParseHashes(t *testing.T) {
+	h := Hashes{AHash: 0x0123456789abcdef, DHash: 42}
+	got, ok := ParseHashes(Format(h.AHash), Format(h.DHash))
+	if !ok || got != h {
+		t.Fatalf("ParseHashes = %+v, %v, want %+v", got, ok, h)
+	}
+	if _, ok = ParseHashes("", Format(h.DHash)); ok {
+		t.Fatal("ParseHashes accepted a missing hash")
+	}
+}
@@ -0,0 +1,292 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/imroc/req/v3"
+	"github.com/joomcode/errorx"
+)
+
+// Config is the policy of the urls that could be fetched
+type Config struct {
+	Enabled bool `mapstructure:"enabled"`
+	// allowed schemes. http and https by default
+	Schemes []string `mapstructure:"schemes"`
+	// if not empty, only these hosts could be fetched.
+	// `*.example.com` matches any subdomain of example.com
+	AllowHosts []string `mapstructure:"allow_hosts"`
+	DenyHosts  []string `mapstructure:"deny_hosts"`
+	// ranges allowed even if they are private, loopback or link-local
+	AllowCIDRs []string `mapstructure:"allow_cidrs"`
+	// extra ranges to block
+	DenyCIDRs []string `mapstructure:"deny_cidrs"`
+	// don't block private, loopback and link-local ranges by default
+	AllowPrivate bool `mapstructure:"allow_private"`
+}
+
+var DefaultConfig = Config{
+	Enabled: true,
+	Schemes: []string{"http", "https"},
+}
+
+// BlockedError is returned when the url or the address is not allowed
+type BlockedError struct {
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	return "blocked by policy: " + e.Reason
+}
+
+func blocked(format string, args ...any) error {
+	return &BlockedError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// reservedCIDRs are not covered by the methods of net.IP
+var reservedCIDRs = []string{
+	"0.0.0.0/8",     // "this" network
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved
+	"64:ff9b::/96",  // NAT64, which could reach private IPv4
+}
+
+type Policy struct {
+	schemes      map[string]struct{}
+	allowHosts   []string
+	denyHosts    []string
+	allowNets    []*net.IPNet
+	denyNets     []*net.IPNet
+	reserved     []*net.IPNet
+	allowPrivate bool
+	// the addresses dialed without checking, like the upstream proxy
+	exempt map[string]struct{}
+	// the requests go through a proxy, so Dial never sees the target
+	proxied  bool
+	resolver *net.Resolver
+	dialer   *net.Dialer
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, errorx.Decorate(err, "bad CIDR %s", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func lower(ss []string) []string {
+	res := make([]string, len(ss))
+	for i, s := range ss {
+		res[i] = strings.ToLower(strings.TrimSuffix(s, "."))
+	}
+	return res
+}
+
+// New creates the policy. It returns nil if it's not enabled, and a nil policy allows everything.
+func New(config Config) (*Policy, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	p := &Policy{
+		schemes:      make(map[string]struct{}),
+		allowHosts:   lower(config.AllowHosts),
+		denyHosts:    lower(config.DenyHosts),
+		allowPrivate: config.AllowPrivate,
+		exempt:       make(map[string]struct{}),
+		resolver:     net.DefaultResolver,
+		dialer:       &net.Dialer{},
+	}
+	schemes := config.Schemes
+	if len(schemes) == 0 {
+		schemes = DefaultConfig.Schemes
+	}
+	for _, s := range schemes {
+		p.schemes[strings.ToLower(s)] = struct{}{}
+	}
+	var err error
+	if p.allowNets, err = parseCIDRs(config.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if p.denyNets, err = parseCIDRs(config.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	if p.reserved, err = parseCIDRs(reservedCIDRs); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Exempt lets the address (host:port) of the upstream proxy be dialed without
+// checking. The targets are then checked by resolving them before sending.
+func (p *Policy) Exempt(addr string) {
+	if p == nil {
+		return
+	}
+	p.exempt[strings.ToLower(addr)] = struct{}{}
+	p.proxied = true
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, pat := range patterns {
+		if suffix, ok := strings.CutPrefix(pat, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pat {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckIP checks if the IP could be connected to
+func (p *Policy) CheckIP(ip net.IP) error {
+	if p == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if contains(p.denyNets, ip) {
+		return blocked("%s is denied", ip)
+	}
+	if contains(p.allowNets, ip) || p.allowPrivate {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || contains(p.reserved, ip) {
+		return blocked("%s is a private, loopback or link-local address", ip)
+	}
+	return nil
+}
+
+// CheckURL checks the scheme and the host of the url. The IP is checked
+// as well if the host is an IP literal.
+func (p *Policy) CheckURL(u *url.URL) error {
+	if p == nil {
+		return nil
+	}
+	if _, ok := p.schemes[strings.ToLower(u.Scheme)]; !ok {
+		return blocked("scheme %s is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return blocked("empty host")
+	}
+	if matchHost(p.denyHosts, host) {
+		return blocked("host %s is denied", host)
+	}
+	if len(p.allowHosts) > 0 && !matchHost(p.allowHosts, host) {
+		return blocked("host %s is not in the allowlist", host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return p.CheckIP(net.IPv4(127, 0, 0, 1))
+	}
+	return nil
+}
+
+// Dial resolves the host and only connects to the allowed IPs, so that
+// DNS rebinding won't work. See also req.Client.SetDial
+func (p *Policy) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if _, ok := p.exempt[strings.ToLower(addr)]; ok {
+		return p.dialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error = blocked("no address of %s", host)
+	for _, ip := range ips {
+		if err = p.CheckIP(ip.IP); err != nil {
+			lastErr = err
+			continue
+		}
+		conn, err := p.dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+// CheckHost resolves the host and checks all of its IPs. Only used behind a
+// proxy, since Dial checks the IP actually connected to otherwise.
+func (p *Policy) CheckHost(ctx context.Context, host string) error {
+	if p == nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+	ips, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return blocked("no address of %s", host)
+	}
+	// the proxy could connect to any of them
+	for _, ip := range ips {
+		if err = p.CheckIP(ip.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wrap checks the url of each round trip, including the ones of redirects.
+// Behind a proxy, the host of the url is resolved and checked as well.
+//
+// See also req.Transport.WrapRoundTripFunc
+func (p *Policy) Wrap(rt http.RoundTripper) req.HttpRoundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		if err := p.CheckURL(r.URL); err != nil {
+			return nil, err
+		}
+		if p.proxied {
+			if err := p.CheckHost(r.Context(), strings.TrimSuffix(r.URL.Hostname(), ".")); err != nil {
+				return nil, err
+			}
+		}
+		return rt.RoundTrip(r)
+	}
+}
+
+// WrapClient installs the policy on the client
+func (p *Policy) WrapClient(client *req.Client) *req.Client {
+	if p == nil {
+		return client
+	}
+	client.SetDial(p.Dial)
+	client.GetTransport().WrapRoundTripFunc(p.Wrap)
+	return client
+}
@@ -0,0 +1,169 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func mustNew(t *testing.T, config Config) *Policy {
+	t.Helper()
+	config.Enabled = true
+	p, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func isBlocked(err error) bool {
+	var b *BlockedError
+	return errors.As(err, &b)
+}
+
+func TestCheckIP(t *testing.T) {
+	p := mustNew(t, Config{
+		AllowCIDRs: []string{"10.0.8.0/24", "93.184.216.0/24"},
+		DenyCIDRs:  []string{"93.184.216.0/28", "203.0.113.0/24"},
+	})
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"93.184.216.34", false},
+		{"2606:4700::6810:84e5", false},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fc00::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"224.0.0.1", true},
+		// reserved ranges not covered by net.IP
+		{"0.1.2.3", true},
+		{"100.64.0.1", true},
+		{"192.0.0.8", true},
+		{"198.18.0.1", true},
+		{"240.0.0.1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		// allow_cidrs
+		{"10.0.8.5", false},
+		{"10.0.9.5", true},
+		// deny_cidrs win over allow_cidrs
+		{"93.184.216.5", true},
+		{"203.0.113.7", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			err := p.CheckIP(net.ParseIP(tt.ip))
+			if tt.blocked != isBlocked(err) {
+				t.Fatalf("CheckIP(%s) = %v, want blocked %v", tt.ip, err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestAllowPrivate(t *testing.T) {
+	p := mustNew(t, Config{AllowPrivate: true, DenyCIDRs: []string{"169.254.0.0/16"}})
+	if err := p.CheckIP(net.ParseIP("10.1.2.3")); err != nil {
+		t.Fatalf("CheckIP = %v with allow_private", err)
+	}
+	if err := p.CheckIP(net.ParseIP("169.254.169.254")); !isBlocked(err) {
+		t.Fatalf("CheckIP = %v, want denied", err)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		url     string
+		blocked bool
+	}{
+		{"public", Config{}, "https://example.com/a.jpg", false},
+		{"scheme", Config{}, "ftp://example.com/a.jpg", true},
+		{"localhost", Config{}, "http://localhost:8080/", true},
+		{"subdomain of localhost", Config{}, "http://a.localhost/", true},
+		{"ip literal", Config{}, "http://169.254.169.254/latest/meta-data/", true},
+		{"ipv6 literal", Config{}, "http://[::1]:8080/", true},
+		{"denied host", Config{DenyHosts: []string{"*.internal"}}, "http://db.internal/", true},
+		{"trailing dot", Config{DenyHosts: []string{"example.com"}}, "http://EXAMPLE.com./", true},
+		{"allowlist", Config{AllowHosts: []string{"*.example.com"}}, "https://img.example.com/", false},
+		{"not in allowlist", Config{AllowHosts: []string{"*.example.com"}}, "https://example.org/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = mustNew(t, tt.config).CheckURL(u)
+			if tt.blocked != isBlocked(err) {
+				t.Fatalf("CheckURL(%s) = %v, want blocked %v", tt.url, err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	p, err := New(Config{Enabled: false})
+	if err != nil || p != nil {
+		t.Fatalf("New = %v, %v, want nil", p, err)
+	}
+	u, _ := url.Parse("http://127.0.0.1/")
+	if err = p.CheckURL(u); err != nil {
+		t.Fatalf("CheckURL = %v, want allowed", err)
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	p := mustNew(t, Config{})
+	// resolved from /etc/hosts
+	if err := p.CheckHost(context.Background(), "localhost"); !isBlocked(err) {
+		t.Fatalf("CheckHost(localhost) = %v, want blocked", err)
+	}
+	if err := p.CheckHost(context.Background(), "93.184.216.34"); err != nil {
+		t.Fatalf("CheckHost = %v, want allowed", err)
+	}
+}
+
+func TestWrapProxied(t *testing.T) {
+	p := mustNew(t, Config{})
+	p.Exempt("127.0.0.1:3128")
+	sent := 0
+	rt := p.Wrap(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	tests := []struct {
+		url     string
+		blocked bool
+	}{
+		{"http://93.184.216.34/", false},
+		{"http://10.0.0.1/", true},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+		_, err := rt(r)
+		if tt.blocked != isBlocked(err) {
+			t.Fatalf("RoundTrip(%s) = %v, want blocked %v", tt.url, err, tt.blocked)
+		}
+	}
+	if sent != 1 {
+		t.Fatalf("sent %d requests, want 1", sent)
+	}
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
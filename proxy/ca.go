@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 365 * 24 * time.Hour
+)
+
+// CA is a local certificate authority that signs the certificates
+// of the hosts being intercepted. The client should trust its certificate.
+type CA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	leafKey *ecdsa.PrivateKey
+	mu      sync.Mutex
+	cache   map[string]*tls.Certificate
+}
+
+func randomSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
+
+func writePEM(p string, blockType string, der []byte, perm os.FileMode) error {
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return os.WriteFile(p, b, perm)
+}
+
+func readPEM(p string) (*pem.Block, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errorx.IllegalFormat.New("no PEM block found in %s", p)
+	}
+	return block, nil
+}
+
+// LoadOrCreateCA loads the CA from certPath and keyPath,
+// or generates a new one and saves it there if both of them do not exist.
+func LoadOrCreateCA(certPath string, keyPath string) (*CA, bool, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		ca, err := createCA(certPath, keyPath)
+		return ca, true, err
+	}
+	ca, err := loadCA(certPath, keyPath)
+	return ca, false, err
+}
+
+func loadCA(certPath string, keyPath string) (*CA, error) {
+	certBlock, err := readPEM(certPath)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to read CA certificate %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to parse CA certificate %s", certPath)
+	}
+	keyBlock, err := readPEM(keyPath)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to read CA key %s", keyPath)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to parse CA key %s", keyPath)
+	}
+	key, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, errorx.IllegalFormat.New("CA key %s is not a signer", keyPath)
+	}
+	return newCA(cert, key)
+}
+
+func createCA(certPath string, keyPath string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to generate CA key")
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "dumbdl local CA", Organization: []string{"dumbdl"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to create CA certificate")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = writePEM(keyPath, "PRIVATE KEY", keyDer, 0600); err != nil {
+		return nil, errorx.Decorate(err, "failed to save CA key %s", keyPath)
+	}
+	if err = writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return nil, errorx.Decorate(err, "failed to save CA certificate %s", certPath)
+	}
+	return newCA(cert, key)
+}
+
+func newCA(cert *x509.Certificate, key crypto.Signer) (*CA, error) {
+	// all the leaf certificates share the same key, which is only kept in memory
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to generate leaf key")
+	}
+	return &CA{
+		cert:    cert,
+		key:     key,
+		leafKey: leafKey,
+		cache:   make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// CertFor returns a certificate for the host signed by the CA
+func (ca *CA) CertFor(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if c, ok := ca.cache[host]; ok && time.Now().Before(c.Leaf.NotAfter) {
+		return c, nil
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, ca.leafKey.Public(), ca.key)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to sign certificate for %s", host)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}
+	ca.cache[host] = c
+	return c, nil
+}
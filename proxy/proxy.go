@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/adaptive"
+	"github.com/crosstyan/dumb_downloader/breaker"
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/policy"
+	"github.com/crosstyan/dumb_downloader/redirect"
+	"github.com/crosstyan/dumb_downloader/utils"
+	"github.com/imroc/req/v3"
+)
+
+// droppedHeaders are the request headers that would break the impersonation.
+// The client fills them according to the fingerprint.
+var droppedHeaders = []string{
+	"User-Agent",
+}
+
+// Proxy is an HTTP forward proxy. Every request (including the ones inside
+// a `CONNECT` tunnel) is re-issued by the impersonated client.
+//
+// The per-host rules of the other modes apply: the url policy, the circuit
+// breaker and the adaptive concurrency. The cookies are up to the client of
+// the proxy, like the redirects. Its `Cookie` header is forwarded as is, and
+// the `Set-Cookie` of the responses are handed back without being kept.
+type Proxy struct {
+	Client *req.Client
+	// CA is used to terminate the TLS of `CONNECT` tunnels
+	CA *CA
+	// nil if the url policy is disabled
+	Policy  *policy.Policy
+	Breaker *breaker.Breaker
+	// nil if adaptive concurrency is disabled
+	Concurrency *adaptive.Limiter
+}
+
+// New creates the proxy. The cookie jar of the client is not used, so the
+// cookies of a caller never leak to another.
+func New(client *req.Client, ca *CA, urlPolicy *policy.Policy, breakers *breaker.Breaker, concurrency *adaptive.Limiter) *Proxy {
+	return &Proxy{
+		Client:      client.Clone().SetCookieJar(nil),
+		CA:          ca,
+		Policy:      urlPolicy,
+		Breaker:     breakers,
+		Concurrency: concurrency,
+	}
+}
+
+// breakerResult tells if the response is a sign of being banned. The body is
+// streamed, so only the status code is looked at.
+func breakerResult(statusCode int) breaker.Result {
+	if statusCode == http.StatusForbidden || statusCode == http.StatusTooManyRequests {
+		return breaker.Failure
+	}
+	return breaker.Success
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a forward proxy. absolute URL is required", http.StatusBadRequest)
+		return
+	}
+	p.forward(w, r, r.URL)
+}
+
+// forward re-issues the request to target and streams the response back
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, target *url.URL) {
+	header := r.Header.Clone()
+	utils.RemoveHopByHopHeaders(header)
+	for _, k := range droppedHeaders {
+		header.Del(k)
+	}
+	// the redirects are up to the client of the proxy
+	ctx := redirect.WithPolicy(r.Context(), entity.RedirectPolicy{NoFollow: true})
+	R := p.Client.R().SetContext(ctx).DisableAutoReadResponse()
+	// the common headers of the impersonation fill the missing ones
+	// and the header order of the fingerprint still applies
+	R.Headers = header
+	if r.Body != nil && r.ContentLength != 0 {
+		R.SetBody(r.Body)
+	}
+	host := target.Hostname()
+	if err := p.Policy.CheckURL(target); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := p.Concurrency.Acquire(r.Context(), host); err != nil {
+		log.Sugar().Warnw("proxy", "method", r.Method, "url", target.String(), "error", err)
+		return
+	}
+	if d, ok := p.Breaker.Allow(host); !ok {
+		p.Concurrency.Cancel(host)
+		err := &breaker.OpenError{Host: host, RetryAfter: d}
+		log.Sugar().Infow("proxy", "method", r.Method, "url", target.String(), "error", err)
+		w.Header().Set("Retry-After", utils.FormatRetryAfter(d))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	start := time.Now()
+	resp, err := R.Send(r.Method, target.String())
+	if err != nil {
+		p.Breaker.Report(host, breaker.Neutral, 0)
+		p.Concurrency.Cancel(host)
+		log.Sugar().Errorw("proxy", "method", r.Method, "url", target.String(), "error", err)
+		var blocked *policy.BlockedError
+		if errors.As(err, &blocked) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	// the time to the response header, since the body is up to the client of the proxy
+	latency := time.Since(start)
+	retryAfter, _ := utils.ParseRetryAfter(resp.Header.Get("Retry-After"))
+	result := breakerResult(resp.StatusCode)
+	p.Breaker.Report(host, result, retryAfter)
+	p.Concurrency.Release(host, latency, result == breaker.Failure || resp.StatusCode == http.StatusServiceUnavailable)
+	utils.CopyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		log.Sugar().Warnw("proxy", "method", r.Method, "url", target.String(), "error", err, "written", n)
+		return
+	}
+	log.Sugar().Infow("proxy", "method", r.Method, "url", target.String(), "status", resp.StatusCode, "written", n)
+}
+
+// serveConnect terminates the TLS with a certificate signed by the CA and serves
+// the requests inside the tunnel as if they were sent to the proxy directly
+func (p *Proxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+	connectHost, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		connectHost = r.Host
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Sugar().Errorw("failed to hijack", "host", r.Host, "error", err)
+		return
+	}
+	// the client could have sent the ClientHello before the response, which is
+	// already read into the buffer
+	if rw.Reader.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, r: rw.Reader}
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	tlsConn := tls.Server(conn, &tls.Config{
+		// the client leg is always HTTP/1.1. The fingerprint only matters for the upstream leg.
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := hello.ServerName
+			if host == "" {
+				host = connectHost
+			}
+			return p.CA.CertFor(host)
+		},
+	})
+	tunnel := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		target := *req.URL
+		target.Scheme = "https"
+		target.Host = req.Host
+		if target.Host == "" {
+			target.Host = r.Host
+		}
+		p.forward(w, req, &target)
+	})
+	srv := &http.Server{Handler: tunnel}
+	// Serve returns once the listener is exhausted. The connection is still being served.
+	_ = srv.Serve(newSingleListener(tlsConn))
+}
+
+// bufferedConn reads what has been buffered before the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// singleListener is a net.Listener that accepts only one connection
+type singleListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func newSingleListener(conn net.Conn) *singleListener {
+	return &singleListener{conn: conn}
+}
+
+func (l *singleListener) Accept() (net.Conn, error) {
+	var c net.Conn
+	l.once.Do(func() {
+		c = l.conn
+	})
+	if c != nil {
+		return c, nil
+	}
+	return nil, io.EOF
+}
+
+func (l *singleListener) Close() error {
+	return nil
+}
+
+func (l *singleListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
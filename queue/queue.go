@@ -0,0 +1,334 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+)
+
+const (
+	// FairByToken shares the workers between the API tokens
+	FairByToken = "token"
+	// FairByOutPrefix shares the workers between the out_prefixes
+	FairByOutPrefix = "out_prefix"
+)
+
+// Config is how the async requests are shared between the clients
+type Config struct {
+	// FairByToken or FairByOutPrefix
+	FairBy string `mapstructure:"fair_by"`
+	// weight of each token or out_prefix. 1 by default
+	Weights map[string]float64 `mapstructure:"weights"`
+	// the requests from the API are rejected once there are this many in the queue.
+	// 0 means unlimited
+	Capacity int `mapstructure:"capacity"`
+}
+
+var DefaultConfig = Config{
+	FairBy:   FairByToken,
+	Capacity: 4096,
+}
+
+// ewmaWeight is the weight of the latest interval between two picks
+const ewmaWeight = 0.2
+
+// FullError is returned when the queue is at its capacity
+type FullError struct {
+	Capacity   int
+	RetryAfter time.Duration
+}
+
+func (e *FullError) Error() string {
+	return fmt.Sprintf("queue is full (capacity %d). retry after %s", e.Capacity, e.RetryAfter)
+}
+
+// Stats is the state of the queue
+//
+// @Description the depth and the estimated wait of the queue
+type Stats struct {
+	Depth int `json:"depth" example:"42"`
+	// 0 means unlimited
+	Capacity int `json:"capacity" example:"4096"`
+	// estimated wait of an async request pushed now, in milliseconds.
+	// 0 if there's nothing to estimate with yet
+	EstimatedWaitMs int64 `json:"estimated_wait_ms" example:"1500"`
+}
+
+type tagged struct {
+	item entity.ReqResp
+	// virtual finish time
+	tag float64
+}
+
+// flow is the requests of a token or an out_prefix
+type flow struct {
+	items  []tagged
+	finish float64
+}
+
+// level is the requests of a priority
+type level struct {
+	flows map[string]*flow
+	vtime float64
+	n     int
+}
+
+// Scheduler replaces the FIFO channel. Sync requests are always picked first.
+// The async ones are picked by priority, and then by weighted fair queuing
+// between the tokens (or out_prefixes), so that none of them could monopolize the workers.
+type Scheduler struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// signaled when a request is picked
+	space  *sync.Cond
+	config Config
+	sync   []entity.ReqResp
+	levels map[int]*level
+	// sorted descending
+	priorities []int
+	n          int
+	closed     bool
+	// the average interval between two picks when the queue is not empty
+	interval time.Duration
+	lastPop  time.Time
+	// the queue has not been empty since lastPop
+	busy bool
+}
+
+func New(config Config) *Scheduler {
+	if config.FairBy == "" {
+		config.FairBy = DefaultConfig.FairBy
+	}
+	s := &Scheduler{config: config, levels: make(map[int]*level)}
+	s.cond = sync.NewCond(&s.mu)
+	s.space = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *Scheduler) key(item entity.ReqResp) string {
+	if s.config.FairBy == FairByOutPrefix {
+		if p := item.Request.OutPrefix; p != nil {
+			return strings.Trim(path.Clean("/"+*p), "/")
+		}
+		return ""
+	}
+	return item.Owner
+}
+
+func (s *Scheduler) weight(key string) float64 {
+	if w, ok := s.config.Weights[key]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// Push adds the request to the queue regardless of the capacity. It's for
+// the requests put back, which have been accepted.
+func (s *Scheduler) Push(item entity.ReqResp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pushLocked(item)
+}
+
+func (s *Scheduler) fullLocked() bool {
+	return s.config.Capacity > 0 && s.n >= s.config.Capacity
+}
+
+func (s *Scheduler) fullError() error {
+	retryAfter := s.interval
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return &FullError{Capacity: s.config.Capacity, RetryAfter: retryAfter}
+}
+
+// TryPush adds the request to the queue, or returns a FullError if it's full
+func (s *Scheduler) TryPush(item entity.ReqResp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fullLocked() {
+		return s.fullError()
+	}
+	s.pushLocked(item)
+	return nil
+}
+
+// PushWait waits for the space until ctx is done, and returns a FullError if
+// there's still no space.
+func (s *Scheduler) PushWait(ctx context.Context, item entity.ReqResp) error {
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.space.Broadcast()
+	})
+	defer stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.fullLocked() {
+		if ctx.Err() != nil {
+			return s.fullError()
+		}
+		s.space.Wait()
+	}
+	s.pushLocked(item)
+	return nil
+}
+
+// pushLocked should be called with lock held
+func (s *Scheduler) pushLocked(item entity.ReqResp) {
+	s.n++
+	defer s.cond.Signal()
+	if item.IsSync {
+		s.sync = append(s.sync, item)
+		return
+	}
+	p := item.Request.Priority
+	l, ok := s.levels[p]
+	if !ok {
+		l = &level{flows: make(map[string]*flow)}
+		s.levels[p] = l
+		s.priorities = append(s.priorities, p)
+		sort.Sort(sort.Reverse(sort.IntSlice(s.priorities)))
+	}
+	k := s.key(item)
+	f, ok := l.flows[k]
+	if !ok {
+		f = &flow{}
+		l.flows[k] = f
+	}
+	start := f.finish
+	if l.vtime > start {
+		start = l.vtime
+	}
+	f.finish = start + 1/s.weight(k)
+	f.items = append(f.items, tagged{item: item, tag: f.finish})
+	l.n++
+}
+
+// popLocked should be called with lock held. Only the sync requests are
+// picked if syncOnly.
+func (s *Scheduler) popLocked(syncOnly bool) (entity.ReqResp, bool) {
+	item, ok := s.pickLocked(syncOnly)
+	if !ok {
+		return item, false
+	}
+	now := time.Now()
+	if s.busy {
+		d := now.Sub(s.lastPop)
+		if s.interval == 0 {
+			s.interval = d
+		} else {
+			s.interval = time.Duration(ewmaWeight*float64(d) + (1-ewmaWeight)*float64(s.interval))
+		}
+	}
+	s.lastPop = now
+	s.busy = s.n > 0
+	s.space.Broadcast()
+	return item, true
+}
+
+// pickLocked should be called with lock held
+func (s *Scheduler) pickLocked(syncOnly bool) (entity.ReqResp, bool) {
+	if len(s.sync) > 0 {
+		item := s.sync[0]
+		s.sync[0] = entity.ReqResp{}
+		s.sync = s.sync[1:]
+		s.n--
+		return item, true
+	}
+	if syncOnly {
+		return entity.ReqResp{}, false
+	}
+	for _, p := range s.priorities {
+		l := s.levels[p]
+		if l.n == 0 {
+			continue
+		}
+		var minKey string
+		var min *flow
+		for k, f := range l.flows {
+			if min == nil || f.items[0].tag < min.items[0].tag ||
+				(f.items[0].tag == min.items[0].tag && k < minKey) {
+				minKey, min = k, f
+			}
+		}
+		head := min.items[0]
+		min.items[0] = tagged{}
+		min.items = min.items[1:]
+		if len(min.items) == 0 {
+			// its finish is not after vtime, so nothing is lost
+			delete(l.flows, minKey)
+		}
+		l.vtime = head.tag
+		l.n--
+		s.n--
+		return head.item, true
+	}
+	return entity.ReqResp{}, false
+}
+
+// Pop blocks until there's a request, or returns false once the scheduler is
+// closed. While paused returns true, only the sync requests are popped, so that
+// their callers could be told instead of waiting. Scheduler.Wake should be called
+// once paused might have changed to false.
+func (s *Scheduler) Pop(paused func() bool) (entity.ReqResp, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.closed {
+			return entity.ReqResp{}, false
+		}
+		if item, ok := s.popLocked(paused()); ok {
+			return item, true
+		}
+		s.cond.Wait()
+	}
+}
+
+// Wake wakes up the ones blocked by Pop to check again
+func (s *Scheduler) Wake() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// TryPop returns a request if there's any, even if the scheduler is closed
+func (s *Scheduler) TryPop() (entity.ReqResp, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.popLocked(false)
+}
+
+// Close wakes up the ones blocked by Pop. The requests are still kept and could
+// be taken by TryPop. Push still works.
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// Stats returns the depth and the estimated wait
+func (s *Scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{
+		Depth:           s.n,
+		Capacity:        s.config.Capacity,
+		EstimatedWaitMs: int64(math.Ceil(float64(s.interval*time.Duration(s.n)) / float64(time.Millisecond))),
+	}
+}
+
+// Len is the number of the requests in the queue
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
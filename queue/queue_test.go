@@ -0,0 +1,179 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+)
+
+func item(owner string, priority int, url string) entity.ReqResp {
+	return entity.ReqResp{Request: &entity.DownloadRequest{Url: url, Priority: priority}, Owner: owner}
+}
+
+func syncItem(url string) entity.ReqResp {
+	i := item("", 0, url)
+	i.IsSync = true
+	return i
+}
+
+// drain pops everything left and returns the urls in order
+func drain(s *Scheduler) []string {
+	var urls []string
+	for {
+		i, ok := s.TryPop()
+		if !ok {
+			return urls
+		}
+		urls = append(urls, i.Request.Url)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		items  []entity.ReqResp
+		want   []string
+	}{
+		{
+			name:   "fair between owners",
+			config: Config{},
+			items: []entity.ReqResp{
+				item("a", 0, "a1"), item("a", 0, "a2"), item("a", 0, "a3"), item("a", 0, "a4"),
+				item("b", 0, "b1"), item("b", 0, "b2"),
+			},
+			want: []string{"a1", "b1", "a2", "b2", "a3", "a4"},
+		},
+		{
+			name:   "weighted",
+			config: Config{Weights: map[string]float64{"a": 2}},
+			items: []entity.ReqResp{
+				item("a", 0, "a1"), item("a", 0, "a2"), item("a", 0, "a3"), item("a", 0, "a4"),
+				item("b", 0, "b1"), item("b", 0, "b2"),
+			},
+			want: []string{"a1", "a2", "b1", "a3", "a4", "b2"},
+		},
+		{
+			name:   "priority first",
+			config: Config{},
+			items: []entity.ReqResp{
+				item("a", 0, "low"), item("a", -1, "lower"), item("b", 5, "high"),
+			},
+			want: []string{"high", "low", "lower"},
+		},
+		{
+			name:   "sync first",
+			config: Config{},
+			items: []entity.ReqResp{
+				item("a", 10, "async"), syncItem("sync1"), syncItem("sync2"),
+			},
+			want: []string{"sync1", "sync2", "async"},
+		},
+		{
+			name:   "fair by out_prefix",
+			config: Config{FairBy: FairByOutPrefix},
+			items: func() []entity.ReqResp {
+				x, y := "x", "/y/"
+				items := []entity.ReqResp{item("a", 0, "x1"), item("a", 0, "x2"), item("a", 0, "y1")}
+				items[0].Request.OutPrefix = &x
+				items[1].Request.OutPrefix = &x
+				items[2].Request.OutPrefix = &y
+				return items
+			}(),
+			want: []string{"x1", "y1", "x2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.config)
+			for _, i := range tt.items {
+				s.Push(i)
+			}
+			if got := drain(s); !equal(got, tt.want) {
+				t.Fatalf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	s := New(Config{Capacity: 2})
+	for i := 0; i < 2; i++ {
+		if err := s.TryPush(item("a", 0, "a")); err != nil {
+			t.Fatalf("TryPush %d = %v", i, err)
+		}
+	}
+	var full *FullError
+	if err := s.TryPush(item("a", 0, "a")); !errors.As(err, &full) || full.Capacity != 2 {
+		t.Fatalf("TryPush = %v, want FullError", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.PushWait(ctx, item("a", 0, "a")); !errors.As(err, &full) {
+		t.Fatalf("PushWait = %v, want FullError", err)
+	}
+	// the ones put back are accepted anyway
+	s.Push(item("a", 0, "a"))
+	if n := s.Len(); n != 3 {
+		t.Fatalf("Len = %d, want 3", n)
+	}
+
+	s.TryPop()
+	s.TryPop()
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.PushWait(ctx, item("a", 0, "a"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.TryPop()
+	if err := <-done; err != nil {
+		t.Fatalf("PushWait = %v once there's space", err)
+	}
+}
+
+func TestPopPaused(t *testing.T) {
+	s := New(Config{})
+	paused := func() bool { return true }
+	s.Push(item("a", 0, "async"))
+	s.Push(syncItem("sync"))
+	i, ok := s.Pop(paused)
+	if !ok || i.Request.Url != "sync" {
+		t.Fatalf("Pop = %v, %v while paused, want the sync request", i.Request, ok)
+	}
+
+	popped := make(chan bool, 1)
+	go func() {
+		_, ok := s.Pop(paused)
+		popped <- ok
+	}()
+	select {
+	case <-popped:
+		t.Fatal("async request popped while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.Close()
+	if ok := <-popped; ok {
+		t.Fatal("Pop = true once closed")
+	}
+	// still kept for persisting
+	if got := drain(s); !equal(got, []string{"async"}) {
+		t.Fatalf("left = %v, want [async]", got)
+	}
+}
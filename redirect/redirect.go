@@ -0,0 +1,90 @@
+package redirect
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/imroc/req/v3"
+)
+
+const DefaultMaxRedirects = 10
+
+type policyKey struct{}
+type recorderKey struct{}
+
+// WithPolicy attaches a per-request policy to the context,
+// which overrides the global one.
+func WithPolicy(ctx context.Context, policy entity.RedirectPolicy) context.Context {
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
+// Recorder records the redirect chain of a request
+type Recorder struct {
+	mu   sync.Mutex
+	hops []entity.RedirectHop
+}
+
+// WithRecorder attaches a new Recorder to the context
+func WithRecorder(ctx context.Context) (context.Context, *Recorder) {
+	r := &Recorder{}
+	return context.WithValue(ctx, recorderKey{}, r), r
+}
+
+// Hops returns the redirects that have been followed
+func (r *Recorder) Hops() []entity.RedirectHop {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]entity.RedirectHop(nil), r.hops...)
+}
+
+func (r *Recorder) record(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	hop := entity.RedirectHop{
+		StatusCode: resp.StatusCode,
+		Location:   resp.Header.Get("Location"),
+		SetCookies: resp.Header.Values("Set-Cookie"),
+	}
+	if resp.Request != nil {
+		hop.Url = resp.Request.URL.String()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hops = append(r.hops, hop)
+}
+
+// Policy creates a client-wide policy which applies the per-request policy
+// from the context if any, otherwise the global one.
+//
+// See also req.Client.SetRedirectPolicy
+func Policy(global entity.RedirectPolicy) req.RedirectPolicy {
+	return func(r *http.Request, via []*http.Request) error {
+		ctx := r.Context()
+		policy, ok := ctx.Value(policyKey{}).(entity.RedirectPolicy)
+		if !ok {
+			policy = global
+		}
+		if policy.NoFollow {
+			return http.ErrUseLastResponse
+		}
+		maxRedirects := policy.MaxRedirects
+		if maxRedirects <= 0 {
+			maxRedirects = DefaultMaxRedirects
+		}
+		if len(via) > maxRedirects {
+			return http.ErrUseLastResponse
+		}
+		if policy.SameHostOnly && !strings.EqualFold(r.URL.Hostname(), via[0].URL.Hostname()) {
+			return http.ErrUseLastResponse
+		}
+		// r.Response is the redirect response that caused this request
+		if rec, ok := ctx.Value(recorderKey{}).(*Recorder); ok {
+			rec.record(r.Response)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+package session
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/imroc/req/v3"
+)
+
+type Config struct {
+	// at most this many sessions are kept. The least recently used one is
+	// dropped beyond it
+	Max int `mapstructure:"max"`
+	// a session unused for this long is dropped. 0 keeps it until it's the
+	// least recently used one beyond `max`
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+}
+
+var DefaultConfig = Config{
+	Max:         64,
+	IdleTimeout: 30 * time.Minute,
+}
+
+type key struct {
+	owner string
+	name  string
+}
+
+type session struct {
+	key      key
+	client   *req.Client
+	lastUsed time.Time
+}
+
+// Store keeps a client for each named session, so that the cookies
+// collected by a session won't leak into others. The sessions of an owner
+// (the token) are not visible to other owners.
+type Store struct {
+	base   *req.Client
+	config Config
+	mu     sync.Mutex
+	// front is the most recently used
+	lru      *list.List
+	sessions map[key]*list.Element
+}
+
+func NewStore(base *req.Client, config Config) *Store {
+	if config.Max <= 0 {
+		config.Max = DefaultConfig.Max
+	}
+	return &Store{base: base, config: config, lru: list.New(), sessions: make(map[key]*list.Element)}
+}
+
+// Client returns the client of the session of the owner, which is cloned
+// from the base client when first used. Empty name refers to the base client.
+func (s *Store) Client(owner string, name string) *req.Client {
+	if name == "" {
+		return s.base
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked(now)
+	k := key{owner: owner, name: name}
+	if e, ok := s.sessions[k]; ok {
+		sess := e.Value.(*session)
+		sess.lastUsed = now
+		s.lru.MoveToFront(e)
+		return sess.client
+	}
+	for s.lru.Len() >= s.config.Max {
+		s.removeLocked(s.lru.Back())
+	}
+	sess := &session{key: k, client: s.base.Clone(), lastUsed: now}
+	s.sessions[k] = s.lru.PushFront(sess)
+	return sess.client
+}
+
+// Len returns the number of the sessions kept
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// expireLocked drops the sessions idle for longer than the timeout
+func (s *Store) expireLocked(now time.Time) {
+	if s.config.IdleTimeout <= 0 {
+		return
+	}
+	for e := s.lru.Back(); e != nil; e = s.lru.Back() {
+		if now.Sub(e.Value.(*session).lastUsed) < s.config.IdleTimeout {
+			return
+		}
+		s.removeLocked(e)
+	}
+}
+
+// removeLocked drops the session with its cookies, and closes its idle
+// connections. A request still using the client finishes as usual.
+func (s *Store) removeLocked(e *list.Element) {
+	sess := s.lru.Remove(e).(*session)
+	delete(s.sessions, sess.key)
+	sess.client.GetTransport().CloseIdleConnections()
+}
@@ -0,0 +1,47 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/imroc/req/v3"
+)
+
+func TestClient(t *testing.T) {
+	base := req.C()
+	s := NewStore(base, Config{Max: 2})
+	if s.Client("a", "") != base {
+		t.Fatal("empty name doesn't refer to the base client")
+	}
+	x := s.Client("a", "x")
+	if x == base || s.Client("a", "x") != x {
+		t.Fatal("the session isn't kept")
+	}
+	if s.Client("b", "x") == x {
+		t.Fatal("another token sees the session")
+	}
+	// x of a is the least recently used
+	s.Client("b", "y")
+	if s.Len() != 2 {
+		t.Fatalf("%d sessions kept, want 2", s.Len())
+	}
+	if s.Client("a", "x") == x {
+		t.Fatal("the least recently used session isn't dropped")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := NewStore(req.C(), Config{Max: 8, IdleTimeout: time.Minute})
+	x := s.Client("", "x")
+	s.Client("", "y")
+	e := s.sessions[key{name: "x"}]
+	e.Value.(*session).lastUsed = time.Now().Add(-2 * time.Minute)
+	// the idle sessions are dropped from the least recently used
+	s.lru.MoveToBack(e)
+	if s.Client("", "x") == x {
+		t.Fatal("the idle session isn't dropped")
+	}
+	if s.Len() != 2 {
+		t.Fatalf("%d sessions kept, want 2", s.Len())
+	}
+}
@@ -0,0 +1,212 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/imroc/req/v3"
+	"golang.org/x/time/rate"
+)
+
+// minBurst is the smallest bucket a limiter would have. A bucket smaller
+// than a single read would make every read wait.
+const minBurst = 32 * 1024
+
+// Config is the bandwidth budget in bytes per second.
+// Zero (or negative) means unlimited.
+//
+// @Description bandwidth caps in bytes per second. 0 means unlimited
+type Config struct {
+	// cap shared by every download
+	Global int64 `json:"global" mapstructure:"global" example:"10485760"`
+	// default cap for each host
+	PerHost int64 `json:"per_host" mapstructure:"per_host" example:"2097152"`
+	// override of PerHost for specific hosts
+	Hosts map[string]int64 `json:"hosts,omitempty" mapstructure:"hosts"`
+}
+
+// Limiter is a bandwidth limiter shared by all the workers.
+// The limits could be changed at runtime with Limiter.SetConfig.
+type Limiter struct {
+	mu      sync.RWMutex
+	config  Config
+	global  *rate.Limiter
+	perHost map[string]*rate.Limiter
+}
+
+type requestLimitKey struct{}
+
+// WithRequestLimit attaches a per-request cap (bytes per second) to the context.
+func WithRequestLimit(ctx context.Context, bytesPerSec int64) context.Context {
+	return context.WithValue(ctx, requestLimitKey{}, bytesPerSec)
+}
+
+func requestLimitFrom(ctx context.Context) int64 {
+	v, ok := ctx.Value(requestLimitKey{}).(int64)
+	if !ok {
+		return 0
+	}
+	return v
+}
+
+func toLimit(bytesPerSec int64) rate.Limit {
+	if bytesPerSec <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSec)
+}
+
+func toBurst(bytesPerSec int64) int {
+	if bytesPerSec < minBurst {
+		return minBurst
+	}
+	return int(bytesPerSec)
+}
+
+func newRateLimiter(bytesPerSec int64) *rate.Limiter {
+	return rate.NewLimiter(toLimit(bytesPerSec), toBurst(bytesPerSec))
+}
+
+func setRateLimiter(l *rate.Limiter, bytesPerSec int64) {
+	l.SetLimit(toLimit(bytesPerSec))
+	l.SetBurst(toBurst(bytesPerSec))
+}
+
+func NewLimiter(config Config) *Limiter {
+	l := &Limiter{
+		global:  newRateLimiter(config.Global),
+		perHost: make(map[string]*rate.Limiter),
+	}
+	l.config = normalize(config)
+	return l
+}
+
+func normalize(config Config) Config {
+	hosts := make(map[string]int64, len(config.Hosts))
+	for h, v := range config.Hosts {
+		hosts[strings.ToLower(h)] = v
+	}
+	config.Hosts = hosts
+	return config
+}
+
+// Config returns a copy of current config
+func (l *Limiter) Config() Config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	c := l.config
+	c.Hosts = make(map[string]int64, len(l.config.Hosts))
+	for h, v := range l.config.Hosts {
+		c.Hosts[h] = v
+	}
+	return c
+}
+
+// SetConfig replaces the limits. The change applies to the downloads
+// in progress as well.
+func (l *Limiter) SetConfig(config Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = normalize(config)
+	setRateLimiter(l.global, l.config.Global)
+	for h, hl := range l.perHost {
+		setRateLimiter(hl, l.hostLimit(h))
+	}
+}
+
+// hostLimit should be called with lock held
+func (l *Limiter) hostLimit(host string) int64 {
+	if v, ok := l.config.Hosts[host]; ok {
+		return v
+	}
+	return l.config.PerHost
+}
+
+func (l *Limiter) hostLimiter(host string) *rate.Limiter {
+	host = strings.ToLower(host)
+	l.mu.RLock()
+	hl, ok := l.perHost[host]
+	l.mu.RUnlock()
+	if ok {
+		return hl
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if hl, ok = l.perHost[host]; ok {
+		return hl
+	}
+	hl = newRateLimiter(l.hostLimit(host))
+	l.perHost[host] = hl
+	return hl
+}
+
+// Wrap wraps the response body of each round trip with a throttled reader.
+//
+// See also req.Transport.WrapRoundTripFunc
+func (l *Limiter) Wrap(rt http.RoundTripper) req.HttpRoundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		resp, err := rt.RoundTrip(r)
+		if err != nil || resp == nil || resp.Body == nil {
+			return resp, err
+		}
+		limiters := []*rate.Limiter{l.global, l.hostLimiter(r.URL.Hostname())}
+		if v := requestLimitFrom(r.Context()); v > 0 {
+			limiters = append(limiters, newRateLimiter(v))
+		}
+		resp.Body = &reader{ReadCloser: resp.Body, ctx: r.Context(), limiters: limiters}
+		return resp, nil
+	}
+}
+
+// WrapClient installs the limiter on the transport of the client
+func (l *Limiter) WrapClient(client *req.Client) *req.Client {
+	client.GetTransport().WrapRoundTripFunc(l.Wrap)
+	return client
+}
+
+type reader struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	// never read more than any bucket could hold
+	for _, l := range r.limiters {
+		if b := l.Burst(); len(p) > b {
+			p = p[:b]
+		}
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n <= 0 {
+		return n, err
+	}
+	for _, l := range r.limiters {
+		if e := waitN(r.ctx, l, n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+// waitN waits in chunks since the burst might be shrunk by Limiter.SetConfig
+// after the read
+func waitN(ctx context.Context, l *rate.Limiter, n int) error {
+	for n > 0 {
+		if l.Limit() == rate.Inf {
+			return nil
+		}
+		c := n
+		if b := l.Burst(); c > b {
+			c = b
+		}
+		if err := l.WaitN(ctx, c); err != nil {
+			return err
+		}
+		n -= c
+	}
+	return nil
+}
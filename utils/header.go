@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"math"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hopByHopHeaders are the headers meaningful only for a single transport-level connection.
+//
+// https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHopHeaders removes the hop-by-hop headers in place,
+// including the ones nominated by the `Connection` header.
+func RemoveHopByHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = textproto.TrimString(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, k := range hopByHopHeaders {
+		h.Del(k)
+	}
+}
+
+// CopyHeaders copies the end-to-end headers from src to dst
+func CopyHeaders(dst http.Header, src http.Header) {
+	src = src.Clone()
+	RemoveHopByHopHeaders(src)
+	for k, vs := range src {
+		for _, v := range vs {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// ParseRetryAfter parses the `Retry-After` header, which is either
+// delay-seconds or an HTTP-date.
+func ParseRetryAfter(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s < 0 {
+			return 0, false
+		}
+		return time.Duration(s) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	d := time.Until(t)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// FormatRetryAfter formats d as the delay-seconds of `Retry-After`, rounded up
+// to at least a second
+func FormatRetryAfter(d time.Duration) string {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return strconv.Itoa(s)
+}
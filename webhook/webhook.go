@@ -0,0 +1,243 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/crosstyan/dumb_downloader/entity"
+	"github.com/crosstyan/dumb_downloader/global/log"
+	"github.com/crosstyan/dumb_downloader/metrics"
+	"github.com/crosstyan/dumb_downloader/policy"
+	"github.com/crosstyan/dumb_downloader/utils"
+	"github.com/imroc/req/v3"
+)
+
+const (
+	// SignatureHeader is `sha256=<hex>`, the HMAC-SHA256 of `<timestamp>.<body>` keyed by the secret
+	SignatureHeader = "X-Dumbdl-Signature"
+	// TimestampHeader is the unix time in seconds when the delivery is attempted
+	TimestampHeader = "X-Dumbdl-Timestamp"
+	EventHeader     = "X-Dumbdl-Event"
+	DeliveryHeader  = "X-Dumbdl-Delivery"
+)
+
+type Config struct {
+	// where the results of the jobs without `callback_url` are POSTed. Empty means nowhere
+	DefaultUrl string `mapstructure:"default_url"`
+	// the key of the signature. Not signed if it's empty
+	Secret string `mapstructure:"secret"`
+	// attempts of a delivery before it's dead-lettered
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// the delay before the first retry. Doubled each retry
+	Backoff time.Duration `mapstructure:"backoff"`
+	// upper bound of the delay
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+	// timeout of an attempt
+	Timeout time.Duration `mapstructure:"timeout"`
+	// the undeliverable callbacks are appended to it as NDJSON
+	DeadLetterFile string `mapstructure:"dead_letter_file"`
+}
+
+var DefaultConfig = Config{
+	MaxAttempts:    5,
+	Backoff:        time.Second,
+	MaxBackoff:     time.Minute,
+	Timeout:        10 * time.Second,
+	DeadLetterFile: "dumbdl-dead-letters.ndjson",
+}
+
+// Notifier POSTs the results of the finished jobs to their callback urls
+type Notifier struct {
+	config Config
+	// for the callback urls of the requests, subject to the url policy
+	client *req.Client
+	// for the default url, which is trusted as it's configured by the admin
+	trusted *req.Client
+	// cancelled when the deliveries in progress should give up
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// guards the dead letter file
+	mu sync.Mutex
+}
+
+// New creates the notifier. The callback urls of the requests are subject to
+// the url policy, while the default url is not.
+func New(config Config, urlPolicy *policy.Policy) *Notifier {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 1
+	}
+	newClient := func() *req.Client {
+		return req.C().SetTimeout(config.Timeout).
+			// a redirect of a webhook is likely a misconfiguration
+			SetRedirectPolicy(req.NoRedirectPolicy())
+	}
+	client := newClient()
+	urlPolicy.WrapClient(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Notifier{config: config, client: client, trusted: newClient(), ctx: ctx, cancel: cancel}
+}
+
+// Sign computes the value of SignatureHeader
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Notify delivers the result of the job in the background, if it has a callback url
+// or there's a default one
+func (n *Notifier) Notify(j entity.Job) {
+	u, client := n.config.DefaultUrl, n.trusted
+	if j.Request != nil && j.Request.CallbackUrl != "" {
+		u, client = j.Request.CallbackUrl, n.client
+	}
+	if u == "" {
+		return
+	}
+	ev := entity.JobEvent{
+		Event:      "job." + string(j.Status),
+		DeliveryID: newDeliveryID(),
+		Job:        j.Redacted(),
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.deliver(client, u, ev)
+	}()
+}
+
+func (n *Notifier) backoff(attempt int) time.Duration {
+	d := n.config.Backoff << attempt
+	if d <= 0 || d > n.config.MaxBackoff {
+		return n.config.MaxBackoff
+	}
+	return d
+}
+
+func (n *Notifier) deliver(client *req.Client, u string, ev entity.JobEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Sugar().Errorw("failed to encode job event", "job", ev.Job.ID, "error", err)
+		return
+	}
+	var lastErr error
+	attempt := 0
+	for attempt < n.config.MaxAttempts {
+		var retryAfter time.Duration
+		retryAfter, lastErr = n.post(client, u, ev, body)
+		attempt++
+		if lastErr == nil {
+			log.Sugar().Infow("callback delivered", "url", u, "job", ev.Job.ID, "event", ev.Event, "attempts", attempt)
+			metrics.WebhookDeliveries.WithLabelValues("delivered").Inc()
+			return
+		}
+		log.Sugar().Warnw("failed to deliver callback", "url", u, "job", ev.Job.ID, "attempt", attempt, "error", lastErr)
+		if attempt == n.config.MaxAttempts {
+			break
+		}
+		metrics.WebhookDeliveries.WithLabelValues("retried").Inc()
+		d := n.backoff(attempt - 1)
+		if retryAfter > d {
+			d = retryAfter
+		}
+		select {
+		case <-time.After(d):
+		case <-n.ctx.Done():
+			lastErr = fmt.Errorf("gave up on shutdown: %w", lastErr)
+			n.deadLetter(u, attempt, lastErr, ev)
+			return
+		}
+	}
+	n.deadLetter(u, attempt, lastErr, ev)
+}
+
+// post makes an attempt. A response other than 2xx is an error, with its
+// Retry-After if any.
+func (n *Notifier) post(client *req.Client, u string, ev entity.JobEvent, body []byte) (time.Duration, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	r := client.R().SetContext(n.ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader(TimestampHeader, ts).
+		SetHeader(EventHeader, ev.Event).
+		SetHeader(DeliveryHeader, ev.DeliveryID).
+		SetBodyBytes(body)
+	if n.config.Secret != "" {
+		r.SetHeader(SignatureHeader, Sign(n.config.Secret, ts, body))
+	}
+	resp, err := r.Post(u)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	var retryAfter time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		retryAfter, _ = utils.ParseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return retryAfter, fmt.Errorf("callback responded %s", resp.Status)
+}
+
+func (n *Notifier) deadLetter(u string, attempts int, err error, ev entity.JobEvent) {
+	metrics.WebhookDeliveries.WithLabelValues("dead").Inc()
+	log.Sugar().Errorw("callback dead-lettered", "url", u, "job", ev.Job.ID, "attempts", attempts, "error", err)
+	if n.config.DeadLetterFile == "" {
+		return
+	}
+	b, _ := json.Marshal(entity.DeadLetter{
+		CallbackUrl: u,
+		Attempts:    attempts,
+		Error:       err.Error(),
+		Event:       ev,
+		Time:        time.Now(),
+	})
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, err := os.OpenFile(n.config.DeadLetterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Sugar().Errorw("failed to open dead letter file", "file", n.config.DeadLetterFile, "error", err)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		log.Sugar().Errorw("failed to write dead letter", "file", n.config.DeadLetterFile, "error", err)
+	}
+}
+
+// Close waits for the deliveries in progress until ctx is done. The ones
+// still not delivered by then are dead-lettered.
+func (n *Notifier) Close(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		n.cancel()
+		<-done
+	}
+	n.cancel()
+}